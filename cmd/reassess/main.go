@@ -0,0 +1,59 @@
+// Command reassess runs the membership reassessment against a SQLite cashier database, it is meant to be run
+// by a scheduler every quarter or year with the matching -window.
+//
+//	reassess -db cashier.db -window 2160h -dry-run
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"oa-bitgin/pkg/repository/sqlite"
+	"oa-bitgin/pkg/usecase"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	path := flag.String("db", "", "path of the SQLite database")
+	dryRun := flag.Bool("dry-run", false, "report who would move without changing anything")
+	window := flag.Duration("window", usecase.DefaultSpendWindow, "how far back purchases count toward keeping a tier")
+	grace := flag.Duration("grace", usecase.DefaultDowngradeGrace, "how long a member below the retention spend keeps the tier")
+	flag.Parse()
+	if *path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := sqlite.Open(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	c, err := usecase.NewCashierUsecaseWithUnitOfWork(sqlite.NewUnitOfWork(db), usecase.WithSpendWindow(*window), usecase.WithDowngradeGrace(*grace))
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := c.ReassessMembers(*dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("reassessed %d users at %s, %d changes (dry run: %t)\n", report.Users, report.At.Format(time.RFC3339), len(report.Changes), report.DryRun)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tNAME\tSPEND\tACTION\tFROM\tTO\tGRACE UNTIL")
+	for _, m := range report.Changes {
+		graceUntil := "-"
+		if !m.GraceUntil.IsZero() {
+			graceUntil = m.GraceUntil.Format(time.RFC3339)
+		}
+		action := string(m.Action)
+		if m.Subscribed {
+			action += " (earned)" // the subscribed level is kept until the subscription expires
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%d\t%d\t%s\n", m.UserID, m.Name, m.Spend, action, m.FromLevel, m.ToLevel, graceUntil)
+	}
+	_ = w.Flush()
+}
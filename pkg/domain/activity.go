@@ -1,6 +1,48 @@
 package domain
 
-import "time"
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrActivityBudgetExhausted = errors.New("activity budget exhausted")
+	ErrActivityUserLimit       = errors.New("activity per user limit reached")
+	ErrActivityNotApplicable   = errors.New("activity does not cover the product")
+	ErrActivityNotRunning      = errors.New("activity is not running now")
+	ErrActivityState           = errors.New("activity cannot change from its current state")
+)
+
+type ActivityKind string
+
+const (
+	ActivityBuyToken   ActivityKind = "buy_token"
+	ActivityBuyProduct ActivityKind = "buy_product"
+	ActivityBonus      ActivityKind = "bonus"
+)
+
+// ActivityState is where an activity is in its lifecycle, only running activities are applied.
+type ActivityState string
+
+const (
+	ActivityRunning  ActivityState = "running"
+	ActivityPaused   ActivityState = "paused"   // 暫停，可恢復
+	ActivityCanceled ActivityState = "canceled" // 取消，無法恢復
+	ActivityDeleted  ActivityState = "deleted"  // 軟刪除，保留紀錄但不再列出
+)
+
+// CanBecome reports whether an activity in state s may move to next.
+func (s ActivityState) CanBecome(next ActivityState) bool {
+	switch s {
+	case ActivityRunning, "":
+		return next == ActivityPaused || next == ActivityCanceled || next == ActivityDeleted
+	case ActivityPaused:
+		return next == ActivityRunning || next == ActivityCanceled || next == ActivityDeleted
+	case ActivityCanceled:
+		return next == ActivityDeleted
+	}
+	return false
+}
 
 type Activity interface {
 	SetID(id int)
@@ -8,22 +50,164 @@ type Activity interface {
 	GetPeriod() (time.Time, time.Time)
 	SetPeriod(startTime, endTime time.Time) error
 	IsInPeriod(time time.Time) bool
+	IsRunning(time time.Time) bool
+	GetState() ActivityState
+	SetState(state ActivityState)
+	SetSchedule(schedule *Schedule)
+	NextOccurrences(from time.Time, n int) []Occurrence
+	SetBudget(budget Budget)
+	SetUserLimit(limit Budget)
+	Consume(userUsed BudgetUsage, discount int64) error
 }
 
 type activity struct {
 	ID        int
 	StartDate time.Time
 	EndDate   time.Time
+	Budget    Budget
+	Used      BudgetUsage
+	UserLimit Budget    // 每位使用者可享有的上限
+	Schedule  *Schedule // 週期性時段，nil 表示整個期間皆有效
+	State     ActivityState
+}
+
+// Budget caps what an activity may give away, a zero field means no limit.
+type Budget struct {
+	MaxDiscount    int64 // 活動總折扣上限
+	MaxRedemptions int   // 活動總使用次數上限
+}
+
+type BudgetUsage struct {
+	Discount    int64
+	Redemptions int
+}
+
+// BudgetStatus is what is left of an activity's budget, a remaining value of -1 means no limit.
+type BudgetStatus struct {
+	Budget               Budget
+	Used                 BudgetUsage
+	RemainingDiscount    int64
+	RemainingRedemptions int
+}
+
+// Stacking controls how a BuyTokenActivity combines with the other running activities.
+type Stacking struct {
+	Stackable      bool   // 可與其他可疊加活動及會員折扣相乘
+	Priority       int    // 越大越先套用，同群組或獨佔活動中優先者勝出
+	ExclusionGroup string // 同一群組的活動只會套用一個
+	Exclusive      bool   // 獨佔活動，符合時不套用其他任何活動
 }
 
 type BuyTokenActivity struct {
 	activity
 	MemberLevel      int
 	BuyTokenDiscount int
+	Stacking         Stacking
 }
 
 func (a *activity) IsInPeriod(time time.Time) bool {
-	return a.StartDate.Before(time) && a.EndDate.After(time)
+	return a.StartDate.Before(time) && a.EndDate.After(time) && (a.Schedule == nil || a.Schedule.IsActive(time))
+}
+
+// IsRunning reports whether the activity applies at time, it must be in period and neither paused, canceled nor deleted.
+func (a *activity) IsRunning(time time.Time) bool {
+	return a.GetState() == ActivityRunning && a.IsInPeriod(time)
+}
+
+func (a *activity) GetState() ActivityState {
+	if a.State == "" {
+		return ActivityRunning
+	}
+	return a.State
+}
+
+func (a *activity) SetState(state ActivityState) {
+	a.State = state
+}
+
+func (a *activity) SetSchedule(schedule *Schedule) {
+	a.Schedule = schedule
+}
+
+// NextOccurrences returns up to n windows of the activity that have not ended by from, clipped to its period.
+func (a *activity) NextOccurrences(from time.Time, n int) []Occurrence {
+	if n < 1 || !a.EndDate.After(from) {
+		return nil
+	}
+	if a.Schedule == nil {
+		return []Occurrence{{Start: a.StartDate, End: a.EndDate}}
+	}
+	if from.Before(a.StartDate) {
+		from = a.StartDate
+	}
+	rtn := a.Schedule.Occurrences(from, a.EndDate, n)
+	for i := range rtn {
+		if rtn[i].Start.Before(a.StartDate) {
+			rtn[i].Start = a.StartDate
+		}
+		if rtn[i].End.After(a.EndDate) {
+			rtn[i].End = a.EndDate
+		}
+	}
+	return rtn
+}
+
+// Exhausted reports whether nothing is left of b after used.
+func (b Budget) Exhausted(used BudgetUsage) bool {
+	return b.MaxRedemptions > 0 && used.Redemptions >= b.MaxRedemptions ||
+		b.MaxDiscount > 0 && used.Discount >= b.MaxDiscount
+}
+
+// Allows reports whether one more redemption giving discount stays within b after used.
+func (b Budget) Allows(used BudgetUsage, discount int64) bool {
+	return (b.MaxRedemptions == 0 || used.Redemptions < b.MaxRedemptions) &&
+		(b.MaxDiscount == 0 || used.Discount+discount <= b.MaxDiscount)
+}
+
+func (b Budget) Status(used BudgetUsage) BudgetStatus {
+	s := BudgetStatus{Budget: b, Used: used, RemainingDiscount: -1, RemainingRedemptions: -1}
+	if b.MaxDiscount > 0 {
+		s.RemainingDiscount = b.MaxDiscount - used.Discount
+	}
+	if b.MaxRedemptions > 0 {
+		s.RemainingRedemptions = b.MaxRedemptions - used.Redemptions
+	}
+	return s
+}
+
+func (a *activity) SetBudget(budget Budget) {
+	a.Budget = budget
+}
+
+func (a *activity) SetUserLimit(limit Budget) {
+	a.UserLimit = limit
+}
+
+// Consume records one redemption giving discount by a user who has used userUsed so far.
+func (a *activity) Consume(userUsed BudgetUsage, discount int64) error {
+	if !a.UserLimit.Allows(userUsed, discount) {
+		return ErrActivityUserLimit
+	}
+	if !a.Budget.Allows(a.Used, discount) {
+		return ErrActivityBudgetExhausted
+	}
+	a.Used.Discount += discount
+	a.Used.Redemptions++
+	return nil
+}
+
+// IsExhausted reports whether the activity has nothing left to give.
+func (a *activity) IsExhausted() bool {
+	return a.Budget.Exhausted(a.Used)
+}
+
+// CanCover reports whether the budget left allows one more redemption giving discount.
+func (a *activity) CanCover(discount int64) bool {
+	return a.Budget.Allows(a.Used, discount)
+}
+
+func (a *activity) BudgetStatus() BudgetStatus {
+	return a.Budget.Status(a.Used)
 }
 
 func (a *activity) SetID(id int) {
@@ -52,18 +236,102 @@ func (t *BuyTokenActivity) GetBuyTokenDiscount() int {
 	return t.BuyTokenDiscount
 }
 
+// ProductScope limits a BuyProductActivity to some products, the zero value covers every product.
+// A product is covered when it is listed by ID or category (if any are listed) and its price is in range.
+type ProductScope struct {
+	ProductIDs []int    // 指定商品
+	Categories []string // 指定商品分類
+	MinPrice   int      // 價格下限，0 為不限制
+	MaxPrice   int      // 價格上限，0 為不限制
+}
+
+// Covers reports whether product is in the scope.
+func (s ProductScope) Covers(product Product) bool {
+	if s.MinPrice > 0 && product.Price < s.MinPrice || s.MaxPrice > 0 && product.Price > s.MaxPrice {
+		return false
+	}
+	if len(s.ProductIDs) == 0 && len(s.Categories) == 0 {
+		return true
+	}
+	for _, id := range s.ProductIDs {
+		if id == product.ID {
+			return true
+		}
+	}
+	for _, category := range s.Categories {
+		if category == product.Category {
+			return true
+		}
+	}
+	return false
+}
+
 type BuyProductActivity struct {
 	activity
 	PointDiscount int
+	Scope         ProductScope
 }
 
 func (t *BuyProductActivity) GetPointDiscount() int {
 	return t.PointDiscount
 }
 
+// Covers reports whether the activity may be used to buy product.
+func (t *BuyProductActivity) Covers(product Product) bool {
+	return t.Scope.Covers(product)
+}
+
+// BonusActivity gives extra tokens or points with a token purchase, e.g. buy 1000 get 100 free.
+// The bonus is given for every Threshold tokens bought, up to the caps.
+type BonusActivity struct {
+	activity
+	Threshold     int64 // 每購買多少平台幣
+	BonusToken    int64 // 贈送的平台幣
+	BonusPoint    int64 // 贈送的點數
+	MaxBonusToken int64 // 每筆購買最多贈送的平台幣，0 為不限制
+	MaxBonusPoint int64 // 每筆購買最多贈送的點數，0 為不限制
+}
+
+// Reward returns the bonus for buying token.
+func (b *BonusActivity) Reward(token int64) (bonusToken int64, bonusPoint int64) {
+	if b.Threshold <= 0 {
+		return 0, 0
+	}
+	times := token / b.Threshold
+	bonusToken, bonusPoint = times*b.BonusToken, times*b.BonusPoint
+	if b.MaxBonusToken > 0 && bonusToken > b.MaxBonusToken {
+		bonusToken = b.MaxBonusToken
+	}
+	if b.MaxBonusPoint > 0 && bonusPoint > b.MaxBonusPoint {
+		bonusPoint = b.MaxBonusPoint
+	}
+	return bonusToken, bonusPoint
+}
+
 type ActivityRepository interface {
 	AddBuyTokenActivity(activity BuyTokenActivity) (int, error)
+	GetBuyTokenActivity(id int) (BuyTokenActivity, error)
 	ListBuyTokenActivity() ([]BuyTokenActivity, error)
 	AddBuyProductActivity(activity BuyProductActivity) (int, error)
 	GetBuyProductActivity(id int) (BuyProductActivity, error)
+	ListBuyProductActivity() ([]BuyProductActivity, error)
+	AddBonusActivity(activity BonusActivity) (int, error)
+	GetBonusActivity(id int) (BonusActivity, error)
+	ListBonusActivity() ([]BonusActivity, error)
+	SetBudget(kind ActivityKind, id int, budget Budget) error
+	SetUserLimit(kind ActivityKind, id int, limit Budget) error
+	// SetSchedule replaces the recurring schedule of an activity, nil removes it.
+	SetSchedule(kind ActivityKind, id int, schedule *Schedule) error
+	SetPeriod(kind ActivityKind, id int, startTime, endTime time.Time) error
+	// SetDiscount replaces the discount of a buy token or buy product activity.
+	SetDiscount(kind ActivityKind, id int, discount int) error
+	SetState(kind ActivityKind, id int, state ActivityState) error
+	AddChange(change ActivityChange) error
+	// ListChanges returns the changes made to an activity, oldest first.
+	ListChanges(kind ActivityKind, id int) ([]ActivityChange, error)
+	// GetUserUsage returns what the activity has given to the user so far.
+	GetUserUsage(kind ActivityKind, id int, userID int) (BudgetUsage, error)
+	// ConsumeBudget records one redemption by the user giving discount, it fails with ErrActivityBudgetExhausted
+	// when the budget left cannot cover it and with ErrActivityUserLimit when the user's limit cannot.
+	ConsumeBudget(kind ActivityKind, id int, userID int, discount int64) error
 }
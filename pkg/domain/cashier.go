@@ -5,19 +5,78 @@ import "time"
 type CashierUsecase interface {
 	NewUser(name string, memberLevel int) (int, error)
 	NewBuyTokenActivity(memberLevel int, startTime time.Time, endTime time.Time, discount int) (int, error)
+	NewStackableBuyTokenActivity(memberLevel int, startTime time.Time, endTime time.Time, discount int, stacking Stacking) (int, error)
 	NewBuyProductActivity(startTime time.Time, endTime time.Time, discount int) (int, error)
+	NewScopedBuyProductActivity(startTime time.Time, endTime time.Time, discount int, scope ProductScope) (int, error)
+	NewBonusActivity(startTime time.Time, endTime time.Time, bonus BonusActivity) (int, error)
+	SetActivityBudget(kind ActivityKind, activityID int, budget Budget) error
+	GetActivityBudget(kind ActivityKind, activityID int) (BudgetStatus, error)
+	SetActivityUserLimit(kind ActivityKind, activityID int, limit Budget) error
+	GetActivityUserUsage(kind ActivityKind, activityID int, userID int) (BudgetStatus, error)
+	SetActivitySchedule(kind ActivityKind, activityID int, schedule *Schedule) error
+	ListActivityOccurrences(kind ActivityKind, activityID int, from time.Time, n int) ([]Occurrence, error)
 
-	BuyToken(userID int, token int64) (int, error)
-	BuyTokenWithActivity(userID int, token int64) (int, error)
+	GetBuyTokenActivity(activityID int) (BuyTokenActivity, error)
+	GetBuyProductActivity(activityID int) (BuyProductActivity, error)
+	ListBuyTokenActivities(filter ActivityFilter) ([]BuyTokenActivity, error)
+	ListBuyProductActivities(filter ActivityFilter) ([]BuyProductActivity, error)
+	UpdateActivityPeriod(kind ActivityKind, activityID int, startTime time.Time, endTime time.Time) error
+	UpdateActivityDiscount(kind ActivityKind, activityID int, discount int) error
+	PauseActivity(kind ActivityKind, activityID int) error
+	ResumeActivity(kind ActivityKind, activityID int) error
+	CancelActivity(kind ActivityKind, activityID int, reason string) error
+	DeleteActivity(kind ActivityKind, activityID int, reason string) error
+	GetActivityHistory(kind ActivityKind, activityID int) ([]ActivityChange, error)
+
+	// BuyToken and the other purchases take an optional coupon code, applied on top of the activities when used.
+	BuyToken(userID int, token int64, coupon ...string) (int, error)
+	BuyTokenWithActivity(userID int, token int64, coupon ...string) (int, error)
+	BuyTokenIdempotent(key string, userID int, token int64) (int, error)
+	BuyTokenWithActivityIdempotent(key string, userID int, token int64) (int, error)
+
+	SetVolumeTiers(memberLevel int, tiers []VolumeTier) error
+	GetVolumeTiers(memberLevel int) ([]VolumeTier, error)
+
+	SetMemberTier(tier MemberTier) (int, error)
+	GetMemberTier(level int) (MemberTier, error)
+	ListMemberTiers() ([]MemberTier, error)
+	GetUserSpend(userID int) (int64, error)
+	ReassessMembers(dryRun bool) (ReassessmentReport, error)
+	Subscribe(userID int, level int, autoRenew bool) (Subscription, error)
+	GetSubscription(userID int) (Subscription, error)
+	SetSubscriptionAutoRenew(userID int, autoRenew bool) error
+	RenewSubscriptions(at time.Time) (renewed int, expired int, err error)
 
 	AddPoint(userID int, token int64) error
 
 	GetUserToken(userID int) (int, error)
 	GetUserPoint(userID int) (int, error)
+	GetUserBonusToken(userID int) (int, error)
 
 	NewProduct(name string, price int) (int, error)
-	BuyProduct(userID int, productID int) (int, error)
-	BuyProductWithActivity(userID int, productID int, activityID int) (int, error)
+	NewCategorizedProduct(name string, price int, category string) (int, error)
+	GetProduct(productID int) (Product, error)
+	SetProductStock(productID int, stock int, lowStockThreshold int) error
+	Restock(productID int, quantity int) (int, error)
+	ListLowStockProducts() ([]Product, error)
+	BuyProduct(userID int, productID int, coupon ...string) (int, error)
+	BuyProductWithActivity(userID int, productID int, activityID int, coupon ...string) (int, error)
+	BuyProductIdempotent(key string, userID int, productID int) (int, error)
+	BuyProductWithActivityIdempotent(key string, userID int, productID int, activityID int) (int, error)
+
+	RefundPurchase(purchaseID int, percent int, reason string) (Transaction, error)
+
+	QuoteBuyToken(userID int, token int64, hold time.Duration) (Quote, error)
+	QuoteBuyProduct(userID int, productID int, activityID int, hold time.Duration) (Quote, error)
+	BuyWithQuote(userID int, quoteID string) (int, error)
+
+	NewCouponBatch(batch CouponBatch, count int) (int, []string, error)
+	GetCouponReport(batchID int) (CouponReport, error)
 
 	GetTotalAmount() int64
+	GetTotalSales() (int64, error)
+
+	ReconcileUser(userID int) error
+	GetUserTransactions(userID int, filter TransactionFilter) (TransactionPage, error)
+	GetStateAt(at time.Time) (CashierState, error)
 }
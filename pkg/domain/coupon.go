@@ -0,0 +1,122 @@
+package domain
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCouponNotFound   = errors.New("coupon not found")
+	ErrCouponExpired    = errors.New("coupon expired")
+	ErrCouponUsedUp     = errors.New("coupon used up")
+	ErrCouponUserLimit  = errors.New("coupon per user limit reached")
+	ErrCouponCodeExists = errors.New("coupon code exists")
+)
+
+type CouponKind int
+
+const (
+	CouponDiscount   CouponKind = iota // Value 為折扣 1-100，例如 90 為九折
+	CouponTokenOff                     // Value 為折抵的金額
+	CouponPointBonus                   // Value 為額外贈送的點數
+)
+
+// CouponBatch is a coupon campaign, every code generated for it shares its rules.
+type CouponBatch struct {
+	ID           int
+	Name         string
+	Kind         CouponKind
+	Value        int64
+	StartDate    time.Time
+	EndDate      time.Time
+	MaxUses      int // 每個代碼可使用次數
+	PerUserLimit int // 每位使用者在此批次可使用次數，0 為不限制
+}
+
+// IsValidAt reports whether codes of the batch can be redeemed at t.
+func (b *CouponBatch) IsValidAt(t time.Time) bool {
+	return !t.Before(b.StartDate) && t.Before(b.EndDate)
+}
+
+type Coupon struct {
+	Code    string
+	BatchID int
+	Used    int
+}
+
+// CouponRedemption records one use of a code, EntryID is the purchase it was used for.
+type CouponRedemption struct {
+	ID         int
+	BatchID    int
+	Code       string
+	UserID     int
+	EntryID    int
+	Discount   int64
+	BonusPoint int64
+	CreatedAt  time.Time
+}
+
+// CouponReport sums up the redemptions of a batch.
+type CouponReport struct {
+	Batch           CouponBatch
+	Issued          int
+	Redeemed        int
+	TotalDiscount   int64
+	TotalBonusPoint int64
+	Redemptions     []CouponRedemption
+}
+
+type CouponRepository interface {
+	AddBatch(batch CouponBatch) (int, error)
+	GetBatch(id int) (CouponBatch, error)
+	// AddCoupon returns ErrCouponCodeExists when the code is taken.
+	AddCoupon(coupon Coupon) error
+	GetCoupon(code string) (Coupon, error)
+	ListCoupons(batchID int) ([]Coupon, error)
+	// Redeem consumes one use of the code and records r, it fails with ErrCouponUsedUp or ErrCouponUserLimit
+	// when the batch limits do not allow another use.
+	Redeem(r CouponRedemption) (int, error)
+	ListRedemptions(batchID int) ([]CouponRedemption, error)
+}
+
+// couponAlphabet leaves out characters that are easily mistaken for each other (0/O, 1/I/L).
+const couponAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+const couponGroupSize = 4
+
+// GenerateCouponCode returns a random code such as "K7QM-3XHD".
+func GenerateCouponCode() (string, error) {
+	var sb strings.Builder
+	max := big.NewInt(int64(len(couponAlphabet)))
+	for i := 0; i < couponGroupSize*2; i++ {
+		if i == couponGroupSize {
+			sb.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(couponAlphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// NormalizeCouponCode accepts a code typed by a user in any case, with or without spaces and dashes.
+func NormalizeCouponCode(code string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range strings.ToUpper(code) {
+		if r == '-' || r == ' ' {
+			continue
+		}
+		if n > 0 && n%couponGroupSize == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteRune(r)
+		n++
+	}
+	return sb.String()
+}
@@ -0,0 +1,104 @@
+package domain
+
+import "time"
+
+type EventType string
+
+const (
+	EventUserCreated         EventType = "UserCreated"
+	EventMemberUpgraded      EventType = "MemberUpgraded"
+	EventMemberDowngraded    EventType = "MemberDowngraded"
+	EventMemberSubscribed    EventType = "MemberSubscribed"
+	EventSubscriptionRenewed EventType = "SubscriptionRenewed"
+	EventSubscriptionExpired EventType = "SubscriptionExpired"
+	EventProductCreated      EventType = "ProductCreated"
+	EventProductRestocked    EventType = "ProductRestocked"
+	EventProductLowStock     EventType = "ProductLowStock"
+	EventActivityCreated     EventType = "ActivityCreated"
+	EventActivityUpdated     EventType = "ActivityUpdated"
+	EventTokensPurchased     EventType = "TokensPurchased"
+	EventPointsAdded         EventType = "PointsAdded"
+	EventProductPurchased    EventType = "ProductPurchased"
+	EventPurchaseRefunded    EventType = "PurchaseRefunded"
+)
+
+// Event records a change made by a CashierUsecase command, Token and Point are the user's balance changes.
+type Event struct {
+	Seq         int64     `json:"seq"`
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	UserID      int       `json:"user_id,omitempty"`
+	Name        string    `json:"name,omitempty"`
+	MemberLevel int       `json:"member_level,omitempty"`
+	ProductID   int       `json:"product_id,omitempty"`
+	ActivityID  int       `json:"activity_id,omitempty"`
+	Price       int       `json:"price,omitempty"`
+	Stock       int       `json:"stock,omitempty"`  // 商品庫存
+	Amount      int64     `json:"amount,omitempty"` // 向使用者收取的金額
+	Token       int64     `json:"token,omitempty"`
+	BonusToken  int64     `json:"bonus_token,omitempty"`
+	Point       int64     `json:"point,omitempty"`
+}
+
+type UserState struct {
+	Name        string `json:"name"`
+	MemberLevel int    `json:"member_level"`
+	Token       int64  `json:"token"`
+	BonusToken  int64  `json:"bonus_token"`
+	Point       int64  `json:"point"`
+}
+
+// CashierState is the state rebuilt from events, it is also what a snapshot stores.
+type CashierState struct {
+	Seq         int64             `json:"seq"` // last applied event
+	Time        time.Time         `json:"time"`
+	TotalAmount int64             `json:"total_amount"`
+	Users       map[int]UserState `json:"users"`
+}
+
+func NewCashierState() CashierState {
+	return CashierState{Users: make(map[int]UserState)}
+}
+
+func (s *CashierState) Apply(e Event) {
+	s.Seq = e.Seq
+	s.Time = e.Time
+	user := s.Users[e.UserID]
+	switch e.Type {
+	case EventUserCreated:
+		user.Name = e.Name
+		user.MemberLevel = e.MemberLevel
+	case EventMemberUpgraded, EventMemberDowngraded, EventMemberSubscribed, EventSubscriptionExpired:
+		user.MemberLevel = e.MemberLevel
+	case EventSubscriptionRenewed:
+	case EventTokensPurchased:
+		s.TotalAmount += e.Amount
+	case EventPointsAdded, EventProductPurchased, EventPurchaseRefunded:
+	default:
+		return
+	}
+	user.Token += e.Token
+	user.BonusToken += e.BonusToken
+	user.Point += e.Point
+	s.Users[e.UserID] = user
+}
+
+// Clone returns a copy that does not share the users map.
+func (s *CashierState) Clone() CashierState {
+	rtn := *s
+	rtn.Users = make(map[int]UserState, len(s.Users))
+	for id, u := range s.Users {
+		rtn.Users[id] = u
+	}
+	return rtn
+}
+
+type EventStore interface {
+	// Append assigns the next sequence number to event and writes it to the log.
+	Append(event Event) (Event, error)
+	// Replay calls fn for every event after seq in order, until fn returns false.
+	Replay(afterSeq int64, fn func(event Event) bool) error
+	SaveSnapshot(state CashierState) error
+	// LoadSnapshot returns the latest snapshot taken at or before at.
+	LoadSnapshot(at time.Time) (CashierState, bool, error)
+}
@@ -0,0 +1,128 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type Unit int
+
+const (
+	UnitToken      Unit = iota // 平台幣 (1 token 與 1 元等值)
+	UnitPoint                  // 平台點數
+	UnitBonusToken             // 活動贈送的平台幣，不可退款或兌現
+)
+
+// Platform side accounts, every journal entry is balanced against user accounts with these.
+const (
+	AccountCashierRevenue   = "cashier:revenue"   // 收銀台實收金額
+	AccountCashierSales     = "cashier:sales"     // 商品銷售收入 (平台幣/點數)
+	AccountCashierMembers   = "cashier:members"   // 會員訂閱收入 (平台幣)
+	AccountPromotionExpense = "promotion:expense" // 折扣與贈點支出
+)
+
+func UserAccount(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+type TransactionType string
+
+const (
+	TransactionBuyToken   TransactionType = "buy_token"
+	TransactionAddPoint   TransactionType = "add_point"
+	TransactionBuyProduct TransactionType = "buy_product"
+	TransactionRefund     TransactionType = "refund"
+	TransactionSubscribe  TransactionType = "subscribe"
+)
+
+var ErrPurchaseRefunded = errors.New("purchase already refunded")
+
+type Posting struct {
+	Account string
+	Unit    Unit
+	Debit   int64
+	Credit  int64
+}
+
+// JournalEntry is a balanced set of postings describing a single cashier operation.
+type JournalEntry struct {
+	ID               int
+	Type             TransactionType
+	UserID           int
+	ProductID        int
+	ActivityID       int
+	ActivityIDs      []int  // 所有套用的活動
+	Coupon           string // 使用的優惠碼
+	BonusActivityIDs []int  // 贈送平台幣或點數的活動
+	Charged          int64  // 向使用者收取的金額
+	RefundOf         int    // 退款對應的購買紀錄
+	Percent          int    // 退款比例 1-100
+	Memo             string
+	CreatedAt        time.Time
+	Postings         []Posting
+}
+
+func (e *JournalEntry) Debit(account string, unit Unit, amount int64) {
+	if amount == 0 {
+		return
+	}
+	e.Postings = append(e.Postings, Posting{Account: account, Unit: unit, Debit: amount})
+}
+
+func (e *JournalEntry) Credit(account string, unit Unit, amount int64) {
+	if amount == 0 {
+		return
+	}
+	e.Postings = append(e.Postings, Posting{Account: account, Unit: unit, Credit: amount})
+}
+
+// Validate checks that debits equal credits for every unit.
+func (e *JournalEntry) Validate() error {
+	sum := make(map[Unit]int64)
+	for _, p := range e.Postings {
+		if p.Debit < 0 || p.Credit < 0 {
+			return errors.New("negative posting amount")
+		}
+		sum[p.Unit] += p.Debit - p.Credit
+	}
+	for unit, v := range sum {
+		if v != 0 {
+			return fmt.Errorf("journal entry not balanced for unit %d", unit)
+		}
+	}
+	return nil
+}
+
+// Movement returns credits minus debits posted to account in unit by this entry.
+func (e *JournalEntry) Movement(account string, unit Unit) int64 {
+	var rtn int64
+	for _, p := range e.Postings {
+		if p.Account == account && p.Unit == unit {
+			rtn += p.Credit - p.Debit
+		}
+	}
+	return rtn
+}
+
+// Spend is what the entry adds to its user's spend: the money paid for tokens plus the tokens paid for a product,
+// less the tokens a refund gives back. Bonus tokens were free and do not count.
+func (e *JournalEntry) Spend() int64 {
+	switch e.Type {
+	case TransactionBuyToken:
+		return e.Charged
+	case TransactionBuyProduct, TransactionRefund:
+		return -e.Movement(UserAccount(e.UserID), UnitToken)
+	}
+	return 0
+}
+
+type LedgerRepository interface {
+	Post(entry JournalEntry) (int, error)
+	GetEntry(id int) (JournalEntry, error)
+	ListEntries(userID int, filter TransactionFilter) ([]JournalEntry, error)
+	ListRefunds(purchaseID int) ([]JournalEntry, error)
+	GetBalance(account string, unit Unit) (int64, error) // credits minus debits
+	// GetUserSpend sums the Spend of the user's entries created at or after since, the zero time counts every entry.
+	GetUserSpend(userID int, since time.Time) (int64, error)
+}
@@ -0,0 +1,73 @@
+package domain
+
+import "time"
+
+type ActivityAction string
+
+const (
+	ActionUpdatePeriod   ActivityAction = "update_period"
+	ActionUpdateDiscount ActivityAction = "update_discount"
+	ActionPause          ActivityAction = "pause"
+	ActionResume         ActivityAction = "resume"
+	ActionCancel         ActivityAction = "cancel"
+	ActionDelete         ActivityAction = "delete"
+)
+
+// ActivityChange is one entry of an activity's history.
+type ActivityChange struct {
+	ID         int
+	Kind       ActivityKind
+	ActivityID int
+	Action     ActivityAction
+	Detail     string // 變更內容，例如 discount 90 -> 80
+	Reason     string
+	CreatedAt  time.Time
+}
+
+// ActivityFilter selects activities, the zero value lists every activity that is not deleted.
+type ActivityFilter struct {
+	RunningAt      time.Time       // only activities running at this time, zero means any time
+	MemberLevels   []int           // buy token activities for these levels only, empty means all levels
+	StartTime      time.Time       // only activities whose period ends after this time, zero means no lower bound
+	EndTime        time.Time       // only activities whose period starts before this time, zero means no upper bound
+	States         []ActivityState // empty means every state but deleted
+	IncludeDeleted bool
+}
+
+// Match reports whether a is selected by the filter.
+func (f *ActivityFilter) Match(a Activity) bool {
+	state := a.GetState()
+	if len(f.States) > 0 {
+		found := false
+		for _, s := range f.States {
+			found = found || s == state
+		}
+		if !found {
+			return false
+		}
+	} else if state == ActivityDeleted && !f.IncludeDeleted {
+		return false
+	}
+	start, end := a.GetPeriod()
+	if !f.StartTime.IsZero() && !end.After(f.StartTime) {
+		return false
+	}
+	if !f.EndTime.IsZero() && !start.Before(f.EndTime) {
+		return false
+	}
+	return f.RunningAt.IsZero() || a.IsRunning(f.RunningAt)
+}
+
+// MatchBuyToken also checks the member level of a.
+func (f *ActivityFilter) MatchBuyToken(a *BuyTokenActivity) bool {
+	if len(f.MemberLevels) > 0 {
+		found := false
+		for _, level := range f.MemberLevels {
+			found = found || level == a.MemberLevel
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.Match(a)
+}
@@ -1,12 +1,37 @@
 package domain
 
+import "errors"
+
+var ErrOutOfStock = errors.New("product out of stock")
+
 type Product struct {
-	ID    int
-	Name  string
-	Price int
+	ID                int
+	Name              string
+	Price             int
+	Category          string // 商品分類
+	TrackStock        bool   // 是否控管庫存，false 為不限量
+	Stock             int    // 庫存數量
+	LowStockThreshold int    // 庫存低於或等於此數量時提醒補貨，0 為不提醒
+}
+
+// InStock reports whether one more unit of the product can be sold.
+func (p Product) InStock() bool {
+	return !p.TrackStock || p.Stock > 0
+}
+
+// IsLowStock reports whether the stock has fallen to the low stock threshold.
+func (p Product) IsLowStock() bool {
+	return p.TrackStock && p.LowStockThreshold > 0 && p.Stock <= p.LowStockThreshold
 }
 
 type ProductRepository interface {
 	AddProduct(product Product) (int, error)
 	GetProduct(id int) (Product, error)
+	// ListProducts returns every product ordered by ID.
+	ListProducts() ([]Product, error)
+	// SetStock starts tracking the stock of a product, or replaces the stock already tracked.
+	SetStock(id int, stock int, lowStockThreshold int) error
+	// AdjustStock adds delta (negative to take) to the stock of a product in one atomic step and returns the product,
+	// it fails with ErrOutOfStock when the stock would become negative. Products without TrackStock are not changed.
+	AdjustStock(id int, delta int) (Product, error)
 }
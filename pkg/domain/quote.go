@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrQuoteNotFound = errors.New("quote not found")
+	ErrQuoteExpired  = errors.New("quote expired")
+)
+
+// QuoteLine is one item of a price breakdown, in the order the pricing rules applied.
+type QuoteLine struct {
+	Rule       string // 計價規則，例如 member_level_discount、buy_token_activity、point_redemption、vip_point_bonus
+	ActivityID int
+	Discount   int64 // 折抵的金額
+	Point      int64 // 折抵使用的點數
+	BonusToken int64 // 贈送的平台幣
+	BonusPoint int64 // 贈送的點數
+}
+
+// Quote is what a purchase would cost now. For a token purchase Charge is the money charged,
+// for a product purchase it is the tokens and Point the points debited.
+type Quote struct {
+	ID          string // 只有保留報價時才有，可於 ExpiresAt 前以此價格購買
+	Type        TransactionType
+	UserID      int
+	Token       int64 // TransactionBuyToken: tokens bought
+	ProductID   int   // TransactionBuyProduct
+	ActivityID  int   // TransactionBuyProduct: activity asked for
+	ListPrice   int64
+	Lines       []QuoteLine
+	Charge      int64
+	Point       int64
+	BonusToken  int64
+	BonusPoint  int64
+	ActivityIDs []int // activities applied, bonus activities included
+	ExpiresAt   time.Time
+}
@@ -0,0 +1,31 @@
+package domain
+
+import "time"
+
+type ReassessmentAction string
+
+const (
+	ReassessGrace     ReassessmentAction = "grace"     // 消費未達保級門檻，進入寬限期
+	ReassessDowngrade ReassessmentAction = "downgrade" // 寬限期已過仍未達標，降級
+	ReassessRecovered ReassessmentAction = "recovered" // 寬限期內消費已達標，取消寬限期
+)
+
+// MemberReassessment is what a reassessment does, or would do in a dry run, to one user.
+type MemberReassessment struct {
+	UserID     int
+	Name       string
+	Spend      int64 // 評估期間內的累計消費
+	FromLevel  int
+	ToLevel    int
+	Action     ReassessmentAction
+	GraceUntil time.Time // ReassessGrace 的寬限期限
+	Subscribed bool      // 訂閱中，評估的是依消費取得的等級，訂閱的等級不變
+}
+
+// ReassessmentReport lists the users a reassessment moved, users that keep their tier are left out.
+type ReassessmentReport struct {
+	At      time.Time
+	DryRun  bool
+	Users   int // 評估的使用者數
+	Changes []MemberReassessment
+}
@@ -0,0 +1,149 @@
+package domain
+
+import (
+	"errors"
+	"time"
+	_ "time/tzdata" // time zones load even where the host has no zoneinfo
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+type Frequency int
+
+const (
+	FrequencyDaily   Frequency = iota + 1 // 每天
+	FrequencyWeekly                       // 每週的 Weekdays
+	FrequencyMonthly                      // 每月的 MonthDays
+)
+
+// maxScheduleLookahead bounds how far Occurrences searches for the next window.
+const maxScheduleLookahead = 366 * 4
+
+// Schedule repeats an activity in windows of Duration starting at StartTime on the matching days,
+// e.g. every Friday 18:00-23:00 or the first day of each month. Days and times are read in TimeZone.
+type Schedule struct {
+	Frequency Frequency      `json:"frequency"`
+	Weekdays  []time.Weekday `json:"weekdays,omitempty"`   // FrequencyWeekly
+	MonthDays []int          `json:"month_days,omitempty"` // FrequencyMonthly, 1-31, months without the day are skipped
+	StartTime time.Duration  `json:"start_time"`           // 當天開始時間，例如 18*time.Hour
+	Duration  time.Duration  `json:"duration"`             // 每次持續多久，可跨日
+	TimeZone  string         `json:"time_zone"`            // IANA 時區，例如 Asia/Taipei，空白為 UTC
+	loc       *time.Location // TimeZone resolved by Validate
+}
+
+// Occurrence is one window of a schedule.
+type Occurrence struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Validate checks the schedule and resolves its time zone once, so IsActive does not load it on every purchase.
+func (s *Schedule) Validate() error {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return ErrInvalidSchedule
+	}
+	s.loc = loc
+	if s.StartTime < 0 || s.StartTime >= 24*time.Hour || s.Duration <= 0 {
+		return ErrInvalidSchedule
+	}
+	switch s.Frequency {
+	case FrequencyDaily:
+	case FrequencyWeekly:
+		if len(s.Weekdays) == 0 {
+			return ErrInvalidSchedule
+		}
+		for _, d := range s.Weekdays {
+			if d < time.Sunday || d > time.Saturday {
+				return ErrInvalidSchedule
+			}
+		}
+	case FrequencyMonthly:
+		if len(s.MonthDays) == 0 {
+			return ErrInvalidSchedule
+		}
+		for _, d := range s.MonthDays {
+			if d < 1 || d > 31 {
+				return ErrInvalidSchedule
+			}
+		}
+	default:
+		return ErrInvalidSchedule
+	}
+	return nil
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.loc != nil {
+		return s.loc
+	}
+	// a schedule that was never validated
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (s *Schedule) matchesDay(day time.Time) bool {
+	switch s.Frequency {
+	case FrequencyDaily:
+		return true
+	case FrequencyWeekly:
+		for _, d := range s.Weekdays {
+			if d == day.Weekday() {
+				return true
+			}
+		}
+	case FrequencyMonthly:
+		for _, d := range s.MonthDays {
+			if d == day.Day() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// occurrenceOn returns the window starting on day, the wall clock start time is kept across DST changes.
+func (s *Schedule) occurrenceOn(day time.Time) Occurrence {
+	start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, int(s.StartTime), day.Location())
+	return Occurrence{Start: start, End: start.Add(s.Duration)}
+}
+
+// firstDay is the first day whose window may still be open at t.
+func (s *Schedule) firstDay(t time.Time) time.Time {
+	t = t.In(s.location())
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.AddDate(0, 0, -int(s.Duration/(24*time.Hour))-1)
+}
+
+// IsActive reports whether t falls inside one of the windows.
+func (s *Schedule) IsActive(t time.Time) bool {
+	day := s.firstDay(t)
+	for ; !day.After(t); day = day.AddDate(0, 0, 1) {
+		if !s.matchesDay(day) {
+			continue
+		}
+		o := s.occurrenceOn(day)
+		if !o.Start.After(t) && o.End.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Occurrences returns up to n windows that have not ended by from and start before until, in order.
+func (s *Schedule) Occurrences(from, until time.Time, n int) []Occurrence {
+	rtn := make([]Occurrence, 0, n)
+	day := s.firstDay(from)
+	for i := 0; i < maxScheduleLookahead && len(rtn) < n && day.Before(until); i, day = i+1, day.AddDate(0, 0, 1) {
+		if !s.matchesDay(day) {
+			continue
+		}
+		if o := s.occurrenceOn(day); o.End.After(from) && o.Start.Before(until) {
+			rtn = append(rtn, o)
+		}
+	}
+	return rtn
+}
@@ -0,0 +1,78 @@
+package domain
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSchedule_IsActive(t *testing.T) {
+	taipei, err := time.LoadLocation("Asia/Taipei")
+	require.NoError(t, err)
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	fridayNight := &Schedule{Frequency: FrequencyWeekly, Weekdays: []time.Weekday{time.Friday},
+		StartTime: 18 * time.Hour, Duration: 5 * time.Hour, TimeZone: "Asia/Taipei"}
+	firstOfMonth := &Schedule{Frequency: FrequencyMonthly, MonthDays: []int{1}, Duration: 24 * time.Hour, TimeZone: "Asia/Taipei"}
+	happyHour := &Schedule{Frequency: FrequencyDaily, StartTime: 22 * time.Hour, Duration: 3 * time.Hour, TimeZone: "America/New_York"}
+
+	tests := []struct {
+		name     string
+		schedule *Schedule
+		at       time.Time
+		want     bool
+	}{
+		{name: "FridayNightInside", schedule: fridayNight, at: time.Date(2024, 3, 8, 20, 0, 0, 0, taipei), want: true},
+		{name: "FridayNightStart", schedule: fridayNight, at: time.Date(2024, 3, 8, 18, 0, 0, 0, taipei), want: true},
+		{name: "FridayNightEnd", schedule: fridayNight, at: time.Date(2024, 3, 8, 23, 0, 0, 0, taipei), want: false},
+		{name: "FridayNightOtherDay", schedule: fridayNight, at: time.Date(2024, 3, 7, 20, 0, 0, 0, taipei), want: false},
+		{name: "FridayNightInUTC", schedule: fridayNight, at: time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC), want: true},
+		{name: "FirstOfMonth", schedule: firstOfMonth, at: time.Date(2024, 4, 1, 9, 0, 0, 0, taipei), want: true},
+		{name: "SecondOfMonth", schedule: firstOfMonth, at: time.Date(2024, 4, 2, 9, 0, 0, 0, taipei), want: false},
+		{name: "HappyHourAcrossMidnight", schedule: happyHour, at: time.Date(2024, 3, 9, 0, 30, 0, 0, newYork), want: true},
+		{name: "HappyHourOver", schedule: happyHour, at: time.Date(2024, 3, 9, 1, 0, 0, 0, newYork), want: false},
+		{name: "HappyHourAfterDST", schedule: happyHour, at: time.Date(2024, 3, 10, 22, 30, 0, 0, newYork), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.schedule.Validate())
+			require.Equal(t, tt.want, tt.schedule.IsActive(tt.at))
+		})
+	}
+}
+
+func TestSchedule_Validate(t *testing.T) {
+	require.ErrorIs(t, (&Schedule{Frequency: FrequencyDaily, Duration: time.Hour, TimeZone: "Mars/Olympus"}).Validate(), ErrInvalidSchedule)
+	require.ErrorIs(t, (&Schedule{Frequency: FrequencyDaily}).Validate(), ErrInvalidSchedule)
+	require.ErrorIs(t, (&Schedule{Frequency: FrequencyWeekly, Duration: time.Hour}).Validate(), ErrInvalidSchedule)
+	require.ErrorIs(t, (&Schedule{Frequency: FrequencyMonthly, MonthDays: []int{32}, Duration: time.Hour}).Validate(), ErrInvalidSchedule)
+	require.ErrorIs(t, (&Schedule{Frequency: FrequencyDaily, StartTime: 24 * time.Hour, Duration: time.Hour}).Validate(), ErrInvalidSchedule)
+}
+
+func TestActivity_NextOccurrences(t *testing.T) {
+	taipei, err := time.LoadLocation("Asia/Taipei")
+	require.NoError(t, err)
+	a := BuyTokenActivity{}
+	_ = a.SetPeriod(time.Date(2024, 3, 1, 0, 0, 0, 0, taipei), time.Date(2024, 3, 22, 20, 0, 0, 0, taipei))
+	a.SetSchedule(&Schedule{Frequency: FrequencyWeekly, Weekdays: []time.Weekday{time.Friday},
+		StartTime: 18 * time.Hour, Duration: 5 * time.Hour, TimeZone: "Asia/Taipei"})
+
+	got := a.NextOccurrences(time.Date(2024, 3, 8, 19, 0, 0, 0, taipei), 5)
+	require.Len(t, got, 3)
+	require.True(t, got[0].Start.Equal(time.Date(2024, 3, 8, 18, 0, 0, 0, taipei)))
+	require.True(t, got[1].Start.Equal(time.Date(2024, 3, 15, 18, 0, 0, 0, taipei)))
+	// the last window is cut at the end of the period
+	require.True(t, got[2].End.Equal(time.Date(2024, 3, 22, 20, 0, 0, 0, taipei)))
+	require.Len(t, a.NextOccurrences(time.Date(2024, 3, 1, 0, 0, 0, 0, taipei), 2), 2)
+	require.Empty(t, a.NextOccurrences(time.Date(2024, 4, 1, 0, 0, 0, 0, taipei), 2))
+}
+
+func TestSchedule_ValidateResolvesLocation(t *testing.T) {
+	s := &Schedule{Frequency: FrequencyDaily, StartTime: 18 * time.Hour, Duration: time.Hour, TimeZone: "Asia/Taipei"}
+	require.Nil(t, s.loc)
+	require.NoError(t, s.Validate())
+	require.NotNil(t, s.loc)
+	require.Equal(t, "Asia/Taipei", s.location().String())
+	require.Same(t, s.loc, s.location()) // IsActive does not load the time zone again
+}
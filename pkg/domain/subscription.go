@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSubscriptionNotFound     = errors.New("subscription not found")
+	ErrSubscriptionNotAvailable = errors.New("member tier cannot be subscribed")
+	ErrSubscriptionActive       = errors.New("user already subscribes to this or a higher tier")
+)
+
+type SubscriptionState string
+
+const (
+	SubscriptionActive   SubscriptionState = "active"
+	SubscriptionExpired  SubscriptionState = "expired"  // 到期未續訂，回到原本的等級
+	SubscriptionUpgraded SubscriptionState = "upgraded" // 升級為更高等級的訂閱，剩餘期間已折抵
+)
+
+// Subscription is a member level bought with tokens for a period, the user goes back to EarnedLevel when it expires.
+type Subscription struct {
+	ID               int
+	UserID           int
+	Level            int       // 訂閱的會員等級
+	EarnedLevel      int       // 依消費取得的等級，訂閱到期後回到此等級
+	EarnedGraceUntil time.Time // 依消費取得等級的保級寬限期限，訂閱期間由重新評估更新，到期後帶回 Member.GraceUntil
+	Fee              int64     // 本期支付的平台幣，升級時已扣除折抵
+	StartDate        time.Time
+	EndDate          time.Time
+	AutoRenew        bool // 到期時自動以平台幣續訂
+	State            SubscriptionState
+}
+
+// Credit is what is left of the fee paid when the subscription is given up at t, in proportion to the time left.
+func (s Subscription) Credit(t time.Time) int64 {
+	total, left := s.EndDate.Sub(s.StartDate), s.EndDate.Sub(t)
+	if total <= 0 || left <= 0 {
+		return 0
+	}
+	if left > total {
+		left = total
+	}
+	return int64(float64(s.Fee) * float64(left) / float64(total))
+}
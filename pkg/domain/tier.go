@@ -0,0 +1,80 @@
+package domain
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrMemberTierNotFound = errors.New("member tier not found")
+	ErrInvalidMemberTier  = errors.New("invalid member tier")
+	ErrSpendingLimit      = errors.New("purchase exceeds the member tier spending limit")
+)
+
+// SpendingLimit caps what a member may spend in one purchase, a zero field means no limit.
+type SpendingLimit struct {
+	MaxTokenPerPurchase int64 // 每筆最多購買的平台幣
+	MaxProductPrice     int   // 可購買的商品價格上限
+}
+
+// AllowsToken reports whether buying token tokens stays within l.
+func (l SpendingLimit) AllowsToken(token int64) bool {
+	return l.MaxTokenPerPurchase == 0 || token <= l.MaxTokenPerPurchase
+}
+
+// AllowsProduct reports whether buying product stays within l.
+func (l SpendingLimit) AllowsProduct(product Product) bool {
+	return l.MaxProductPrice == 0 || product.Price <= l.MaxProductPrice
+}
+
+// MemberTier describes a member level, users whose Member.Level is Level get its discount and benefits.
+type MemberTier struct {
+	Level            int           // 會員等級，即 Member.Level
+	Name             string        // 例如 VIP1
+	Rank             int           // 排序用，越大等級越高
+	BuyTokenDiscount int           // 1-100，購買平台幣的預設折扣，即 Member.BuyTokenDefaultDiscount
+	PointMultiplier  int           // 贈送點數的倍率，百分比，100 為一倍，0 視為 100
+	SpendingLimit    SpendingLimit // 消費上限
+	Perks            []string      // 其他權益，例如免運、專屬客服
+	UpgradeSpend     int64         // 累計消費達到此金額即自動升級至此等級，0 為不自動升級
+	RetainSpend      int64         // 重新評估時累計消費需達到此金額才能保級，0 為永久保級
+	SubscriptionFee  int64         // 以平台幣訂閱此等級一期的費用，0 為不開放訂閱
+	SubscriptionDays int           // 訂閱一期的天數
+}
+
+// MultiplyPoint scales the points given to a member by the multiplier of their tier, a percentage where 0 counts as 100.
+func MultiplyPoint(point int64, multiplier int) int64 {
+	if multiplier == 0 {
+		return point
+	}
+	return point * int64(multiplier) / 100
+}
+
+// Subscribable reports whether the tier can be bought with tokens.
+func (t MemberTier) Subscribable() bool {
+	return t.SubscriptionFee > 0 && t.SubscriptionDays > 0
+}
+
+// SubscriptionPeriod is how long one period of a subscription to the tier lasts.
+func (t MemberTier) SubscriptionPeriod() time.Duration {
+	return time.Duration(t.SubscriptionDays) * 24 * time.Hour
+}
+
+func (t MemberTier) Validate() error {
+	if t.Level < 0 || t.Name == "" || t.BuyTokenDiscount < 1 || t.BuyTokenDiscount > 100 || t.PointMultiplier < 0 ||
+		t.UpgradeSpend < 0 || t.RetainSpend < 0 || t.SubscriptionFee < 0 || t.SubscriptionDays < 0 ||
+		t.SpendingLimit.MaxTokenPerPurchase < 0 || t.SpendingLimit.MaxProductPrice < 0 {
+		return ErrInvalidMemberTier
+	}
+	return nil
+}
+
+// DefaultMemberTiers is the catalog a new store starts with.
+func DefaultMemberTiers() []MemberTier {
+	return []MemberTier{
+		{Level: 0, Name: "Normal", Rank: 0, BuyTokenDiscount: 100, PointMultiplier: 100},
+		{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, PointMultiplier: 100},
+		{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, PointMultiplier: 100},
+		{Level: 3, Name: "VIP3", Rank: 3, BuyTokenDiscount: 85, PointMultiplier: 100},
+	}
+}
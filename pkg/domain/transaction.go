@@ -0,0 +1,77 @@
+package domain
+
+import "time"
+
+// Transaction is the user facing view of a journal entry.
+type Transaction struct {
+	ID               int
+	Type             TransactionType
+	UserID           int
+	ProductID        int
+	ActivityID       int
+	ActivityIDs      []int
+	Coupon           string
+	BonusActivityIDs []int
+	Charged          int64 // 向使用者收取的金額
+	Token            int64 // 使用者平台幣變動 (正數為增加)
+	BonusToken       int64 // 使用者贈送平台幣變動 (正數為增加)
+	Point            int64 // 使用者點數變動 (正數為增加)
+	RefundOf         int
+	Memo             string
+	CreatedAt        time.Time
+}
+
+type TransactionFilter struct {
+	Types     []TransactionType // empty means all types
+	StartTime time.Time         // zero means no lower bound
+	EndTime   time.Time         // zero means no upper bound
+	Cursor    int               // only return transactions after this ID, 0 for the first page
+	Limit     int               // page size, 0 means no limit
+}
+
+func (f *TransactionFilter) Match(entry *JournalEntry) bool {
+	if entry.ID <= f.Cursor {
+		return false
+	}
+	if !f.StartTime.IsZero() && entry.CreatedAt.Before(f.StartTime) {
+		return false
+	}
+	if !f.EndTime.IsZero() && !entry.CreatedAt.Before(f.EndTime) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == entry.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type TransactionPage struct {
+	Transactions []Transaction
+	NextCursor   int // 0 when there is no next page
+}
+
+func (e *JournalEntry) Transaction() Transaction {
+	account := UserAccount(e.UserID)
+	return Transaction{
+		ID:               e.ID,
+		Type:             e.Type,
+		UserID:           e.UserID,
+		ProductID:        e.ProductID,
+		ActivityID:       e.ActivityID,
+		ActivityIDs:      e.ActivityIDs,
+		Coupon:           e.Coupon,
+		BonusActivityIDs: e.BonusActivityIDs,
+		Charged:          e.Charged,
+		Token:            e.Movement(account, UnitToken),
+		BonusToken:       e.Movement(account, UnitBonusToken),
+		Point:            e.Movement(account, UnitPoint),
+		RefundOf:         e.RefundOf,
+		Memo:             e.Memo,
+		CreatedAt:        e.CreatedAt,
+	}
+}
@@ -0,0 +1,17 @@
+package domain
+
+// Repositories gives access to the repositories that share one storage backend.
+type Repositories interface {
+	Users() UserRepository
+	Products() ProductRepository
+	Activities() ActivityRepository
+	Ledger() LedgerRepository
+	Coupons() CouponRepository
+}
+
+// UnitOfWork runs a usecase operation as a transaction, every change made through the repositories passed to fn
+// is committed together, or discarded when fn returns an error.
+type UnitOfWork interface {
+	Repositories
+	Do(fn func(repos Repositories) error) error
+}
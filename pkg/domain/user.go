@@ -1,17 +1,32 @@
 package domain
 
 import (
+	"errors"
 	"sync/atomic"
+	"time"
 )
 
+var (
+	ErrNotEnoughToken = errors.New("not enough token")
+	ErrNotEnoughPoint = errors.New("not enough point")
+)
+
+type Balance struct {
+	Token      int // 平台幣
+	Point      int // 平台點數
+	BonusToken int // 活動贈送的平台幣，與購買的平台幣分開計算
+}
+
+// Account holds a Balance that is always replaced as a whole with compare-and-swap,
+// so token and point are checked and changed together without locks.
 type Account struct {
-	Token atomic.Value // 平台幣
-	Point atomic.Value // 平台點數
+	balance atomic.Value // Balance
 }
 
 type Member struct {
-	Level                   int // 0: Normal, 1: VIP1, 2: VIP2, 3: VIP3
-	BuyTokenDefaultDiscount int // 1-100, VIP會員有平台幣優惠價格 (例如: VIP1: 95折，VIP2: 9折，VIP3: 85折，各個等級的折扣會依照活動做調整。)
+	Level                   int       // 0: Normal, 1: VIP1, 2: VIP2, 3: VIP3
+	BuyTokenDefaultDiscount int       // 1-100, VIP會員有平台幣優惠價格 (例如: VIP1: 95折，VIP2: 9折，VIP3: 85折，各個等級的折扣會依照活動做調整。)
+	GraceUntil              time.Time // 保級寬限期限，重新評估時消費未達標且已過期限即降級，zero 表示不在寬限期
 }
 
 type User struct {
@@ -21,40 +36,105 @@ type User struct {
 	Member  Member
 }
 
+func (a *Account) Load() Balance {
+	if b, ok := a.balance.Load().(Balance); ok {
+		return b
+	}
+	return Balance{}
+}
+
+// Apply adds token and point (negative to debit) in one atomic step.
+// Nothing is changed if either balance would become negative.
+func (a *Account) Apply(token, point int) (Balance, error) {
+	return a.ApplyBalance(Balance{Token: token, Point: point})
+}
+
+// ApplyBalance adds every field of delta (negative to debit) in one atomic step.
+// Nothing is changed if any balance would become negative.
+func (a *Account) ApplyBalance(delta Balance) (Balance, error) {
+	for {
+		old := a.balance.Load()
+		cur, _ := old.(Balance)
+		next := Balance{Token: cur.Token + delta.Token, Point: cur.Point + delta.Point, BonusToken: cur.BonusToken + delta.BonusToken}
+		if next.Point < 0 {
+			return cur, ErrNotEnoughPoint
+		}
+		if next.Token < 0 || next.BonusToken < 0 {
+			return cur, ErrNotEnoughToken
+		}
+		if a.balance.CompareAndSwap(old, next) {
+			return next, nil
+		}
+	}
+}
+
 func (u *User) BuyToken(token int) int {
-	u.Account.Token.Store(u.Account.Token.Load().(int) + token)
-	rtn := u.Account.Token.Load().(int)
-	return rtn
+	b, _ := u.Account.Apply(token, 0)
+	return b.Token
 }
 
-func (u *User) UseToken(token int) int {
-	u.Account.Token.Store(u.Account.Token.Load().(int) - token)
-	rtn := u.Account.Token.Load().(int)
-	return rtn
+func (u *User) UseToken(token int) (int, error) {
+	b, err := u.Account.Apply(-token, 0)
+	return b.Token, err
 }
 
 func (u *User) AddPoint(point int) int {
-	u.Account.Point.Store(u.Account.Point.Load().(int) + point)
-	rtn := u.Account.Point.Load().(int)
-	return rtn
+	b, _ := u.Account.Apply(0, point)
+	return b.Point
 }
 
-func (u *User) UsePoint(point int) int {
-	u.Account.Point.Store(u.Account.Point.Load().(int) - point)
-	rtn := u.Account.Point.Load().(int)
-	return rtn
+func (u *User) UsePoint(point int) (int, error) {
+	b, err := u.Account.Apply(0, -point)
+	return b.Point, err
+}
+
+// Pay debits token and point together, either both or none are taken.
+func (u *User) Pay(token, point int) error {
+	_, err := u.Account.Apply(-token, -point)
+	return err
 }
 
 func (u *User) GetPoint() int {
-	return u.Account.Point.Load().(int)
+	return u.Account.Load().Point
 }
 
 func (u *User) GetToken() int {
-	return u.Account.Token.Load().(int)
+	return u.Account.Load().Token
+}
+
+func (u *User) GetBonusToken() int {
+	return u.Account.Load().BonusToken
 }
 
 type UserRepository interface {
 	GetUser(id int) (*User, error)
+	// ListUsers returns every user ordered by ID.
+	ListUsers() ([]*User, error)
 	NewUser(user User) (int, error)
+	// AdjustBalance adds token and point (negative to debit) to the user's account in one atomic step.
+	AdjustBalance(id int, token int, point int) (Balance, error)
+	// AdjustBonusToken adds bonus token (negative to debit) to the user's account.
+	AdjustBonusToken(id int, bonusToken int) (Balance, error)
+	// GetDefaultBuyTokenDiscount returns the BuyTokenDiscount of the level's member tier, 100 when there is none.
 	GetDefaultBuyTokenDiscount(level int) int
+	// SetMemberTier adds the tier of its level or replaces the existing one.
+	SetMemberTier(tier MemberTier) error
+	GetMemberTier(level int) (MemberTier, error)
+	// ListMemberTiers returns the member tiers ordered by Rank then Level.
+	ListMemberTiers() ([]MemberTier, error)
+	// SetMember replaces the member level, discount and grace period of a user.
+	SetMember(id int, member Member) error
+	AddSubscription(subscription Subscription) (int, error)
+	// GetActiveSubscription returns the user's active subscription, ErrSubscriptionNotFound when there is none.
+	GetActiveSubscription(userID int) (Subscription, error)
+	// UpdateSubscription replaces the subscription with the same ID.
+	UpdateSubscription(subscription Subscription) error
+	// ListDueSubscriptions returns the active subscriptions that end at or before t, ordered by ID.
+	ListDueSubscriptions(t time.Time) ([]Subscription, error)
+	// SetMemberDiscount sets the BuyTokenDefaultDiscount of every user at level and returns how many were changed.
+	SetMemberDiscount(level int, discount int) (int, error)
+	// SetVolumeTiers replaces the volume tiers of a member level.
+	SetVolumeTiers(level int, tiers []VolumeTier) error
+	// ListVolumeTiers returns the volume tiers of a member level ordered by MinToken.
+	ListVolumeTiers(level int) ([]VolumeTier, error)
 }
@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUser_ConcurrentBalance(t *testing.T) {
+	const workers = 100
+	const rounds = 1000
+
+	t.Run("NoLostUpdates", func(t *testing.T) {
+		user := &User{}
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < rounds; j++ {
+					user.BuyToken(2)
+					user.AddPoint(1)
+					_, _ = user.UseToken(1)
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, workers*rounds, user.GetToken())
+		require.Equal(t, workers*rounds, user.GetPoint())
+	})
+
+	t.Run("NoNegativeBalance", func(t *testing.T) {
+		user := &User{}
+		user.BuyToken(10000)
+		user.AddPoint(5000)
+
+		var paid int64
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < rounds; j++ {
+					err := user.Pay(3, 2)
+					if err == nil {
+						atomic.AddInt64(&paid, 1)
+						continue
+					}
+					require.True(t, err == ErrNotEnoughToken || err == ErrNotEnoughPoint)
+					b := user.Account.Load()
+					require.GreaterOrEqual(t, b.Token, 0)
+					require.GreaterOrEqual(t, b.Point, 0)
+				}
+			}()
+		}
+		wg.Wait()
+		// points run out first: 5000 / 2 = 2500 payments
+		require.Equal(t, int64(2500), paid)
+		require.Equal(t, 10000-3*2500, user.GetToken())
+		require.Equal(t, 0, user.GetPoint())
+	})
+}
@@ -0,0 +1,18 @@
+package domain
+
+// VolumeTier gives members of a level a better rate when they buy at least MinToken tokens at once.
+type VolumeTier struct {
+	MemberLevel int
+	MinToken    int64
+	Discount    int // 1-100，在會員價或活動價之上再打折
+}
+
+// ReachedVolumeTier returns the highest tier token reaches, tiers must be ordered by MinToken.
+func ReachedVolumeTier(tiers []VolumeTier, token int64) (VolumeTier, bool) {
+	for i := len(tiers) - 1; i >= 0; i-- {
+		if token >= tiers[i].MinToken {
+			return tiers[i], true
+		}
+	}
+	return VolumeTier{}, false
+}
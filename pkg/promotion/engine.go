@@ -0,0 +1,156 @@
+// Package promotion prices token and product purchases by running registered rules in a fixed pipeline.
+package promotion
+
+import (
+	"oa-bitgin/pkg/domain"
+	"sort"
+	"time"
+)
+
+type Kind int
+
+const (
+	KindBuyToken   Kind = iota // 購買平台幣，Charge 為收取的金額
+	KindBuyProduct             // 購買商品，Charge 為扣除的平台幣，Point 為扣除的點數
+)
+
+// Stage orders the pipeline, rules of a stage see the result of every earlier stage.
+type Stage int
+
+const (
+	StageBase       Stage = iota // member level price
+	StageActivity                // campaign discounts
+	StageRedemption              // paying part of the price with points
+	StageBonus                   // extra discounts on top of everything else
+	StageCoupon                  // the coupon entered at checkout
+)
+
+// Order is the purchase being priced.
+type Order struct {
+	Kind            Kind
+	Member          domain.Member
+	PointMultiplier int // the member tier's multiplier of points given, see domain.MultiplyPoint
+	Now             time.Time
+
+	Token       int64               // KindBuyToken: tokens bought
+	VolumeTiers []domain.VolumeTier // KindBuyToken: the member level's tiers ordered by MinToken
+
+	Product            domain.Product             // KindBuyProduct
+	BuyProductActivity *domain.BuyProductActivity // KindBuyProduct: activity chosen by the user, may be nil
+
+	BuyTokenActivities []domain.BuyTokenActivity // KindBuyToken: candidate activities
+	BonusActivities    []domain.BonusActivity    // KindBuyToken: candidate bonus activities
+
+	Coupon *domain.CouponBatch // batch of the code entered at checkout, may be nil
+}
+
+// Step is one line of the itemized price.
+type Step struct {
+	Rule       string
+	ActivityID int
+	Discount   int64 // how much Charge went down
+	Point      int64 // points added to the price
+	BonusToken int64 // tokens given to the user
+	BonusPoint int64 // points given to the user
+}
+
+// IsBonus reports whether the step gave the user something instead of lowering the price.
+func (s Step) IsBonus() bool {
+	return s.BonusToken != 0 || s.BonusPoint != 0
+}
+
+type Result struct {
+	ListPrice   int64
+	Charge      int64
+	Point       int64
+	BonusToken  int64 // 額外贈送給使用者的平台幣
+	BonusPoint  int64 // 額外贈送給使用者的點數
+	ActivityIDs []int // activities that lowered the price
+	Steps       []Step
+
+	BonusActivityIDs []int // activities that gave a bonus
+}
+
+// AddStep sets the new charge and records the change.
+func (r *Result) AddStep(rule string, activityID int, charge int64, point int64) {
+	r.Steps = append(r.Steps, Step{Rule: rule, ActivityID: activityID, Discount: r.Charge - charge, Point: point})
+	r.Charge = charge
+	r.Point += point
+	if activityID != 0 {
+		r.ActivityIDs = append(r.ActivityIDs, activityID)
+	}
+}
+
+// AddBonus records tokens and points given to the user on top of the purchase.
+func (r *Result) AddBonus(rule string, activityID int, token int64, point int64) {
+	if token == 0 && point == 0 {
+		return
+	}
+	r.Steps = append(r.Steps, Step{Rule: rule, ActivityID: activityID, BonusToken: token, BonusPoint: point})
+	r.BonusToken += token
+	r.BonusPoint += point
+	if activityID != 0 {
+		r.BonusActivityIDs = append(r.BonusActivityIDs, activityID)
+	}
+}
+
+type Rule interface {
+	Name() string
+	Stage() Stage
+	Apply(order *Order, result *Result) error
+}
+
+type Engine struct {
+	rules []Rule
+}
+
+func NewEngine(rules ...Rule) *Engine {
+	e := &Engine{}
+	for _, r := range rules {
+		e.Register(r)
+	}
+	return e
+}
+
+// NewDefaultEngine returns an engine with the platform's standard pricing rules.
+func NewDefaultEngine() *Engine {
+	return NewEngine(
+		MemberLevelDiscount{},
+		BuyTokenActivityDiscount{},
+		PointRedemption{},
+		VIPPointBonus{MinPoint: 100, Discount: 90},
+		VolumeTierDiscount{},
+		BonusActivityReward{},
+		CouponBenefit{},
+	)
+}
+
+// Register adds rule to the pipeline after the rules already registered for its stage.
+func (e *Engine) Register(rule Rule) {
+	e.rules = append(e.rules, rule)
+	sort.SliceStable(e.rules, func(i, j int) bool {
+		return e.rules[i].Stage() < e.rules[j].Stage()
+	})
+}
+
+// Evaluate prices order, it has no side effects.
+func (e *Engine) Evaluate(order Order) (Result, error) {
+	if order.Now.IsZero() {
+		order.Now = time.Now()
+	}
+	var result Result
+	switch order.Kind {
+	case KindBuyToken:
+		result.ListPrice = order.Token
+	case KindBuyProduct:
+		result.ListPrice = int64(order.Product.Price)
+	}
+	result.Charge = result.ListPrice
+
+	for _, r := range e.rules {
+		if err := r.Apply(&order, &result); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
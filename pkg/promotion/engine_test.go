@@ -0,0 +1,233 @@
+package promotion
+
+import (
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"testing"
+	"time"
+)
+
+// flatOff is a campaign defined outside the default rules.
+type flatOff struct {
+	off int64
+}
+
+func (flatOff) Name() string { return "flat_off" }
+func (flatOff) Stage() Stage { return StageActivity }
+
+func (r flatOff) Apply(order *Order, result *Result) error {
+	result.AddStep(r.Name(), 0, result.Charge-r.off, 0)
+	return nil
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	tokenActivity := func(level, discount int) domain.BuyTokenActivity {
+		a := domain.BuyTokenActivity{MemberLevel: level, BuyTokenDiscount: discount}
+		a.SetID(discount)
+		_ = a.SetPeriod(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		return a
+	}
+	stacked := func(a domain.BuyTokenActivity, stacking domain.Stacking) domain.BuyTokenActivity {
+		a.Stacking = stacking
+		return a
+	}
+	productActivity := func(discount int) *domain.BuyProductActivity {
+		a := &domain.BuyProductActivity{PointDiscount: discount}
+		a.SetID(1)
+		_ = a.SetPeriod(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		return a
+	}
+	bonusActivity := func(id int, threshold, bonus, max int64) domain.BonusActivity {
+		a := domain.BonusActivity{Threshold: threshold, BonusToken: bonus, MaxBonusToken: max}
+		a.SetID(id)
+		_ = a.SetPeriod(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		return a
+	}
+	vip1 := domain.Member{Level: 1, BuyTokenDefaultDiscount: 95}
+
+	tests := []struct {
+		name           string
+		engine         *Engine
+		order          Order
+		wantCharge     int64
+		wantPoint      int64
+		wantIDs        []int
+		wantBonus      int64
+		wantBonusPoint int64
+	}{
+		{
+			name:       "OKMemberLevel",
+			engine:     NewDefaultEngine(),
+			order:      Order{Kind: KindBuyToken, Member: vip1, Token: 100},
+			wantCharge: 95,
+		},
+		{
+			name:   "OKBestActivity",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 100,
+				BuyTokenActivities: []domain.BuyTokenActivity{tokenActivity(1, 90), tokenActivity(1, 80), tokenActivity(2, 50)}},
+			wantCharge: 80,
+			wantIDs:    []int{80},
+		},
+		{
+			name:   "OKStackable",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 1000,
+				BuyTokenActivities: []domain.BuyTokenActivity{
+					stacked(tokenActivity(1, 90), domain.Stacking{Stackable: true}),
+					stacked(tokenActivity(1, 80), domain.Stacking{Stackable: true, Priority: 1}),
+				}},
+			wantCharge: 684, // 1000 * 95% * 80% * 90%
+			wantIDs:    []int{80, 90},
+		},
+		{
+			name:   "OKStackLosesToBetterSingle",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 1000,
+				BuyTokenActivities: []domain.BuyTokenActivity{
+					stacked(tokenActivity(1, 90), domain.Stacking{Stackable: true}),
+					tokenActivity(1, 50),
+				}},
+			wantCharge: 500,
+			wantIDs:    []int{50},
+		},
+		{
+			name:   "OKExclusionGroup",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 1000,
+				BuyTokenActivities: []domain.BuyTokenActivity{
+					stacked(tokenActivity(1, 80), domain.Stacking{Stackable: true, ExclusionGroup: "weekend"}),
+					stacked(tokenActivity(1, 90), domain.Stacking{Stackable: true, ExclusionGroup: "weekend", Priority: 1}),
+					stacked(tokenActivity(1, 95), domain.Stacking{Stackable: true}),
+				}},
+			wantCharge: 812, // the higher priority 90% wins the group: 1000 * 95% * 90% * 95%
+			wantIDs:    []int{90, 95},
+		},
+		{
+			name:   "OKExclusive",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 1000,
+				BuyTokenActivities: []domain.BuyTokenActivity{
+					stacked(tokenActivity(1, 50), domain.Stacking{Stackable: true}),
+					stacked(tokenActivity(1, 70), domain.Stacking{Exclusive: true}),
+				}},
+			wantCharge: 700,
+			wantIDs:    []int{70},
+		},
+		{
+			name:       "OKProductWithoutActivity",
+			engine:     NewDefaultEngine(),
+			order:      Order{Kind: KindBuyProduct, Member: vip1, Product: domain.Product{Price: 1000}},
+			wantCharge: 1000,
+		},
+		{
+			name:       "OKPointRedemption",
+			engine:     NewDefaultEngine(),
+			order:      Order{Kind: KindBuyProduct, Product: domain.Product{Price: 1000}, BuyProductActivity: productActivity(80)},
+			wantCharge: 800,
+			wantPoint:  200,
+			wantIDs:    []int{1},
+		},
+		{
+			name:       "OKVIPPointBonus",
+			engine:     NewDefaultEngine(),
+			order:      Order{Kind: KindBuyProduct, Member: vip1, Product: domain.Product{Price: 1000}, BuyProductActivity: productActivity(80)},
+			wantCharge: 720,
+			wantPoint:  200,
+			wantIDs:    []int{1},
+		},
+		{
+			name:   "OKCouponAfterVIPBonus",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyProduct, Member: vip1, Product: domain.Product{Price: 1000}, BuyProductActivity: productActivity(80),
+				Coupon: &domain.CouponBatch{Kind: domain.CouponDiscount, Value: 50}},
+			wantCharge: 360,
+			wantPoint:  200,
+			wantIDs:    []int{1},
+		},
+		{
+			name:       "OKCouponTokenOffFloor",
+			engine:     NewDefaultEngine(),
+			order:      Order{Kind: KindBuyToken, Member: vip1, Token: 100, Coupon: &domain.CouponBatch{Kind: domain.CouponTokenOff, Value: 500}},
+			wantCharge: 0,
+		},
+		{
+			name:   "OKVolumeTier",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 10000,
+				VolumeTiers: []domain.VolumeTier{{MinToken: 1000, Discount: 97}, {MinToken: 10000, Discount: 90}}},
+			wantCharge: 8550, // 10000 * 95% * 90%
+		},
+		{
+			name:   "OKVolumeTierBelowFirst",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 999,
+				VolumeTiers: []domain.VolumeTier{{MinToken: 1000, Discount: 97}}},
+			wantCharge: 949,
+		},
+		{
+			name:   "OKVolumeTierWithActivity",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 1000,
+				BuyTokenActivities: []domain.BuyTokenActivity{tokenActivity(1, 80)},
+				VolumeTiers:        []domain.VolumeTier{{MinToken: 1000, Discount: 90}}},
+			wantCharge: 720,
+			wantIDs:    []int{80},
+		},
+		{
+			name:   "OKBonusPerThreshold",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 2500,
+				BonusActivities: []domain.BonusActivity{bonusActivity(1, 1000, 100, 0)}},
+			wantCharge: 2375,
+			wantBonus:  200,
+		},
+		{
+			name:   "OKBonusCapped",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 10000,
+				BonusActivities: []domain.BonusActivity{bonusActivity(1, 1000, 100, 300), bonusActivity(2, 5000, 50, 0)}},
+			wantCharge: 9500,
+			wantBonus:  400,
+		},
+		{
+			name:   "OKBonusPointMultiplier",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, PointMultiplier: 150, Token: 100,
+				Coupon: &domain.CouponBatch{Kind: domain.CouponPointBonus, Value: 40}},
+			wantCharge:     95,
+			wantBonusPoint: 60,
+		},
+		{
+			name:   "OKBonusBelowThreshold",
+			engine: NewDefaultEngine(),
+			order: Order{Kind: KindBuyToken, Member: vip1, Token: 999,
+				BonusActivities: []domain.BonusActivity{bonusActivity(1, 1000, 100, 0)}},
+			wantCharge: 949,
+		},
+		{
+			name:       "OKCustomRule",
+			engine:     NewEngine(VIPPointBonus{MinPoint: 100, Discount: 90}, flatOff{off: 10}, MemberLevelDiscount{}),
+			order:      Order{Kind: KindBuyToken, Member: vip1, Token: 100},
+			wantCharge: 85,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.engine.Evaluate(tt.order)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCharge, got.Charge)
+			require.Equal(t, tt.wantPoint, got.Point)
+			require.Equal(t, tt.wantIDs, got.ActivityIDs)
+			require.Equal(t, tt.wantBonus, got.BonusToken)
+			require.Equal(t, tt.wantBonusPoint, got.BonusPoint)
+
+			// the itemized steps add up to the final price
+			charge := got.ListPrice
+			for _, s := range got.Steps {
+				charge -= s.Discount
+			}
+			require.Equal(t, got.Charge, charge)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package promotion
+
+import (
+	"math"
+	"oa-bitgin/pkg/domain"
+	"sort"
+)
+
+// MemberLevelDiscount applies the member's default discount to token purchases.
+type MemberLevelDiscount struct{}
+
+func (MemberLevelDiscount) Name() string { return "member_level_discount" }
+func (MemberLevelDiscount) Stage() Stage { return StageBase }
+
+func (r MemberLevelDiscount) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyToken {
+		return nil
+	}
+	result.AddStep(r.Name(), 0, order.Token*int64(order.Member.BuyTokenDefaultDiscount)/100, 0)
+	return nil
+}
+
+// BuyTokenActivityDiscount applies the running activities for the member's level.
+// An exclusive activity is applied alone. Otherwise only one activity per exclusion group is kept, stackable
+// activities are multiplied onto the member price in priority order, and the cheaper of that stack and the best
+// non-stackable activity (which replaces the member price) wins.
+type BuyTokenActivityDiscount struct{}
+
+func (BuyTokenActivityDiscount) Name() string { return "buy_token_activity" }
+func (BuyTokenActivityDiscount) Stage() Stage { return StageActivity }
+
+// preferred reports whether a should be chosen over b when only one of them can apply.
+func preferred(a, b *domain.BuyTokenActivity) bool {
+	if a.Stacking.Priority != b.Stacking.Priority {
+		return a.Stacking.Priority > b.Stacking.Priority
+	}
+	return a.BuyTokenDiscount < b.BuyTokenDiscount
+}
+
+func (r BuyTokenActivityDiscount) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyToken {
+		return nil
+	}
+
+	var exclusive *domain.BuyTokenActivity
+	groups := make(map[string]*domain.BuyTokenActivity)
+	matched := make([]*domain.BuyTokenActivity, 0)
+	for i := range order.BuyTokenActivities {
+		a := &order.BuyTokenActivities[i]
+		if !a.IsRunning(order.Now) || a.MemberLevel != order.Member.Level {
+			continue
+		}
+		if a.Stacking.Exclusive && (exclusive == nil || preferred(a, exclusive)) {
+			exclusive = a
+		}
+		if g := a.Stacking.ExclusionGroup; g != "" {
+			if cur, ok := groups[g]; ok && !preferred(a, cur) {
+				continue
+			}
+			groups[g] = a
+		}
+		matched = append(matched, a)
+	}
+	if exclusive != nil {
+		result.AddStep(r.Name(), exclusive.GetID(), order.Token*int64(exclusive.BuyTokenDiscount)/100, 0)
+		return nil
+	}
+
+	bestPrice := int64(math.MaxInt64)
+	var best *domain.BuyTokenActivity
+	stack := make([]*domain.BuyTokenActivity, 0)
+	for _, a := range matched {
+		if g := a.Stacking.ExclusionGroup; g != "" && groups[g] != a {
+			continue
+		}
+		if a.Stacking.Stackable {
+			stack = append(stack, a)
+			continue
+		}
+		if tmp := order.Token * int64(a.BuyTokenDiscount) / 100; tmp < bestPrice {
+			bestPrice = tmp
+			best = a
+		}
+	}
+
+	sort.SliceStable(stack, func(i, j int) bool { return stack[i].Stacking.Priority > stack[j].Stacking.Priority })
+	stackPrice := result.Charge
+	for _, a := range stack {
+		stackPrice = stackPrice * int64(a.BuyTokenDiscount) / 100
+	}
+
+	if len(stack) > 0 && (best == nil || stackPrice <= bestPrice) {
+		for _, a := range stack {
+			result.AddStep(r.Name(), a.GetID(), result.Charge*int64(a.BuyTokenDiscount)/100, 0)
+		}
+	} else if best != nil {
+		result.AddStep(r.Name(), best.GetID(), bestPrice, 0)
+	}
+	return nil
+}
+
+// PointRedemption pays part of a product with points according to the chosen BuyProductActivity.
+type PointRedemption struct{}
+
+func (PointRedemption) Name() string { return "point_redemption" }
+func (PointRedemption) Stage() Stage { return StageRedemption }
+
+func (r PointRedemption) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyProduct || order.BuyProductActivity == nil {
+		return nil
+	}
+	a := order.BuyProductActivity
+	if !a.Covers(order.Product) {
+		return domain.ErrActivityNotApplicable
+	}
+	needPoint := int64(order.Product.Price * (100 - a.GetPointDiscount()) / 100)
+	result.AddStep(r.Name(), a.GetID(), result.Charge-needPoint, needPoint)
+	return nil
+}
+
+// VIPPointBonus gives VIP members who redeem more than MinPoint points an extra Discount on the tokens left to pay.
+// 平台後來新增了另一個收費模式，如果有VIP身份扣100點以上折抵，另外享再九折優惠。
+type VIPPointBonus struct {
+	MinPoint int64
+	Discount int64 // 1-100
+}
+
+func (VIPPointBonus) Name() string { return "vip_point_bonus" }
+func (VIPPointBonus) Stage() Stage { return StageBonus }
+
+func (r VIPPointBonus) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyProduct || order.Member.Level == 0 || result.Point <= r.MinPoint {
+		return nil
+	}
+	result.AddStep(r.Name(), 0, result.Charge*r.Discount/100, 0)
+	return nil
+}
+
+// VolumeTierDiscount gives large token purchases the rate of the highest volume tier they reach,
+// on top of the member or activity price.
+type VolumeTierDiscount struct{}
+
+func (VolumeTierDiscount) Name() string { return "volume_tier" }
+func (VolumeTierDiscount) Stage() Stage { return StageBonus }
+
+func (r VolumeTierDiscount) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyToken {
+		return nil
+	}
+	if tier, ok := domain.ReachedVolumeTier(order.VolumeTiers, order.Token); ok {
+		result.AddStep(r.Name(), 0, result.Charge*int64(tier.Discount)/100, 0)
+	}
+	return nil
+}
+
+// BonusActivityReward gives the bonus tokens and points of every running bonus activity the purchase qualifies for.
+type BonusActivityReward struct{}
+
+func (BonusActivityReward) Name() string { return "bonus_activity" }
+func (BonusActivityReward) Stage() Stage { return StageBonus }
+
+func (r BonusActivityReward) Apply(order *Order, result *Result) error {
+	if order.Kind != KindBuyToken {
+		return nil
+	}
+	for i := range order.BonusActivities {
+		a := &order.BonusActivities[i]
+		if !a.IsRunning(order.Now) {
+			continue
+		}
+		token, point := a.Reward(order.Token)
+		result.AddBonus(r.Name(), a.GetID(), token, domain.MultiplyPoint(point, order.PointMultiplier))
+	}
+	return nil
+}
+
+// CouponBenefit applies the coupon entered at checkout, whether the code may still be used is checked by the caller.
+type CouponBenefit struct{}
+
+func (CouponBenefit) Name() string { return "coupon" }
+func (CouponBenefit) Stage() Stage { return StageCoupon }
+
+func (r CouponBenefit) Apply(order *Order, result *Result) error {
+	if order.Coupon == nil {
+		return nil
+	}
+	switch c := order.Coupon; c.Kind {
+	case domain.CouponDiscount:
+		result.AddStep(r.Name(), 0, result.Charge*c.Value/100, 0)
+	case domain.CouponTokenOff:
+		charge := result.Charge - c.Value
+		if charge < 0 {
+			charge = 0
+		}
+		result.AddStep(r.Name(), 0, charge, 0)
+	case domain.CouponPointBonus:
+		result.AddBonus(r.Name(), 0, 0, domain.MultiplyPoint(c.Value, order.PointMultiplier))
+	}
+	return nil
+}
@@ -3,26 +3,43 @@ package repository
 import (
 	"errors"
 	"oa-bitgin/pkg/domain"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Use to store all activity, use id as key
 type activityStore struct {
-	BuyTokenActivitiesIDCounter   atomic.Value
-	BuyProductActivitiesIDCounter atomic.Value
-	BuyTokenActivities            map[int]domain.BuyTokenActivity
-	BuyProductActivities          map[int]domain.BuyProductActivity
+	BuyTokenActivitiesIDCounter   int64
+	BuyProductActivitiesIDCounter int64
+	BonusActivitiesIDCounter      int64
+	BuyTokenActivities            *shardedMap[domain.BuyTokenActivity]
+	BuyProductActivities          *shardedMap[domain.BuyProductActivity]
+	BonusActivities               *shardedMap[domain.BonusActivity]
+
+	usageMu sync.Mutex // also serializes ConsumeBudget so the activity and user limits are checked together
+	Usage   map[usageKey]domain.BudgetUsage
+
+	changesMu sync.RWMutex
+	Changes   []domain.ActivityChange
+}
+
+type usageKey struct {
+	kind   domain.ActivityKind
+	id     int
+	userID int
 }
 
 func (s *activityStore) init() {
-	s.BuyTokenActivitiesIDCounter.Store(0)
-	s.BuyProductActivitiesIDCounter.Store(0)
-	s.BuyTokenActivities = make(map[int]domain.BuyTokenActivity)
-	s.BuyProductActivities = make(map[int]domain.BuyProductActivity)
+	s.BuyTokenActivities = newShardedMap[domain.BuyTokenActivity]()
+	s.BuyProductActivities = newShardedMap[domain.BuyProductActivity]()
+	s.BonusActivities = newShardedMap[domain.BonusActivity]()
+	s.Usage = make(map[usageKey]domain.BudgetUsage)
 }
 
 type activityRepository struct {
 	store *activityStore
+	undo  *undoLog
 }
 
 func NewActivityRepository() *activityRepository {
@@ -32,38 +49,193 @@ func NewActivityRepository() *activityRepository {
 }
 
 func (a *activityRepository) ListBuyTokenActivity() ([]domain.BuyTokenActivity, error) {
-	var rtn []domain.BuyTokenActivity
-	for _, v := range a.store.BuyTokenActivities {
-		rtn = append(rtn, v)
-	}
-	if len(rtn) == 0 {
-		return make([]domain.BuyTokenActivity, 0), nil
-	}
-	return rtn, nil
+	return a.store.BuyTokenActivities.values(), nil
 }
 
 func (a *activityRepository) AddBuyTokenActivity(activity domain.BuyTokenActivity) (int, error) {
-	id := a.store.BuyProductActivitiesIDCounter.Load().(int)
-	id++
-	a.store.BuyProductActivitiesIDCounter.Store(id)
+	id := int(atomic.AddInt64(&a.store.BuyTokenActivitiesIDCounter, 1))
 	activity.SetID(id)
-	a.store.BuyTokenActivities[id] = activity
+	a.store.BuyTokenActivities.set(id, activity)
+	a.undo.push(func() { a.store.BuyTokenActivities.delete(id) })
 	return id, nil
 }
 
 func (a *activityRepository) AddBuyProductActivity(activity domain.BuyProductActivity) (int, error) {
-	id := a.store.BuyProductActivitiesIDCounter.Load().(int)
-	id++
-	a.store.BuyProductActivitiesIDCounter.Store(id)
+	id := int(atomic.AddInt64(&a.store.BuyProductActivitiesIDCounter, 1))
 	activity.SetID(id)
-	a.store.BuyProductActivities[id] = activity
+	a.store.BuyProductActivities.set(id, activity)
+	a.undo.push(func() { a.store.BuyProductActivities.delete(id) })
 	return id, nil
 }
 
+func (a *activityRepository) GetBuyTokenActivity(id int) (domain.BuyTokenActivity, error) {
+	if activity, ok := a.store.BuyTokenActivities.get(id); ok {
+		return activity, nil
+	} else {
+		return domain.BuyTokenActivity{}, errors.New("activity not found")
+	}
+}
+
 func (a *activityRepository) GetBuyProductActivity(id int) (domain.BuyProductActivity, error) {
-	if activity, ok := a.store.BuyProductActivities[id]; ok {
+	if activity, ok := a.store.BuyProductActivities.get(id); ok {
 		return activity, nil
 	} else {
 		return domain.BuyProductActivity{}, errors.New("activity not found")
 	}
 }
+
+func (a *activityRepository) ListBuyProductActivity() ([]domain.BuyProductActivity, error) {
+	return a.store.BuyProductActivities.values(), nil
+}
+
+func (a *activityRepository) AddBonusActivity(activity domain.BonusActivity) (int, error) {
+	id := int(atomic.AddInt64(&a.store.BonusActivitiesIDCounter, 1))
+	activity.SetID(id)
+	a.store.BonusActivities.set(id, activity)
+	a.undo.push(func() { a.store.BonusActivities.delete(id) })
+	return id, nil
+}
+
+func (a *activityRepository) GetBonusActivity(id int) (domain.BonusActivity, error) {
+	if activity, ok := a.store.BonusActivities.get(id); ok {
+		return activity, nil
+	}
+	return domain.BonusActivity{}, errors.New("activity not found")
+}
+
+func (a *activityRepository) ListBonusActivity() ([]domain.BonusActivity, error) {
+	return a.store.BonusActivities.values(), nil
+}
+
+func (a *activityRepository) SetBudget(kind domain.ActivityKind, id int, budget domain.Budget) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		ac.SetBudget(budget)
+		return nil
+	})
+}
+
+func (a *activityRepository) SetUserLimit(kind domain.ActivityKind, id int, limit domain.Budget) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		ac.SetUserLimit(limit)
+		return nil
+	})
+}
+
+func (a *activityRepository) SetSchedule(kind domain.ActivityKind, id int, schedule *domain.Schedule) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		ac.SetSchedule(schedule)
+		return nil
+	})
+}
+
+func (a *activityRepository) SetPeriod(kind domain.ActivityKind, id int, startTime, endTime time.Time) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		return ac.SetPeriod(startTime, endTime)
+	})
+}
+
+func (a *activityRepository) SetDiscount(kind domain.ActivityKind, id int, discount int) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		switch ac := ac.(type) {
+		case *domain.BuyTokenActivity:
+			ac.BuyTokenDiscount = discount
+		case *domain.BuyProductActivity:
+			ac.PointDiscount = discount
+		default:
+			return errors.New("activity has no discount")
+		}
+		return nil
+	})
+}
+
+func (a *activityRepository) SetState(kind domain.ActivityKind, id int, state domain.ActivityState) error {
+	return a.updateActivity(kind, id, func(ac domain.Activity) error {
+		ac.SetState(state)
+		return nil
+	})
+}
+
+func (a *activityRepository) AddChange(change domain.ActivityChange) error {
+	s := a.store
+	s.changesMu.Lock()
+	defer s.changesMu.Unlock()
+	change.ID = len(s.Changes) + 1
+	s.Changes = append(s.Changes, change)
+	a.undo.push(func() {
+		s.changesMu.Lock()
+		defer s.changesMu.Unlock()
+		s.Changes = s.Changes[:change.ID-1]
+	})
+	return nil
+}
+
+func (a *activityRepository) ListChanges(kind domain.ActivityKind, id int) ([]domain.ActivityChange, error) {
+	a.store.changesMu.RLock()
+	defer a.store.changesMu.RUnlock()
+	rtn := make([]domain.ActivityChange, 0)
+	for _, c := range a.store.Changes {
+		if c.Kind == kind && c.ActivityID == id {
+			rtn = append(rtn, c)
+		}
+	}
+	return rtn, nil
+}
+
+func (a *activityRepository) GetUserUsage(kind domain.ActivityKind, id int, userID int) (domain.BudgetUsage, error) {
+	a.store.usageMu.Lock()
+	defer a.store.usageMu.Unlock()
+	return a.store.Usage[usageKey{kind: kind, id: id, userID: userID}], nil
+}
+
+func (a *activityRepository) ConsumeBudget(kind domain.ActivityKind, id int, userID int, discount int64) error {
+	s := a.store
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	key := usageKey{kind: kind, id: id, userID: userID}
+	old := s.Usage[key]
+	err := a.updateActivity(kind, id, func(ac domain.Activity) error {
+		return ac.Consume(old, discount)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Usage[key] = domain.BudgetUsage{Discount: old.Discount + discount, Redemptions: old.Redemptions + 1}
+	a.undo.push(func() {
+		s.usageMu.Lock()
+		defer s.usageMu.Unlock()
+		s.Usage[key] = old
+	})
+	return nil
+}
+
+// updateActivity changes activity id of kind in place with fn, the old value is restored on rollback. Restoring the
+// whole activity is safe because units of work run one at a time and the cashier changes activities only inside one.
+func (a *activityRepository) updateActivity(kind domain.ActivityKind, id int, fn func(a domain.Activity) error) error {
+	switch kind {
+	case domain.ActivityBuyToken:
+		return updateActivityIn(a.store.BuyTokenActivities, a.undo, id, fn)
+	case domain.ActivityBuyProduct:
+		return updateActivityIn(a.store.BuyProductActivities, a.undo, id, fn)
+	case domain.ActivityBonus:
+		return updateActivityIn(a.store.BonusActivities, a.undo, id, fn)
+	}
+	return errors.New("activity not found")
+}
+
+func updateActivityIn[V any, P interface {
+	*V
+	domain.Activity
+}](m *shardedMap[V], undo *undoLog, id int, fn func(a domain.Activity) error) error {
+	old, ok, err := m.update(id, func(v V) (V, error) {
+		err := fn(P(&v))
+		return v, err
+	})
+	if !ok {
+		return errors.New("activity not found")
+	}
+	if err == nil {
+		undo.push(func() { m.set(id, old) })
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"sync"
+	"testing"
+)
+
+func Test_activityRepository_Parallel(t *testing.T) {
+	const workers = 50
+	const rounds = 100
+	r := NewActivityRepository()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				_, err := r.AddBuyTokenActivity(domain.BuyTokenActivity{BuyTokenDiscount: 90})
+				require.NoError(t, err)
+				if j%20 == 0 {
+					_, err = r.ListBuyTokenActivity()
+					require.NoError(t, err)
+				}
+
+				id, err := r.AddBuyProductActivity(domain.BuyProductActivity{PointDiscount: 90})
+				require.NoError(t, err)
+				activity, err := r.GetBuyProductActivity(id)
+				require.NoError(t, err)
+				require.Equal(t, id, activity.GetID())
+			}
+		}()
+	}
+	wg.Wait()
+
+	activities, err := r.ListBuyTokenActivity()
+	require.NoError(t, err)
+	require.Len(t, activities, workers*rounds)
+	for i, a := range activities {
+		require.Equal(t, i+1, a.GetID())
+	}
+	_, err = r.GetBuyProductActivity(workers*rounds + 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"sort"
+	"sync"
+)
+
+type couponStore struct {
+	mu                  sync.RWMutex
+	BatchIDCounter      int
+	RedemptionIDCounter int
+	Batches             map[int]domain.CouponBatch
+	Coupons             map[string]domain.Coupon // key is the code
+	Redemptions         []domain.CouponRedemption
+}
+
+func (s *couponStore) init() {
+	s.Batches = make(map[int]domain.CouponBatch)
+	s.Coupons = make(map[string]domain.Coupon)
+}
+
+type couponRepository struct {
+	store *couponStore
+	undo  *undoLog
+}
+
+func NewCouponRepository() domain.CouponRepository {
+	store := &couponStore{}
+	store.init()
+	return &couponRepository{store: store}
+}
+
+func (c *couponRepository) AddBatch(batch domain.CouponBatch) (int, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.BatchIDCounter++
+	batch.ID = s.BatchIDCounter
+	s.Batches[batch.ID] = batch
+	c.undo.push(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.Batches, batch.ID)
+	})
+	return batch.ID, nil
+}
+
+func (c *couponRepository) GetBatch(id int) (domain.CouponBatch, error) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	if batch, ok := c.store.Batches[id]; ok {
+		return batch, nil
+	}
+	return domain.CouponBatch{}, errors.New("coupon batch not found")
+}
+
+func (c *couponRepository) AddCoupon(coupon domain.Coupon) error {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Batches[coupon.BatchID]; !ok {
+		return errors.New("coupon batch not found")
+	}
+	if _, ok := s.Coupons[coupon.Code]; ok {
+		return domain.ErrCouponCodeExists
+	}
+	s.Coupons[coupon.Code] = coupon
+	c.undo.push(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.Coupons, coupon.Code)
+	})
+	return nil
+}
+
+func (c *couponRepository) GetCoupon(code string) (domain.Coupon, error) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	if coupon, ok := c.store.Coupons[code]; ok {
+		return coupon, nil
+	}
+	return domain.Coupon{}, domain.ErrCouponNotFound
+}
+
+func (c *couponRepository) ListCoupons(batchID int) ([]domain.Coupon, error) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	rtn := make([]domain.Coupon, 0)
+	for _, coupon := range c.store.Coupons {
+		if coupon.BatchID == batchID {
+			rtn = append(rtn, coupon)
+		}
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].Code < rtn[j].Code })
+	return rtn, nil
+}
+
+func (c *couponRepository) Redeem(r domain.CouponRedemption) (int, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coupon, ok := s.Coupons[r.Code]
+	if !ok {
+		return -1, domain.ErrCouponNotFound
+	}
+	batch := s.Batches[coupon.BatchID]
+	if coupon.Used >= batch.MaxUses {
+		return -1, domain.ErrCouponUsedUp
+	}
+	if batch.PerUserLimit > 0 {
+		used := 0
+		for _, old := range s.Redemptions {
+			if old.BatchID == batch.ID && old.UserID == r.UserID {
+				used++
+			}
+		}
+		if used >= batch.PerUserLimit {
+			return -1, domain.ErrCouponUserLimit
+		}
+	}
+
+	coupon.Used++
+	s.Coupons[coupon.Code] = coupon
+	s.RedemptionIDCounter++
+	r.ID = s.RedemptionIDCounter
+	r.BatchID = batch.ID
+	s.Redemptions = append(s.Redemptions, r)
+	c.undo.push(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		coupon := s.Coupons[r.Code]
+		coupon.Used--
+		s.Coupons[r.Code] = coupon
+		for i := range s.Redemptions {
+			if s.Redemptions[i].ID == r.ID {
+				s.Redemptions = append(s.Redemptions[:i], s.Redemptions[i+1:]...)
+				break
+			}
+		}
+	})
+	return r.ID, nil
+}
+
+func (c *couponRepository) ListRedemptions(batchID int) ([]domain.CouponRedemption, error) {
+	c.store.mu.RLock()
+	defer c.store.mu.RUnlock()
+	rtn := make([]domain.CouponRedemption, 0)
+	for _, r := range c.store.Redemptions {
+		if r.BatchID == batchID {
+			rtn = append(rtn, r)
+		}
+	}
+	return rtn, nil
+}
@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"bufio"
+	"encoding/json"
+	"oa-bitgin/pkg/domain"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	eventLogFile    = "events.jsonl"
+	snapshotLogFile = "snapshots.jsonl"
+)
+
+// fileEventStore keeps events and snapshots in append-only JSON lines files.
+type fileEventStore struct {
+	mu        sync.Mutex
+	dir       string
+	events    *os.File
+	snapshots *os.File
+	seq       int64
+}
+
+// NewFileEventStore opens (or creates) the event log in dir.
+func NewFileEventStore(dir string) (*fileEventStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &fileEventStore{dir: dir}
+	if err := s.replay(0, func(e domain.Event) bool {
+		s.seq = e.Seq
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.events, err = os.OpenFile(filepath.Join(dir, eventLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		return nil, err
+	}
+	if s.snapshots, err = os.OpenFile(filepath.Join(dir, snapshotLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+		_ = s.events.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileEventStore) Close() error {
+	err := s.events.Close()
+	if err2 := s.snapshots.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func appendLine(f *os.File, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// readLines decodes every line of file into a new T and passes it to fn until fn returns false.
+func readLines[T any](path string, fn func(v T) bool) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var v T
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			return err
+		}
+		if !fn(v) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *fileEventStore) Append(event domain.Event) (domain.Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	event.Seq = s.seq + 1
+	if err := appendLine(s.events, event); err != nil {
+		return event, err
+	}
+	s.seq = event.Seq
+	return event, nil
+}
+
+func (s *fileEventStore) Replay(afterSeq int64, fn func(event domain.Event) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replay(afterSeq, fn)
+}
+
+func (s *fileEventStore) replay(afterSeq int64, fn func(event domain.Event) bool) error {
+	return readLines(filepath.Join(s.dir, eventLogFile), func(e domain.Event) bool {
+		if e.Seq <= afterSeq {
+			return true
+		}
+		return fn(e)
+	})
+}
+
+func (s *fileEventStore) SaveSnapshot(state domain.CashierState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendLine(s.snapshots, state)
+}
+
+func (s *fileEventStore) LoadSnapshot(at time.Time) (domain.CashierState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rtn domain.CashierState
+	found := false
+	err := readLines(filepath.Join(s.dir, snapshotLogFile), func(state domain.CashierState) bool {
+		if state.Time.After(at) {
+			return false
+		}
+		rtn, found = state, true
+		return true
+	})
+	return rtn, found, err
+}
@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+type balanceKey struct {
+	account string
+	unit    domain.Unit
+}
+
+type ledgerStore struct {
+	mu          sync.RWMutex
+	IDCounter   int
+	Entries     []domain.JournalEntry // ordered by ID
+	UserEntries map[int][]int         // entry ids of each user in order, so reading a user's entries skips everyone else's
+	Balances    map[balanceKey]int64
+}
+
+func (s *ledgerStore) init() {
+	s.UserEntries = make(map[int][]int)
+	s.Balances = make(map[balanceKey]int64)
+}
+
+type ledgerRepository struct {
+	store *ledgerStore
+	undo  *undoLog
+}
+
+func NewLedgerRepository() domain.LedgerRepository {
+	store := &ledgerStore{}
+	store.init()
+	return &ledgerRepository{store: store}
+}
+
+func (l *ledgerRepository) Post(entry domain.JournalEntry) (int, error) {
+	if err := entry.Validate(); err != nil {
+		return -1, err
+	}
+	s := l.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.IDCounter++
+	entry.ID = s.IDCounter
+	s.apply(&entry, 1)
+	s.Entries = append(s.Entries, entry)
+	s.UserEntries[entry.UserID] = append(s.UserEntries[entry.UserID], entry.ID)
+	l.undo.push(func() { s.remove(entry.ID) })
+	return entry.ID, nil
+}
+
+// apply adds (sign 1) or removes (sign -1) the postings of entry from the balances.
+func (s *ledgerStore) apply(entry *domain.JournalEntry, sign int64) {
+	for _, p := range entry.Postings {
+		s.Balances[balanceKey{account: p.Account, unit: p.Unit}] += sign * (p.Credit - p.Debit)
+	}
+}
+
+// find returns the index of entry id, the caller must hold the lock.
+func (s *ledgerStore) find(id int) (int, bool) {
+	i := sort.Search(len(s.Entries), func(i int) bool { return s.Entries[i].ID >= id })
+	return i, i < len(s.Entries) && s.Entries[i].ID == id
+}
+
+func (s *ledgerStore) remove(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.find(id)
+	if !ok {
+		return
+	}
+	userID := s.Entries[i].UserID
+	s.apply(&s.Entries[i], -1)
+	s.Entries = append(s.Entries[:i], s.Entries[i+1:]...)
+	ids := s.UserEntries[userID]
+	if j := sort.SearchInts(ids, id); j < len(ids) && ids[j] == id {
+		s.UserEntries[userID] = append(ids[:j], ids[j+1:]...)
+	}
+}
+
+// userEntries calls fn with each entry of the user in order until fn returns false, the caller must hold the lock.
+func (s *ledgerStore) userEntries(userID int, fn func(e *domain.JournalEntry) bool) {
+	for _, id := range s.UserEntries[userID] {
+		if i, ok := s.find(id); ok && !fn(&s.Entries[i]) {
+			return
+		}
+	}
+}
+
+func (l *ledgerRepository) GetEntry(id int) (domain.JournalEntry, error) {
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	if i, ok := l.store.find(id); ok {
+		return l.store.Entries[i], nil
+	}
+	return domain.JournalEntry{}, errors.New("journal entry not found")
+}
+
+func (l *ledgerRepository) ListEntries(userID int, filter domain.TransactionFilter) ([]domain.JournalEntry, error) {
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	rtn := make([]domain.JournalEntry, 0)
+	l.store.userEntries(userID, func(e *domain.JournalEntry) bool {
+		if filter.Limit > 0 && len(rtn) == filter.Limit {
+			return false
+		}
+		if filter.Match(e) {
+			rtn = append(rtn, *e)
+		}
+		return true
+	})
+	return rtn, nil
+}
+
+func (l *ledgerRepository) ListRefunds(purchaseID int) ([]domain.JournalEntry, error) {
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	rtn := make([]domain.JournalEntry, 0)
+	for _, e := range l.store.Entries {
+		if e.Type == domain.TransactionRefund && e.RefundOf == purchaseID {
+			rtn = append(rtn, e)
+		}
+	}
+	return rtn, nil
+}
+
+func (l *ledgerRepository) GetBalance(account string, unit domain.Unit) (int64, error) {
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	return l.store.Balances[balanceKey{account: account, unit: unit}], nil
+}
+
+func (l *ledgerRepository) GetUserSpend(userID int, since time.Time) (int64, error) {
+	l.store.mu.RLock()
+	defer l.store.mu.RUnlock()
+	var spend int64
+	l.store.userEntries(userID, func(e *domain.JournalEntry) bool {
+		if !e.CreatedAt.Before(since) {
+			spend += e.Spend()
+		}
+		return true
+	})
+	return spend, nil
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"testing"
+	"time"
+)
+
+func Test_ledgerRepository_GetUserSpend(t *testing.T) {
+	uow := NewMemoryUnitOfWork()
+	ledger := uow.Ledger()
+	start := time.Now()
+	post := func(ledger domain.LedgerRepository, userID int, at time.Time) error {
+		entry := domain.JournalEntry{Type: domain.TransactionBuyToken, UserID: userID, Charged: 95, CreatedAt: at}
+		entry.Credit(domain.UserAccount(userID), domain.UnitToken, 100)
+		entry.Debit(domain.AccountCashierRevenue, domain.UnitToken, 95)
+		entry.Debit(domain.AccountPromotionExpense, domain.UnitToken, 5)
+		_, err := ledger.Post(entry)
+		return err
+	}
+	require.NoError(t, post(ledger, 1, start))
+	require.NoError(t, post(ledger, 2, start))
+	require.NoError(t, post(ledger, 1, start.Add(time.Hour)))
+	refund := domain.JournalEntry{Type: domain.TransactionRefund, UserID: 1, CreatedAt: start.Add(time.Hour)}
+	refund.Debit(domain.AccountCashierSales, domain.UnitToken, 30)
+	refund.Credit(domain.UserAccount(1), domain.UnitToken, 30)
+	_, err := ledger.Post(refund)
+	require.NoError(t, err)
+
+	// a rolled back entry leaves the user's entries
+	err = uow.Do(func(repos domain.Repositories) error {
+		require.NoError(t, post(repos.Ledger(), 1, start.Add(time.Hour)))
+		return errors.New("testRollback")
+	})
+	require.Error(t, err)
+
+	spend, err := ledger.GetUserSpend(1, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, int64(95+95-30), spend)
+	spend, err = ledger.GetUserSpend(1, start.Add(time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, int64(95-30), spend)
+	entries, err := ledger.ListEntries(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	entries, err = ledger.ListEntries(2, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
@@ -6,35 +6,91 @@ import (
 	"sync/atomic"
 )
 
-type productRepository struct {
-	IDCounter atomic.Value
-	Product   map[int]domain.Product
+type productStore struct {
+	IDCounter int64
+	Product   *shardedMap[domain.Product]
 }
 
-func (p *productRepository) init() {
-	p.IDCounter.Store(0)
-	p.Product = make(map[int]domain.Product)
+func (s *productStore) init() {
+	s.Product = newShardedMap[domain.Product]()
+}
+
+type productRepository struct {
+	store *productStore
+	undo  *undoLog
 }
 
 func NewProductRepository() domain.ProductRepository {
-	store := &productRepository{}
+	store := &productStore{}
 	store.init()
-	return store
+	return &productRepository{store: store}
 }
 
 func (p *productRepository) AddProduct(product domain.Product) (int, error) {
-	id := p.IDCounter.Load().(int)
-	id++
-	p.IDCounter.Store(id)
+	id := int(atomic.AddInt64(&p.store.IDCounter, 1))
 	product.ID = id
-	p.Product[id] = product
+	p.store.Product.set(id, product)
+	p.undo.push(func() { p.store.Product.delete(id) })
 	return id, nil
 }
 
 func (p *productRepository) GetProduct(id int) (domain.Product, error) {
-	if product, ok := p.Product[id]; ok {
+	if product, ok := p.store.Product.get(id); ok {
 		return product, nil
 	} else {
 		return domain.Product{}, errors.New("product not found")
 	}
 }
+
+func (p *productRepository) ListProducts() ([]domain.Product, error) {
+	return p.store.Product.values(), nil
+}
+
+func (p *productRepository) SetStock(id int, stock int, lowStockThreshold int) error {
+	old, ok, _ := p.store.Product.update(id, func(product domain.Product) (domain.Product, error) {
+		product.TrackStock, product.Stock, product.LowStockThreshold = true, stock, lowStockThreshold
+		return product, nil
+	})
+	if !ok {
+		return errors.New("product not found")
+	}
+	// only the stock fields are put back, the rest of the product may have changed since
+	p.undo.push(func() {
+		_, _, _ = p.store.Product.update(id, func(product domain.Product) (domain.Product, error) {
+			product.TrackStock, product.Stock, product.LowStockThreshold = old.TrackStock, old.Stock, old.LowStockThreshold
+			return product, nil
+		})
+	})
+	return nil
+}
+
+func (p *productRepository) AdjustStock(id int, delta int) (domain.Product, error) {
+	var next domain.Product
+	old, ok, err := p.store.Product.update(id, func(product domain.Product) (domain.Product, error) {
+		if !product.TrackStock {
+			next = product
+			return product, nil
+		}
+		if product.Stock+delta < 0 {
+			return product, domain.ErrOutOfStock
+		}
+		product.Stock += delta
+		next = product
+		return product, nil
+	})
+	if !ok {
+		return domain.Product{}, errors.New("product not found")
+	}
+	if err != nil {
+		return old, err
+	}
+	if next.TrackStock {
+		p.undo.push(func() {
+			_, _, _ = p.store.Product.update(id, func(product domain.Product) (domain.Product, error) {
+				product.Stock -= delta
+				return product, nil
+			})
+		})
+	}
+	return next, nil
+}
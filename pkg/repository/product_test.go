@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"sync"
+	"testing"
+)
+
+func Test_productRepository_Parallel(t *testing.T) {
+	const workers = 50
+	const rounds = 200
+	r := NewProductRepository()
+
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				id, err := r.AddProduct(domain.Product{Name: "testProduct", Price: i})
+				require.NoError(t, err)
+				product, err := r.GetProduct(id)
+				require.NoError(t, err)
+				require.Equal(t, i, product.Price)
+
+				mu.Lock()
+				require.False(t, seen[id], "duplicate id %d", id)
+				seen[id] = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Len(t, seen, workers*rounds)
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+)
+
+const shardCount = 16
+
+type shard[V any] struct {
+	mu    sync.RWMutex
+	items map[int]V
+}
+
+// shardedMap is a map keyed by id that is safe for concurrent use,
+// ids are spread over shards so writers of different ids rarely block each other.
+type shardedMap[V any] struct {
+	shards [shardCount]shard[V]
+}
+
+func newShardedMap[V any]() *shardedMap[V] {
+	m := &shardedMap[V]{}
+	for i := range m.shards {
+		m.shards[i].items = make(map[int]V)
+	}
+	return m
+}
+
+func (m *shardedMap[V]) shard(id int) *shard[V] {
+	return &m.shards[uint(id)%shardCount]
+}
+
+func (m *shardedMap[V]) get(id int) (V, bool) {
+	s := m.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.items[id]
+	return v, ok
+}
+
+func (m *shardedMap[V]) set(id int, v V) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[id] = v
+}
+
+// update replaces the value of id with what fn returns while holding the shard lock,
+// nothing is changed when id is missing or fn fails.
+func (m *shardedMap[V]) update(id int, fn func(v V) (V, error)) (old V, ok bool, err error) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok = s.items[id]; !ok {
+		return old, false, nil
+	}
+	v, err := fn(old)
+	if err != nil {
+		return old, true, err
+	}
+	s.items[id] = v
+	return old, true, nil
+}
+
+func (m *shardedMap[V]) delete(id int) {
+	s := m.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, id)
+}
+
+// values returns all values ordered by id.
+func (m *shardedMap[V]) values() []V {
+	ids := make([]int, 0)
+	items := make(map[int]V)
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		for id, v := range s.items {
+			ids = append(ids, id)
+			items[id] = v
+		}
+		s.mu.RUnlock()
+	}
+	sort.Ints(ids)
+	rtn := make([]V, 0, len(ids))
+	for _, id := range ids {
+		rtn = append(rtn, items[id])
+	}
+	return rtn
+}
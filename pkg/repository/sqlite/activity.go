@@ -0,0 +1,395 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+type activityRepository struct {
+	db dbtx
+}
+
+func NewActivityRepository(db *sql.DB) domain.ActivityRepository {
+	return &activityRepository{db: db}
+}
+
+// activityTables maps an activity kind to its table.
+var activityTables = map[domain.ActivityKind]string{
+	domain.ActivityBuyToken:   "buy_token_activities",
+	domain.ActivityBuyProduct: "buy_product_activities",
+	domain.ActivityBonus:      "bonus_activities",
+}
+
+const budgetColumns = `max_discount, max_redemptions, used_discount, used_redemptions, user_max_discount, user_max_redemptions`
+
+const buyTokenActivityColumns = `id, start_date, end_date, member_level, discount, stackable, priority, exclusion_group, exclusive, schedule, state, ` +
+	budgetColumns
+
+// encodeSchedule stores a schedule as JSON, an empty string for none.
+func encodeSchedule(schedule *domain.Schedule) (string, error) {
+	if schedule == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(schedule)
+	return string(b), err
+}
+
+func decodeSchedule(s string) (*domain.Schedule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	schedule := &domain.Schedule{}
+	if err := json.Unmarshal([]byte(s), schedule); err != nil {
+		return nil, err
+	}
+	// resolves the time zone, the schedule was validated when it was set
+	return schedule, schedule.Validate()
+}
+
+func (a *activityRepository) AddBuyTokenActivity(activity domain.BuyTokenActivity) (int, error) {
+	start, end := activity.GetPeriod()
+	s := activity.Stacking
+	schedule, err := encodeSchedule(activity.Schedule)
+	if err != nil {
+		return -1, err
+	}
+	res, err := a.db.Exec(`INSERT INTO buy_token_activities (start_date, end_date, member_level, discount, stackable, priority, exclusion_group, exclusive,
+		schedule, state, max_discount, max_redemptions, user_max_discount, user_max_redemptions)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		start.UnixNano(), end.UnixNano(), activity.MemberLevel, activity.BuyTokenDiscount, s.Stackable, s.Priority, s.ExclusionGroup, s.Exclusive,
+		schedule, string(activity.GetState()), activity.Budget.MaxDiscount, activity.Budget.MaxRedemptions, activity.UserLimit.MaxDiscount, activity.UserLimit.MaxRedemptions)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (a *activityRepository) GetBuyTokenActivity(id int) (domain.BuyTokenActivity, error) {
+	activities, err := a.queryBuyTokenActivities(`SELECT `+buyTokenActivityColumns+` FROM buy_token_activities WHERE id = ?`, id)
+	if err != nil {
+		return domain.BuyTokenActivity{}, err
+	}
+	if len(activities) == 0 {
+		return domain.BuyTokenActivity{}, errors.New("activity not found")
+	}
+	return activities[0], nil
+}
+
+func (a *activityRepository) ListBuyTokenActivity() ([]domain.BuyTokenActivity, error) {
+	return a.queryBuyTokenActivities(`SELECT ` + buyTokenActivityColumns + ` FROM buy_token_activities ORDER BY id`)
+}
+
+func (a *activityRepository) queryBuyTokenActivities(query string, args ...interface{}) ([]domain.BuyTokenActivity, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.BuyTokenActivity, 0)
+	for rows.Next() {
+		var activity domain.BuyTokenActivity
+		var id int
+		var start, end int64
+		var schedule, state string
+		if err := rows.Scan(&id, &start, &end, &activity.MemberLevel, &activity.BuyTokenDiscount,
+			&activity.Stacking.Stackable, &activity.Stacking.Priority, &activity.Stacking.ExclusionGroup, &activity.Stacking.Exclusive,
+			&schedule, &state,
+			&activity.Budget.MaxDiscount, &activity.Budget.MaxRedemptions, &activity.Used.Discount, &activity.Used.Redemptions,
+			&activity.UserLimit.MaxDiscount, &activity.UserLimit.MaxRedemptions); err != nil {
+			return nil, err
+		}
+		if activity.Schedule, err = decodeSchedule(schedule); err != nil {
+			return nil, err
+		}
+		activity.SetState(domain.ActivityState(state))
+		activity.SetID(id)
+		_ = activity.SetPeriod(time.Unix(0, start), time.Unix(0, end))
+		rtn = append(rtn, activity)
+	}
+	return rtn, rows.Err()
+}
+
+func (a *activityRepository) AddBuyProductActivity(activity domain.BuyProductActivity) (int, error) {
+	start, end := activity.GetPeriod()
+	scope := activity.Scope
+	categories, err := json.Marshal(scope.Categories)
+	if err != nil {
+		return -1, err
+	}
+	schedule, err := encodeSchedule(activity.Schedule)
+	if err != nil {
+		return -1, err
+	}
+	res, err := a.db.Exec(`INSERT INTO buy_product_activities (start_date, end_date, point_discount, max_discount, max_redemptions,
+		user_max_discount, user_max_redemptions, scope_product_ids, scope_categories, scope_min_price, scope_max_price, schedule, state)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		start.UnixNano(), end.UnixNano(), activity.PointDiscount, activity.Budget.MaxDiscount, activity.Budget.MaxRedemptions,
+		activity.UserLimit.MaxDiscount, activity.UserLimit.MaxRedemptions,
+		joinIDs(scope.ProductIDs), string(categories), scope.MinPrice, scope.MaxPrice, schedule, string(activity.GetState()))
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+const buyProductActivityColumns = `id, start_date, end_date, point_discount, ` + budgetColumns +
+	`, scope_product_ids, scope_categories, scope_min_price, scope_max_price, schedule, state`
+
+func (a *activityRepository) GetBuyProductActivity(id int) (domain.BuyProductActivity, error) {
+	activities, err := a.queryBuyProductActivities(`SELECT `+buyProductActivityColumns+` FROM buy_product_activities WHERE id = ?`, id)
+	if err != nil {
+		return domain.BuyProductActivity{}, err
+	}
+	if len(activities) == 0 {
+		return domain.BuyProductActivity{}, errors.New("activity not found")
+	}
+	return activities[0], nil
+}
+
+func (a *activityRepository) ListBuyProductActivity() ([]domain.BuyProductActivity, error) {
+	return a.queryBuyProductActivities(`SELECT ` + buyProductActivityColumns + ` FROM buy_product_activities ORDER BY id`)
+}
+
+func (a *activityRepository) queryBuyProductActivities(query string, args ...interface{}) ([]domain.BuyProductActivity, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.BuyProductActivity, 0)
+	for rows.Next() {
+		var activity domain.BuyProductActivity
+		var id int
+		var start, end int64
+		var productIDs, categories, schedule, state string
+		if err := rows.Scan(&id, &start, &end, &activity.PointDiscount,
+			&activity.Budget.MaxDiscount, &activity.Budget.MaxRedemptions, &activity.Used.Discount, &activity.Used.Redemptions,
+			&activity.UserLimit.MaxDiscount, &activity.UserLimit.MaxRedemptions,
+			&productIDs, &categories, &activity.Scope.MinPrice, &activity.Scope.MaxPrice, &schedule, &state); err != nil {
+			return nil, err
+		}
+		activity.Scope.ProductIDs = splitIDs(productIDs)
+		if err := json.Unmarshal([]byte(categories), &activity.Scope.Categories); err != nil {
+			return nil, err
+		}
+		if activity.Schedule, err = decodeSchedule(schedule); err != nil {
+			return nil, err
+		}
+		activity.SetState(domain.ActivityState(state))
+		activity.SetID(id)
+		_ = activity.SetPeriod(time.Unix(0, start), time.Unix(0, end))
+		rtn = append(rtn, activity)
+	}
+	return rtn, rows.Err()
+}
+
+const bonusActivityColumns = `id, start_date, end_date, threshold, bonus_token, bonus_point, max_bonus_token, max_bonus_point, schedule, state, ` +
+	budgetColumns
+
+func (a *activityRepository) AddBonusActivity(activity domain.BonusActivity) (int, error) {
+	start, end := activity.GetPeriod()
+	schedule, err := encodeSchedule(activity.Schedule)
+	if err != nil {
+		return -1, err
+	}
+	res, err := a.db.Exec(`INSERT INTO bonus_activities (start_date, end_date, threshold, bonus_token, bonus_point, max_bonus_token, max_bonus_point,
+		schedule, state, max_discount, max_redemptions, user_max_discount, user_max_redemptions)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		start.UnixNano(), end.UnixNano(), activity.Threshold, activity.BonusToken, activity.BonusPoint, activity.MaxBonusToken, activity.MaxBonusPoint,
+		schedule, string(activity.GetState()), activity.Budget.MaxDiscount, activity.Budget.MaxRedemptions, activity.UserLimit.MaxDiscount, activity.UserLimit.MaxRedemptions)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (a *activityRepository) GetBonusActivity(id int) (domain.BonusActivity, error) {
+	activities, err := a.queryBonusActivities(`SELECT `+bonusActivityColumns+` FROM bonus_activities WHERE id = ?`, id)
+	if err != nil {
+		return domain.BonusActivity{}, err
+	}
+	if len(activities) == 0 {
+		return domain.BonusActivity{}, errors.New("activity not found")
+	}
+	return activities[0], nil
+}
+
+func (a *activityRepository) ListBonusActivity() ([]domain.BonusActivity, error) {
+	return a.queryBonusActivities(`SELECT ` + bonusActivityColumns + ` FROM bonus_activities ORDER BY id`)
+}
+
+func (a *activityRepository) queryBonusActivities(query string, args ...interface{}) ([]domain.BonusActivity, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.BonusActivity, 0)
+	for rows.Next() {
+		var activity domain.BonusActivity
+		var id int
+		var start, end int64
+		var schedule, state string
+		if err := rows.Scan(&id, &start, &end, &activity.Threshold, &activity.BonusToken, &activity.BonusPoint,
+			&activity.MaxBonusToken, &activity.MaxBonusPoint, &schedule, &state,
+			&activity.Budget.MaxDiscount, &activity.Budget.MaxRedemptions, &activity.Used.Discount, &activity.Used.Redemptions,
+			&activity.UserLimit.MaxDiscount, &activity.UserLimit.MaxRedemptions); err != nil {
+			return nil, err
+		}
+		if activity.Schedule, err = decodeSchedule(schedule); err != nil {
+			return nil, err
+		}
+		activity.SetState(domain.ActivityState(state))
+		activity.SetID(id)
+		_ = activity.SetPeriod(time.Unix(0, start), time.Unix(0, end))
+		rtn = append(rtn, activity)
+	}
+	return rtn, rows.Err()
+}
+
+func (a *activityRepository) SetBudget(kind domain.ActivityKind, id int, budget domain.Budget) error {
+	return a.setLimit(kind, id, `max_discount`, `max_redemptions`, budget)
+}
+
+func (a *activityRepository) SetUserLimit(kind domain.ActivityKind, id int, limit domain.Budget) error {
+	return a.setLimit(kind, id, `user_max_discount`, `user_max_redemptions`, limit)
+}
+
+func (a *activityRepository) SetSchedule(kind domain.ActivityKind, id int, schedule *domain.Schedule) error {
+	s, err := encodeSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	return a.update(kind, id, `schedule = ?`, s)
+}
+
+func (a *activityRepository) SetPeriod(kind domain.ActivityKind, id int, startTime, endTime time.Time) error {
+	return a.update(kind, id, `start_date = ?, end_date = ?`, startTime.UnixNano(), endTime.UnixNano())
+}
+
+// discountColumns maps an activity kind to its discount column.
+var discountColumns = map[domain.ActivityKind]string{
+	domain.ActivityBuyToken:   "discount",
+	domain.ActivityBuyProduct: "point_discount",
+}
+
+func (a *activityRepository) SetDiscount(kind domain.ActivityKind, id int, discount int) error {
+	column, ok := discountColumns[kind]
+	if !ok {
+		return errors.New("activity has no discount")
+	}
+	return a.update(kind, id, column+` = ?`, discount)
+}
+
+func (a *activityRepository) SetState(kind domain.ActivityKind, id int, state domain.ActivityState) error {
+	return a.update(kind, id, `state = ?`, string(state))
+}
+
+// update sets the columns of activity id of kind, set is the SET clause and args its values.
+func (a *activityRepository) update(kind domain.ActivityKind, id int, set string, args ...interface{}) error {
+	table, ok := activityTables[kind]
+	if !ok {
+		return errors.New("activity not found")
+	}
+	res, err := a.db.Exec(`UPDATE `+table+` SET `+set+` WHERE id = ?`, append(args, id)...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("activity not found")
+	}
+	return nil
+}
+
+func (a *activityRepository) AddChange(change domain.ActivityChange) error {
+	_, err := a.db.Exec(`INSERT INTO activity_changes (kind, activity_id, action, detail, reason, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		string(change.Kind), change.ActivityID, string(change.Action), change.Detail, change.Reason, change.CreatedAt.UnixNano())
+	return err
+}
+
+func (a *activityRepository) ListChanges(kind domain.ActivityKind, id int) ([]domain.ActivityChange, error) {
+	rows, err := a.db.Query(`SELECT id, kind, activity_id, action, detail, reason, created_at FROM activity_changes
+		WHERE kind = ? AND activity_id = ? ORDER BY id`, string(kind), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.ActivityChange, 0)
+	for rows.Next() {
+		var c domain.ActivityChange
+		var kind, action string
+		var createdAt int64
+		if err := rows.Scan(&c.ID, &kind, &c.ActivityID, &action, &c.Detail, &c.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		c.Kind = domain.ActivityKind(kind)
+		c.Action = domain.ActivityAction(action)
+		c.CreatedAt = time.Unix(0, createdAt)
+		rtn = append(rtn, c)
+	}
+	return rtn, rows.Err()
+}
+
+func (a *activityRepository) setLimit(kind domain.ActivityKind, id int, discountColumn, redemptionsColumn string, limit domain.Budget) error {
+	return a.update(kind, id, discountColumn+` = ?, `+redemptionsColumn+` = ?`, limit.MaxDiscount, limit.MaxRedemptions)
+}
+
+func (a *activityRepository) GetUserUsage(kind domain.ActivityKind, id int, userID int) (domain.BudgetUsage, error) {
+	var used domain.BudgetUsage
+	err := a.db.QueryRow(`SELECT discount, redemptions FROM activity_usage WHERE kind = ? AND activity_id = ? AND user_id = ?`,
+		string(kind), id, userID).Scan(&used.Discount, &used.Redemptions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.BudgetUsage{}, nil
+	}
+	return used, err
+}
+
+func (a *activityRepository) ConsumeBudget(kind domain.ActivityKind, id int, userID int, discount int64) error {
+	return inTx(a.db, func(tx dbtx) error {
+		var limit domain.Budget
+		err := tx.QueryRow(`SELECT user_max_discount, user_max_redemptions FROM `+activityTables[kind]+` WHERE id = ?`, id).
+			Scan(&limit.MaxDiscount, &limit.MaxRedemptions)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("activity not found")
+		}
+		if err != nil {
+			return err
+		}
+		used, err := (&activityRepository{db: tx}).GetUserUsage(kind, id, userID)
+		if err != nil {
+			return err
+		}
+		if !limit.Allows(used, discount) {
+			return domain.ErrActivityUserLimit
+		}
+
+		// the limits are checked by the update itself, so concurrent purchases cannot overspend the budget
+		res, err := tx.Exec(`UPDATE `+activityTables[kind]+` SET used_discount = used_discount + ?1, used_redemptions = used_redemptions + 1
+			WHERE id = ?2 AND (max_discount = 0 OR used_discount + ?1 <= max_discount)
+			AND (max_redemptions = 0 OR used_redemptions < max_redemptions)`, discount, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return domain.ErrActivityBudgetExhausted
+		}
+		_, err = tx.Exec(`INSERT INTO activity_usage (kind, activity_id, user_id, discount, redemptions) VALUES (?1, ?2, ?3, ?4, 1)
+			ON CONFLICT (kind, activity_id, user_id) DO UPDATE SET discount = discount + ?4, redemptions = redemptions + 1`,
+			string(kind), id, userID, discount)
+		return err
+	})
+}
@@ -0,0 +1,154 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"strings"
+	"time"
+)
+
+type couponRepository struct {
+	db dbtx
+}
+
+func NewCouponRepository(db *sql.DB) domain.CouponRepository {
+	return &couponRepository{db: db}
+}
+
+func (c *couponRepository) AddBatch(batch domain.CouponBatch) (int, error) {
+	res, err := c.db.Exec(`INSERT INTO coupon_batches (name, kind, value, start_date, end_date, max_uses, per_user_limit)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		batch.Name, int(batch.Kind), batch.Value, batch.StartDate.UnixNano(), batch.EndDate.UnixNano(), batch.MaxUses, batch.PerUserLimit)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (c *couponRepository) GetBatch(id int) (domain.CouponBatch, error) {
+	var batch domain.CouponBatch
+	var kind int
+	var start, end int64
+	err := c.db.QueryRow(`SELECT id, name, kind, value, start_date, end_date, max_uses, per_user_limit FROM coupon_batches WHERE id = ?`, id).
+		Scan(&batch.ID, &batch.Name, &kind, &batch.Value, &start, &end, &batch.MaxUses, &batch.PerUserLimit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.CouponBatch{}, errors.New("coupon batch not found")
+	}
+	if err != nil {
+		return domain.CouponBatch{}, err
+	}
+	batch.Kind = domain.CouponKind(kind)
+	batch.StartDate = time.Unix(0, start)
+	batch.EndDate = time.Unix(0, end)
+	return batch, nil
+}
+
+func (c *couponRepository) AddCoupon(coupon domain.Coupon) error {
+	_, err := c.db.Exec(`INSERT INTO coupons (code, batch_id) VALUES (?, ?)`, coupon.Code, coupon.BatchID)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return domain.ErrCouponCodeExists
+	}
+	return err
+}
+
+func (c *couponRepository) GetCoupon(code string) (domain.Coupon, error) {
+	coupon := domain.Coupon{Code: code}
+	err := c.db.QueryRow(`SELECT batch_id, used FROM coupons WHERE code = ?`, code).Scan(&coupon.BatchID, &coupon.Used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Coupon{}, domain.ErrCouponNotFound
+	}
+	if err != nil {
+		return domain.Coupon{}, err
+	}
+	return coupon, nil
+}
+
+func (c *couponRepository) ListCoupons(batchID int) ([]domain.Coupon, error) {
+	rows, err := c.db.Query(`SELECT code, batch_id, used FROM coupons WHERE batch_id = ? ORDER BY code`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.Coupon, 0)
+	for rows.Next() {
+		var coupon domain.Coupon
+		if err := rows.Scan(&coupon.Code, &coupon.BatchID, &coupon.Used); err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, coupon)
+	}
+	return rtn, rows.Err()
+}
+
+func (c *couponRepository) Redeem(r domain.CouponRedemption) (int, error) {
+	var id int64
+	err := inTx(c.db, func(tx dbtx) error {
+		var batch domain.CouponBatch
+		err := tx.QueryRow(`SELECT b.id, b.max_uses, b.per_user_limit FROM coupons c JOIN coupon_batches b ON b.id = c.batch_id
+			WHERE c.code = ?`, r.Code).Scan(&batch.ID, &batch.MaxUses, &batch.PerUserLimit)
+		if errors.Is(err, sql.ErrNoRows) {
+			return domain.ErrCouponNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if batch.PerUserLimit > 0 {
+			var used int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM coupon_redemptions WHERE batch_id = ? AND user_id = ?`, batch.ID, r.UserID).
+				Scan(&used); err != nil {
+				return err
+			}
+			if used >= batch.PerUserLimit {
+				return domain.ErrCouponUserLimit
+			}
+		}
+
+		// the use is only counted while there is one left, concurrent redeemers cannot both take the last one
+		res, err := tx.Exec(`UPDATE coupons SET used = used + 1 WHERE code = ? AND used < ?`, r.Code, batch.MaxUses)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return domain.ErrCouponUsedUp
+		}
+
+		res, err = tx.Exec(`INSERT INTO coupon_redemptions (batch_id, code, user_id, entry_id, discount, bonus_point, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			batch.ID, r.Code, r.UserID, r.EntryID, r.Discount, r.BonusPoint, r.CreatedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+func (c *couponRepository) ListRedemptions(batchID int) ([]domain.CouponRedemption, error) {
+	rows, err := c.db.Query(`SELECT id, batch_id, code, user_id, entry_id, discount, bonus_point, created_at
+		FROM coupon_redemptions WHERE batch_id = ? ORDER BY id`, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.CouponRedemption, 0)
+	for rows.Next() {
+		var r domain.CouponRedemption
+		var createdAt int64
+		if err := rows.Scan(&r.ID, &r.BatchID, &r.Code, &r.UserID, &r.EntryID, &r.Discount, &r.BonusPoint, &createdAt); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = time.Unix(0, createdAt)
+		rtn = append(rtn, r)
+	}
+	return rtn, rows.Err()
+}
@@ -0,0 +1,236 @@
+// Package sqlite provides durable implementations of the domain repositories backed by an embedded SQLite file.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, a migration must never be edited once released, add a new one instead.
+var migrations = []string{
+	`CREATE TABLE users (
+		id                         INTEGER PRIMARY KEY AUTOINCREMENT,
+		name                       TEXT    NOT NULL,
+		level                      INTEGER NOT NULL DEFAULT 0,
+		buy_token_default_discount INTEGER NOT NULL DEFAULT 100,
+		token                      INTEGER NOT NULL DEFAULT 0 CHECK (token >= 0),
+		point                      INTEGER NOT NULL DEFAULT 0 CHECK (point >= 0)
+	);
+	CREATE TABLE products (
+		id    INTEGER PRIMARY KEY AUTOINCREMENT,
+		name  TEXT    NOT NULL,
+		price INTEGER NOT NULL
+	);
+	CREATE TABLE buy_token_activities (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_date   INTEGER NOT NULL,
+		end_date     INTEGER NOT NULL,
+		member_level INTEGER NOT NULL,
+		discount     INTEGER NOT NULL
+	);
+	CREATE TABLE buy_product_activities (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_date     INTEGER NOT NULL,
+		end_date       INTEGER NOT NULL,
+		point_discount INTEGER NOT NULL
+	);
+	CREATE TABLE journal_entries (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		type        TEXT    NOT NULL,
+		user_id     INTEGER NOT NULL,
+		product_id  INTEGER NOT NULL DEFAULT 0,
+		activity_id INTEGER NOT NULL DEFAULT 0,
+		charged     INTEGER NOT NULL DEFAULT 0,
+		refund_of   INTEGER NOT NULL DEFAULT 0,
+		percent     INTEGER NOT NULL DEFAULT 0,
+		memo        TEXT    NOT NULL DEFAULT '',
+		created_at  INTEGER NOT NULL
+	);
+	CREATE INDEX journal_entries_user_id ON journal_entries (user_id, id);
+	CREATE INDEX journal_entries_refund_of ON journal_entries (refund_of);
+	CREATE TABLE postings (
+		entry_id INTEGER NOT NULL REFERENCES journal_entries (id),
+		account  TEXT    NOT NULL,
+		unit     INTEGER NOT NULL,
+		debit    INTEGER NOT NULL,
+		credit   INTEGER NOT NULL
+	);
+	CREATE INDEX postings_entry_id ON postings (entry_id);
+	CREATE INDEX postings_account ON postings (account, unit);`,
+	`ALTER TABLE buy_token_activities ADD COLUMN stackable INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN exclusion_group TEXT NOT NULL DEFAULT '';
+	ALTER TABLE buy_token_activities ADD COLUMN exclusive INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE journal_entries ADD COLUMN activity_ids TEXT NOT NULL DEFAULT '';`,
+	`CREATE TABLE coupon_batches (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		name           TEXT    NOT NULL,
+		kind           INTEGER NOT NULL,
+		value          INTEGER NOT NULL,
+		start_date     INTEGER NOT NULL,
+		end_date       INTEGER NOT NULL,
+		max_uses       INTEGER NOT NULL,
+		per_user_limit INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE coupons (
+		code     TEXT    PRIMARY KEY,
+		batch_id INTEGER NOT NULL REFERENCES coupon_batches (id),
+		used     INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX coupons_batch_id ON coupons (batch_id);
+	CREATE TABLE coupon_redemptions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		batch_id    INTEGER NOT NULL REFERENCES coupon_batches (id),
+		code        TEXT    NOT NULL REFERENCES coupons (code),
+		user_id     INTEGER NOT NULL,
+		entry_id    INTEGER NOT NULL,
+		discount    INTEGER NOT NULL,
+		bonus_point INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL
+	);
+	CREATE INDEX coupon_redemptions_batch_user ON coupon_redemptions (batch_id, user_id);
+	ALTER TABLE journal_entries ADD COLUMN coupon TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE buy_token_activities ADD COLUMN max_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN max_redemptions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN used_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN used_redemptions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN max_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN max_redemptions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN used_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN used_redemptions INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE buy_token_activities ADD COLUMN user_max_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_token_activities ADD COLUMN user_max_redemptions INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN user_max_discount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN user_max_redemptions INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE activity_usage (
+		kind        TEXT    NOT NULL,
+		activity_id INTEGER NOT NULL,
+		user_id     INTEGER NOT NULL,
+		discount    INTEGER NOT NULL,
+		redemptions INTEGER NOT NULL,
+		PRIMARY KEY (kind, activity_id, user_id)
+	);`,
+	`CREATE TABLE volume_tiers (
+		member_level INTEGER NOT NULL,
+		min_token    INTEGER NOT NULL,
+		discount     INTEGER NOT NULL,
+		PRIMARY KEY (member_level, min_token)
+	);`,
+	`ALTER TABLE users ADD COLUMN bonus_token INTEGER NOT NULL DEFAULT 0 CHECK (bonus_token >= 0);
+	CREATE TABLE bonus_activities (
+		id                   INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_date           INTEGER NOT NULL,
+		end_date             INTEGER NOT NULL,
+		threshold            INTEGER NOT NULL,
+		bonus_token          INTEGER NOT NULL,
+		bonus_point          INTEGER NOT NULL,
+		max_bonus_token      INTEGER NOT NULL DEFAULT 0,
+		max_bonus_point      INTEGER NOT NULL DEFAULT 0,
+		max_discount         INTEGER NOT NULL DEFAULT 0,
+		max_redemptions      INTEGER NOT NULL DEFAULT 0,
+		used_discount        INTEGER NOT NULL DEFAULT 0,
+		used_redemptions     INTEGER NOT NULL DEFAULT 0,
+		user_max_discount    INTEGER NOT NULL DEFAULT 0,
+		user_max_redemptions INTEGER NOT NULL DEFAULT 0
+	);
+	ALTER TABLE journal_entries ADD COLUMN bonus_activity_ids TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE products ADD COLUMN category TEXT NOT NULL DEFAULT '';
+	ALTER TABLE buy_product_activities ADD COLUMN scope_product_ids TEXT NOT NULL DEFAULT '';
+	ALTER TABLE buy_product_activities ADD COLUMN scope_categories TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE buy_product_activities ADD COLUMN scope_min_price INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE buy_product_activities ADD COLUMN scope_max_price INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE buy_token_activities ADD COLUMN schedule TEXT NOT NULL DEFAULT '';
+	ALTER TABLE buy_product_activities ADD COLUMN schedule TEXT NOT NULL DEFAULT '';
+	ALTER TABLE bonus_activities ADD COLUMN schedule TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE buy_token_activities ADD COLUMN state TEXT NOT NULL DEFAULT 'running';
+	ALTER TABLE buy_product_activities ADD COLUMN state TEXT NOT NULL DEFAULT 'running';
+	ALTER TABLE bonus_activities ADD COLUMN state TEXT NOT NULL DEFAULT 'running';
+	CREATE TABLE activity_changes (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind        TEXT    NOT NULL,
+		activity_id INTEGER NOT NULL,
+		action      TEXT    NOT NULL,
+		detail      TEXT    NOT NULL,
+		reason      TEXT    NOT NULL,
+		created_at  INTEGER NOT NULL
+	);
+	CREATE INDEX activity_changes_activity ON activity_changes (kind, activity_id);`,
+	`CREATE TABLE member_tiers (
+		level                  INTEGER PRIMARY KEY,
+		name                   TEXT    NOT NULL,
+		rank                   INTEGER NOT NULL DEFAULT 0,
+		buy_token_discount     INTEGER NOT NULL CHECK (buy_token_discount BETWEEN 1 AND 100),
+		point_multiplier       INTEGER NOT NULL DEFAULT 100,
+		max_token_per_purchase INTEGER NOT NULL DEFAULT 0,
+		max_product_price      INTEGER NOT NULL DEFAULT 0,
+		perks                  TEXT    NOT NULL DEFAULT '[]'
+	);
+	INSERT INTO member_tiers (level, name, rank, buy_token_discount) VALUES
+		(0, 'Normal', 0, 100), (1, 'VIP1', 1, 95), (2, 'VIP2', 2, 90), (3, 'VIP3', 3, 85);`,
+	`ALTER TABLE member_tiers ADD COLUMN upgrade_spend INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE member_tiers ADD COLUMN retain_spend INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN grace_until INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE member_tiers ADD COLUMN subscription_fee INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE member_tiers ADD COLUMN subscription_days INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE subscriptions (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER NOT NULL REFERENCES users (id),
+		level        INTEGER NOT NULL,
+		earned_level INTEGER NOT NULL,
+		fee          INTEGER NOT NULL,
+		start_date   INTEGER NOT NULL,
+		end_date     INTEGER NOT NULL,
+		auto_renew   INTEGER NOT NULL,
+		state        TEXT    NOT NULL
+	);
+	CREATE UNIQUE INDEX subscriptions_active_user ON subscriptions (user_id) WHERE state = 'active';`,
+	`ALTER TABLE products ADD COLUMN track_stock INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE products ADD COLUMN stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0);
+	ALTER TABLE products ADD COLUMN low_stock_threshold INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE subscriptions ADD COLUMN earned_grace_until INTEGER NOT NULL DEFAULT 0;`,
+}
+
+// Open opens (or creates) the database file at path and brings its schema up to date.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, sharing one connection avoids SQLITE_BUSY between our own goroutines.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ledgerRepository struct {
+	db dbtx
+}
+
+func NewLedgerRepository(db *sql.DB) domain.LedgerRepository {
+	return &ledgerRepository{db: db}
+}
+
+func (l *ledgerRepository) Post(entry domain.JournalEntry) (int, error) {
+	if err := entry.Validate(); err != nil {
+		return -1, err
+	}
+	var id int64
+	err := inTx(l.db, func(tx dbtx) error {
+		res, err := tx.Exec(`INSERT INTO journal_entries (type, user_id, product_id, activity_id, activity_ids, coupon, bonus_activity_ids, charged, refund_of, percent, memo, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			string(entry.Type), entry.UserID, entry.ProductID, entry.ActivityID, joinIDs(entry.ActivityIDs), entry.Coupon, joinIDs(entry.BonusActivityIDs), entry.Charged, entry.RefundOf, entry.Percent, entry.Memo, entry.CreatedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		for _, p := range entry.Postings {
+			if _, err := tx.Exec(`INSERT INTO postings (entry_id, account, unit, debit, credit) VALUES (?, ?, ?, ?, ?)`,
+				id, p.Account, int(p.Unit), p.Debit, p.Credit); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+const entryColumns = `id, type, user_id, product_id, activity_id, activity_ids, coupon, bonus_activity_ids, charged, refund_of, percent, memo, created_at`
+
+func (l *ledgerRepository) GetEntry(id int) (domain.JournalEntry, error) {
+	entries, err := l.query(`SELECT `+entryColumns+` FROM journal_entries WHERE id = ?`, id)
+	if err != nil {
+		return domain.JournalEntry{}, err
+	}
+	if len(entries) == 0 {
+		return domain.JournalEntry{}, errors.New("journal entry not found")
+	}
+	return entries[0], nil
+}
+
+func (l *ledgerRepository) ListEntries(userID int, filter domain.TransactionFilter) ([]domain.JournalEntry, error) {
+	where := []string{`user_id = ?`, `id > ?`}
+	args := []interface{}{userID, filter.Cursor}
+	if !filter.StartTime.IsZero() {
+		where = append(where, `created_at >= ?`)
+		args = append(args, filter.StartTime.UnixNano())
+	}
+	if !filter.EndTime.IsZero() {
+		where = append(where, `created_at < ?`)
+		args = append(args, filter.EndTime.UnixNano())
+	}
+	if len(filter.Types) > 0 {
+		where = append(where, `type IN (?`+strings.Repeat(`, ?`, len(filter.Types)-1)+`)`)
+		for _, t := range filter.Types {
+			args = append(args, string(t))
+		}
+	}
+	query := `SELECT ` + entryColumns + ` FROM journal_entries WHERE ` + strings.Join(where, ` AND `) + ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+	return l.query(query, args...)
+}
+
+func (l *ledgerRepository) ListRefunds(purchaseID int) ([]domain.JournalEntry, error) {
+	return l.query(`SELECT `+entryColumns+` FROM journal_entries WHERE type = ? AND refund_of = ? ORDER BY id`,
+		string(domain.TransactionRefund), purchaseID)
+}
+
+func (l *ledgerRepository) GetBalance(account string, unit domain.Unit) (int64, error) {
+	var balance int64
+	err := l.db.QueryRow(`SELECT COALESCE(SUM(credit - debit), 0) FROM postings WHERE account = ? AND unit = ?`, account, int(unit)).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// GetUserSpend adds up domain.JournalEntry.Spend in SQL.
+func (l *ledgerRepository) GetUserSpend(userID int, since time.Time) (int64, error) {
+	var spend int64
+	err := l.db.QueryRow(`SELECT
+			COALESCE((SELECT SUM(charged) FROM journal_entries WHERE user_id = ? AND created_at >= ? AND type = ?), 0) +
+			COALESCE((SELECT SUM(p.debit - p.credit) FROM postings p JOIN journal_entries e ON e.id = p.entry_id
+				WHERE e.user_id = ? AND e.created_at >= ? AND e.type IN (?, ?) AND p.account = ? AND p.unit = ?), 0)`,
+		userID, encodeTime(since), string(domain.TransactionBuyToken),
+		userID, encodeTime(since), string(domain.TransactionBuyProduct), string(domain.TransactionRefund),
+		domain.UserAccount(userID), int(domain.UnitToken)).Scan(&spend)
+	return spend, err
+}
+
+// query loads the matching entries together with their postings.
+func (l *ledgerRepository) query(query string, args ...interface{}) ([]domain.JournalEntry, error) {
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]domain.JournalEntry, 0)
+	index := make(map[int]int)
+	for rows.Next() {
+		var e domain.JournalEntry
+		var entryType, activityIDs, bonusActivityIDs string
+		var createdAt int64
+		if err := rows.Scan(&e.ID, &entryType, &e.UserID, &e.ProductID, &e.ActivityID, &activityIDs, &e.Coupon, &bonusActivityIDs, &e.Charged, &e.RefundOf, &e.Percent, &e.Memo, &createdAt); err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		e.Type = domain.TransactionType(entryType)
+		e.CreatedAt = time.Unix(0, createdAt)
+		e.ActivityIDs = splitIDs(activityIDs)
+		e.BonusActivityIDs = splitIDs(bonusActivityIDs)
+		index[e.ID] = len(rtn)
+		rtn = append(rtn, e)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(rtn) == 0 {
+		return rtn, nil
+	}
+
+	// the single connection is free again, load the postings a batch of entries at a time
+	// so the query stays under SQLite's limit on bound parameters
+	for start := 0; start < len(rtn); start += postingsBatch {
+		end := start + postingsBatch
+		if end > len(rtn) {
+			end = len(rtn)
+		}
+		if err := l.loadPostings(rtn[start:end], index, rtn); err != nil {
+			return nil, err
+		}
+	}
+	return rtn, nil
+}
+
+// postingsBatch is how many entries' postings are loaded by one query.
+const postingsBatch = 500
+
+func (l *ledgerRepository) loadPostings(batch []domain.JournalEntry, index map[int]int, entries []domain.JournalEntry) error {
+	ids := make([]interface{}, 0, len(batch))
+	for _, e := range batch {
+		ids = append(ids, e.ID)
+	}
+	prows, err := l.db.Query(`SELECT entry_id, account, unit, debit, credit FROM postings WHERE entry_id IN (?`+
+		strings.Repeat(`, ?`, len(ids)-1)+`) ORDER BY rowid`, ids...)
+	if err != nil {
+		return err
+	}
+	defer prows.Close()
+	for prows.Next() {
+		var entryID, unit int
+		var p domain.Posting
+		if err := prows.Scan(&entryID, &p.Account, &unit, &p.Debit, &p.Credit); err != nil {
+			return err
+		}
+		p.Unit = domain.Unit(unit)
+		e := &entries[index[entryID]]
+		e.Postings = append(e.Postings, p)
+	}
+	return prows.Err()
+}
+
+// joinIDs stores a list of ids as a comma separated column.
+func joinIDs(ids []int) string {
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(s string) []int {
+	if s == "" {
+		return nil
+	}
+	rtn := make([]int, 0)
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			continue
+		}
+		rtn = append(rtn, id)
+	}
+	return rtn
+}
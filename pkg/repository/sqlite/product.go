@@ -0,0 +1,92 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"oa-bitgin/pkg/domain"
+)
+
+type productRepository struct {
+	db dbtx
+}
+
+func NewProductRepository(db *sql.DB) domain.ProductRepository {
+	return &productRepository{db: db}
+}
+
+func (p *productRepository) AddProduct(product domain.Product) (int, error) {
+	res, err := p.db.Exec(`INSERT INTO products (name, price, category, track_stock, stock, low_stock_threshold) VALUES (?, ?, ?, ?, ?, ?)`,
+		product.Name, product.Price, product.Category, product.TrackStock, product.Stock, product.LowStockThreshold)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+const productColumns = `id, name, price, category, track_stock, stock, low_stock_threshold`
+
+func scanProduct(row interface{ Scan(dest ...any) error }) (domain.Product, error) {
+	var product domain.Product
+	err := row.Scan(&product.ID, &product.Name, &product.Price, &product.Category, &product.TrackStock, &product.Stock, &product.LowStockThreshold)
+	return product, err
+}
+
+func (p *productRepository) GetProduct(id int) (domain.Product, error) {
+	product, err := scanProduct(p.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Product{}, errors.New("product not found")
+	}
+	return product, err
+}
+
+func (p *productRepository) ListProducts() ([]domain.Product, error) {
+	rows, err := p.db.Query(`SELECT ` + productColumns + ` FROM products ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.Product, 0)
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, product)
+	}
+	return rtn, rows.Err()
+}
+
+func (p *productRepository) SetStock(id int, stock int, lowStockThreshold int) error {
+	res, err := p.db.Exec(`UPDATE products SET track_stock = 1, stock = ?, low_stock_threshold = ? WHERE id = ?`, stock, lowStockThreshold, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("product not found")
+	}
+	return nil
+}
+
+func (p *productRepository) AdjustStock(id int, delta int) (domain.Product, error) {
+	product, err := scanProduct(p.db.QueryRow(`UPDATE products SET stock = stock + ?1 WHERE id = ?2 AND track_stock AND stock + ?1 >= 0
+		RETURNING `+productColumns, delta, id))
+	if err == nil {
+		return product, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return product, err
+	}
+
+	// nothing updated, find out why
+	if product, err = p.GetProduct(id); err != nil {
+		return product, err
+	}
+	if !product.TrackStock {
+		return product, nil
+	}
+	return product, domain.ErrOutOfStock
+}
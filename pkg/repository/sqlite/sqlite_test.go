@@ -0,0 +1,616 @@
+package sqlite
+
+import (
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"oa-bitgin/pkg/repository"
+	"oa-bitgin/pkg/usecase"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCashier(t *testing.T, path string) (domain.CashierUsecase, func()) {
+	db, err := Open(path)
+	require.NoError(t, err)
+	c, err := usecase.NewCashierUsecaseWithUnitOfWork(NewUnitOfWork(db))
+	require.NoError(t, err)
+	return c, func() { require.NoError(t, db.Close()) }
+}
+
+func TestSQLite_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_, _ = c.NewBuyTokenActivity(1, time.Now(), time.Now().Add(time.Hour*24*30), 80)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 80)
+	got, err := c.BuyTokenWithActivity(1, 10000)
+	require.NoError(t, err)
+	require.Equal(t, 8000, got)
+	require.NoError(t, c.AddPoint(1, 1000))
+	got, err = c.BuyProductWithActivity(1, 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, 720, got)
+	_, err = c.BuyProduct(2, 1)
+	require.ErrorIs(t, err, domain.ErrNotEnoughToken)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	token, err := c.GetUserToken(1)
+	require.NoError(t, err)
+	require.Equal(t, 9280, token)
+	point, err := c.GetUserPoint(1)
+	require.NoError(t, err)
+	require.Equal(t, 800, point)
+	require.Equal(t, int64(8000), c.GetTotalAmount())
+	require.NoError(t, c.ReconcileUser(1))
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 1)
+	require.Equal(t, int64(-720), page.Transactions[0].Token)
+	require.Equal(t, int64(-200), page.Transactions[0].Point)
+
+	refund, err := c.RefundPurchase(page.Transactions[0].ID, 100, "testReason")
+	require.NoError(t, err)
+	require.Equal(t, int64(720), refund.Token)
+	_, err = c.RefundPurchase(page.Transactions[0].ID, 100, "testReason")
+	require.ErrorIs(t, err, domain.ErrPurchaseRefunded)
+	require.NoError(t, c.ReconcileUser(1))
+	require.Equal(t, int64(8000), c.GetTotalAmount()) // refunds give back tokens, not money
+
+	// the amount received is picked up after a restart
+	restarted, closeRestarted := newCashier(t, path)
+	require.Equal(t, int64(8000), restarted.GetTotalAmount())
+	closeRestarted()
+
+	// new users keep counting from the stored ids
+	id, err := c.NewUser("testUser3", 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, id)
+}
+
+func TestSQLite_NewCashierUsecase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+	db, err := Open(path)
+	require.NoError(t, err)
+	c := usecase.NewCashierUsecase(NewUserRepository(db), NewActivityRepository(db), NewProductRepository(db))
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewProduct("testProduct1", 1000)
+	charged, err := c.BuyToken(1, 10000)
+	require.NoError(t, err)
+	_, err = c.BuyProduct(1, 1)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	c, closeDB := newCashier(t, path)
+	defer closeDB()
+	token, err := c.GetUserToken(1)
+	require.NoError(t, err)
+	require.Equal(t, 9000, token)
+	require.Equal(t, int64(charged), c.GetTotalAmount())
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func TestSQLite_UnitOfWorkRollback(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cashier.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	uow := NewUnitOfWork(db)
+	userID, err := uow.Users().NewUser(domain.User{Name: "testUser"})
+	require.NoError(t, err)
+
+	entry := domain.JournalEntry{Type: domain.TransactionBuyToken, UserID: userID, CreatedAt: time.Now()}
+	entry.Credit(domain.UserAccount(userID), domain.UnitToken, 100)
+	entry.Debit(domain.AccountCashierRevenue, domain.UnitToken, 100)
+
+	err = uow.Do(func(repos domain.Repositories) error {
+		_, err := repos.Users().AdjustBalance(userID, 100, 10)
+		require.NoError(t, err)
+		_, err = repos.Ledger().Post(entry)
+		require.NoError(t, err)
+		_, err = repos.Users().AdjustBalance(userID, 0, -20)
+		return err
+	})
+	require.ErrorIs(t, err, domain.ErrNotEnoughPoint)
+
+	user, err := uow.Users().GetUser(userID)
+	require.NoError(t, err)
+	require.Equal(t, domain.Balance{}, user.Account.Load())
+	balance, err := uow.Ledger().GetBalance(domain.UserAccount(userID), domain.UnitToken)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), balance)
+}
+
+func TestSQLite_Coupon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	batchID, codes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponPointBonus, Value: 50,
+		StartDate: time.Now().Add(-time.Hour), EndDate: time.Now().Add(time.Hour)}, 2)
+	require.NoError(t, err)
+	require.Len(t, codes, 2)
+	_, err = c.BuyTokenWithActivity(1, 100, codes[0])
+	require.NoError(t, err)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	_, err = c.BuyTokenWithActivity(1, 100, codes[0])
+	require.ErrorIs(t, err, domain.ErrCouponUsedUp)
+	point, err := c.GetUserPoint(1)
+	require.NoError(t, err)
+	require.Equal(t, 50, point)
+	require.NoError(t, c.ReconcileUser(1))
+
+	report, err := c.GetCouponReport(batchID)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Issued)
+	require.Equal(t, 1, report.Redeemed)
+	require.Equal(t, int64(50), report.TotalBonusPoint)
+}
+
+func TestSQLite_ActivityBudget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	activityID, _ := c.NewBuyTokenActivity(0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 90)
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyToken, activityID, domain.Budget{MaxDiscount: 150, MaxRedemptions: 5}))
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 900, got)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	got, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+	status, err := c.GetActivityBudget(domain.ActivityBuyToken, activityID)
+	require.NoError(t, err)
+	require.Equal(t, domain.BudgetUsage{Discount: 100, Redemptions: 1}, status.Used)
+	require.Equal(t, int64(50), status.RemainingDiscount)
+	require.Equal(t, 4, status.RemainingRedemptions)
+}
+
+func TestSQLite_ActivityUserLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	activityID, _ := c.NewBuyTokenActivity(0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 90)
+	require.NoError(t, c.SetActivityUserLimit(domain.ActivityBuyToken, activityID, domain.Budget{MaxRedemptions: 1}))
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 900, got)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	got, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+	got, err = c.BuyTokenWithActivity(2, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 900, got)
+	usage, err := c.GetActivityUserUsage(domain.ActivityBuyToken, activityID, 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.BudgetUsage{Discount: 100, Redemptions: 1}, usage.Used)
+	require.Equal(t, 0, usage.RemainingRedemptions)
+}
+
+func TestSQLite_VolumeTiers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	require.NoError(t, c.SetVolumeTiers(1, []domain.VolumeTier{{MinToken: 10000, Discount: 93}, {MinToken: 1000, Discount: 97}}))
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	got, err := c.BuyToken(1, 10000)
+	require.NoError(t, err)
+	require.Equal(t, 8835, got)
+	require.NoError(t, c.SetVolumeTiers(1, nil))
+	got, err = c.BuyToken(1, 10000)
+	require.NoError(t, err)
+	require.Equal(t, 9500, got)
+}
+
+func TestSQLite_BonusActivity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewProduct("testProduct1", 300)
+	bonusID, err := c.NewBonusActivity(time.Now().Add(-time.Hour), time.Now().Add(time.Hour),
+		domain.BonusActivity{Threshold: 1000, BonusToken: 100})
+	require.NoError(t, err)
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBonus, bonusID, domain.Budget{MaxDiscount: 150}))
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	bonus, err := c.GetUserBonusToken(1)
+	require.NoError(t, err)
+	require.Equal(t, 100, bonus)
+	_, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	bonus, _ = c.GetUserBonusToken(1)
+	require.Equal(t, 100, bonus)
+	status, err := c.GetActivityBudget(domain.ActivityBonus, bonusID)
+	require.NoError(t, err)
+	require.Equal(t, int64(50), status.RemainingDiscount)
+
+	_, err = c.BuyProduct(1, 1)
+	require.NoError(t, err)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 1800, token)
+	bonus, _ = c.GetUserBonusToken(1)
+	require.Equal(t, 0, bonus)
+	require.NoError(t, c.ReconcileUser(1))
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyToken}})
+	require.NoError(t, err)
+	require.Equal(t, []int{bonusID}, page.Transactions[0].BonusActivityIDs)
+	require.Equal(t, int64(100), page.Transactions[0].BonusToken)
+}
+
+func TestSQLite_ScopedBuyProductActivity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 10000)
+	_ = c.AddPoint(1, 1000)
+	bookID, _ := c.NewCategorizedProduct("testBook", 1000, "book")
+	gameID, _ := c.NewCategorizedProduct("testGame", 1000, "game")
+	activityID, err := c.NewScopedBuyProductActivity(time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 80,
+		domain.ProductScope{ProductIDs: []int{gameID}, Categories: []string{"book"}, MinPrice: 500})
+	require.NoError(t, err)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	got, err := c.BuyProductWithActivity(1, bookID, activityID)
+	require.NoError(t, err)
+	require.Equal(t, 800, got)
+	got, err = c.BuyProductWithActivity(1, gameID, activityID)
+	require.NoError(t, err)
+	require.Equal(t, 800, got)
+	otherID, _ := c.NewCategorizedProduct("testMusic", 1000, "music")
+	_, err = c.BuyProductWithActivity(1, otherID, activityID)
+	require.ErrorIs(t, err, domain.ErrActivityNotApplicable)
+}
+
+func TestSQLite_ActivitySchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	now := time.Now().UTC()
+	activityID, _ := c.NewBuyTokenActivity(0, now.Add(-time.Hour*24), now.Add(time.Hour*24*30), 90)
+	schedule := &domain.Schedule{Frequency: domain.FrequencyWeekly, Weekdays: []time.Weekday{(now.Weekday() + 1) % 7},
+		StartTime: 18 * time.Hour, Duration: 5 * time.Hour, TimeZone: "Asia/Taipei"}
+	require.NoError(t, c.SetActivitySchedule(domain.ActivityBuyToken, activityID, schedule))
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	occurrences, err := c.ListActivityOccurrences(domain.ActivityBuyToken, activityID, now, 2)
+	require.NoError(t, err)
+	require.Len(t, occurrences, 2)
+	require.Equal(t, 7*24*time.Hour, occurrences[1].Start.Sub(occurrences[0].Start))
+	require.Equal(t, 18, occurrences[0].Start.Hour())
+	require.Equal(t, "Asia/Taipei", occurrences[0].Start.Location().String())
+	require.Error(t, c.SetActivitySchedule(domain.ActivityBuyToken, 99, schedule))
+}
+
+func TestSQLite_ActivityLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	now := time.Now()
+	tokenID, _ := c.NewBuyTokenActivity(0, now.Add(-time.Hour), now.Add(time.Hour), 80)
+	productID, _ := c.NewBuyProductActivity(now.Add(-time.Hour), now.Add(time.Hour), 80)
+	require.NoError(t, c.UpdateActivityDiscount(domain.ActivityBuyToken, tokenID, 60))
+	require.NoError(t, c.UpdateActivityDiscount(domain.ActivityBuyProduct, productID, 50))
+	require.NoError(t, c.PauseActivity(domain.ActivityBuyToken, tokenID))
+	require.NoError(t, c.DeleteActivity(domain.ActivityBuyProduct, productID, "testReason"))
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+	require.NoError(t, c.ResumeActivity(domain.ActivityBuyToken, tokenID))
+	got, _ = c.BuyTokenWithActivity(1, 1000)
+	require.Equal(t, 600, got)
+
+	products, err := c.ListBuyProductActivities(domain.ActivityFilter{})
+	require.NoError(t, err)
+	require.Empty(t, products)
+	products, _ = c.ListBuyProductActivities(domain.ActivityFilter{States: []domain.ActivityState{domain.ActivityDeleted}})
+	require.Len(t, products, 1)
+	require.Equal(t, 50, products[0].PointDiscount)
+
+	history, err := c.GetActivityHistory(domain.ActivityBuyToken, tokenID)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	require.Equal(t, domain.ActionResume, history[2].Action)
+}
+
+func TestSQLite_MemberTiers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 2) // id = 1, 90%
+	_, _ = c.NewUser("testUser2", 3) // id = 2, 85%
+	changed, err := c.SetMemberTier(domain.MemberTier{Level: 2, Name: "Gold", Rank: 2, BuyTokenDiscount: 75, PointMultiplier: 120,
+		SpendingLimit: domain.SpendingLimit{MaxTokenPerPurchase: 2000}, Perks: []string{"birthday gift", "priority support"}})
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	tier, err := c.GetMemberTier(2)
+	require.NoError(t, err)
+	require.Equal(t, domain.MemberTier{Level: 2, Name: "Gold", Rank: 2, BuyTokenDiscount: 75, PointMultiplier: 120,
+		SpendingLimit: domain.SpendingLimit{MaxTokenPerPurchase: 2000}, Perks: []string{"birthday gift", "priority support"}}, tier)
+	tiers, err := c.ListMemberTiers()
+	require.NoError(t, err)
+	require.Len(t, tiers, 4)
+	require.Equal(t, "VIP1", tiers[1].Name)
+
+	got, err := c.BuyToken(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 750, got)
+	got, _ = c.BuyToken(2, 1000)
+	require.Equal(t, 850, got)
+	_, err = c.BuyToken(1, 2001)
+	require.ErrorIs(t, err, domain.ErrSpendingLimit)
+}
+
+func TestSQLite_MemberUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, err := c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, UpgradeSpend: 1000})
+	require.NoError(t, err)
+	_, _ = c.BuyToken(1, 800)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	tier, _ := c.GetMemberTier(1)
+	require.Equal(t, int64(1000), tier.UpgradeSpend)
+	got, _ := c.BuyToken(1, 200)
+	require.Equal(t, 200, got)
+	spend, err := c.GetUserSpend(1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), spend)
+	got, _ = c.BuyToken(1, 1000)
+	require.Equal(t, 950, got)
+}
+
+func TestSQLite_ReassessMembers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, RetainSpend: 1000})
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewUser("testUser2", 1) // id = 2
+	_, _ = c.BuyToken(2, 2000)
+	report, err := c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1)
+	require.Equal(t, domain.ReassessGrace, report.Changes[0].Action)
+	closeDB()
+
+	// the grace period survives a restart
+	db, err := Open(path)
+	require.NoError(t, err)
+	defer db.Close()
+	users := NewUnitOfWork(db).Users()
+	user, err := users.GetUser(1)
+	require.NoError(t, err)
+	require.True(t, user.Member.GraceUntil.Equal(report.Changes[0].GraceUntil))
+	list, err := users.ListUsers()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.True(t, list[1].Member.GraceUntil.IsZero())
+
+	c, err = usecase.NewCashierUsecaseWithUnitOfWork(NewUnitOfWork(db), usecase.WithDowngradeGrace(0))
+	require.NoError(t, err)
+	report, err = c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Empty(t, report.Changes) // still in the grace period given before
+	require.NoError(t, users.SetMember(1, domain.Member{Level: 1, BuyTokenDefaultDiscount: 95, GraceUntil: time.Now().Add(-time.Second)}))
+	report, _ = c.ReassessMembers(false)
+	require.Len(t, report.Changes, 1)
+	require.Equal(t, domain.ReassessDowngrade, report.Changes[0].Action)
+	got, _ := c.BuyToken(1, 1000)
+	require.Equal(t, 1000, got)
+}
+
+func TestSQLite_Subscription(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, RetainSpend: 10000})
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, SubscriptionFee: 300, SubscriptionDays: 30})
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.BuyToken(1, 700)
+	sub, err := c.Subscribe(1, 2, true)
+	require.NoError(t, err)
+	_, err = c.Subscribe(1, 2, true)
+	require.ErrorIs(t, err, domain.ErrSubscriptionActive)
+	report, err := c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1) // the earned VIP1 enters the grace period
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	tier, _ := c.GetMemberTier(2)
+	require.Equal(t, 30, tier.SubscriptionDays)
+	got, err := c.GetSubscription(1)
+	require.NoError(t, err)
+	require.Equal(t, sub.ID, got.ID)
+	require.True(t, sub.EndDate.Equal(got.EndDate))
+	require.Equal(t, domain.SubscriptionActive, got.State)
+	require.Equal(t, 1, got.EarnedLevel)
+	require.True(t, got.EarnedGraceUntil.Equal(report.Changes[0].GraceUntil))
+	price, _ := c.BuyToken(1, 100)
+	require.Equal(t, 90, price)
+
+	renewed, _, err := c.RenewSubscriptions(sub.EndDate)
+	require.NoError(t, err)
+	require.Equal(t, 1, renewed)
+	_, expired, err := c.RenewSubscriptions(sub.EndDate.Add(30 * 24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, expired) // 200 tokens left, not enough for another period
+	price, _ = c.BuyToken(1, 100)
+	require.Equal(t, 95, price)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func TestSQLite_Inventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cashier.db")
+
+	c, closeDB := newCashier(t, path)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 1000)
+	productID, _ := c.NewProduct("testProduct1", 100)
+	require.NoError(t, c.SetProductStock(productID, 2, 1))
+	_, err := c.BuyProduct(1, productID)
+	require.NoError(t, err)
+	closeDB()
+
+	c, closeDB = newCashier(t, path)
+	defer closeDB()
+	product, err := c.GetProduct(productID)
+	require.NoError(t, err)
+	require.Equal(t, domain.Product{ID: productID, Name: "testProduct1", Price: 100, TrackStock: true, Stock: 1, LowStockThreshold: 1}, product)
+	low, _ := c.ListLowStockProducts()
+	require.Len(t, low, 1)
+
+	_, err = c.BuyProduct(1, productID)
+	require.NoError(t, err)
+	_, err = c.BuyProduct(1, productID)
+	require.ErrorIs(t, err, domain.ErrOutOfStock)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 800, token)
+
+	page, _ := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	_, err = c.RefundPurchase(page.Transactions[1].ID, 100, "testReason")
+	require.NoError(t, err)
+	got, err := c.Restock(productID, 5)
+	require.NoError(t, err)
+	require.Equal(t, 6, got)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func TestSQLite_LedgerManyEntries(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cashier.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	ledger := NewLedgerRepository(db)
+
+	// more entries than SQLite takes bound parameters in one query
+	const n = 1200
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		entry := domain.JournalEntry{Type: domain.TransactionBuyToken, UserID: 1, Charged: 9, CreatedAt: start.Add(time.Duration(i) * time.Millisecond)}
+		entry.Credit(domain.UserAccount(1), domain.UnitToken, 10)
+		entry.Debit(domain.AccountCashierRevenue, domain.UnitToken, 9)
+		entry.Debit(domain.AccountPromotionExpense, domain.UnitToken, 1)
+		_, err := ledger.Post(entry)
+		require.NoError(t, err)
+	}
+	purchase := domain.JournalEntry{Type: domain.TransactionBuyProduct, UserID: 1, CreatedAt: start.Add(n * time.Millisecond)}
+	purchase.Debit(domain.UserAccount(1), domain.UnitToken, 100)
+	purchase.Credit(domain.AccountCashierSales, domain.UnitToken, 100)
+	_, err = ledger.Post(purchase)
+	require.NoError(t, err)
+
+	entries, err := ledger.ListEntries(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, n+1)
+	for _, e := range entries {
+		require.NotEmpty(t, e.Postings)
+	}
+
+	spend, err := ledger.GetUserSpend(1, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, int64(n*9+100), spend)
+	spend, err = ledger.GetUserSpend(1, start.Add((n-10)*time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, int64(10*9+100), spend)
+	spend, err = ledger.GetUserSpend(2, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), spend)
+}
+
+func TestSQLite_GetBalanceError(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "cashier.db"))
+	require.NoError(t, err)
+	uow := NewUnitOfWork(db)
+	balance, err := uow.Ledger().GetBalance(domain.AccountCashierRevenue, domain.UnitToken)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), balance) // no postings yet
+
+	require.NoError(t, db.Close())
+	_, err = uow.Ledger().GetBalance(domain.AccountCashierRevenue, domain.UnitToken)
+	require.Error(t, err)
+	_, err = usecase.NewCashierUsecaseWithUnitOfWork(uow)
+	require.Error(t, err)
+}
+
+func TestSQLite_EventStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cashier.db")
+	open := func() (domain.CashierUsecase, func()) {
+		db, err := Open(path)
+		require.NoError(t, err)
+		store, err := repository.NewFileEventStore(filepath.Join(dir, "events"))
+		require.NoError(t, err)
+		c, err := usecase.NewCashierUsecaseWithUnitOfWork(NewUnitOfWork(db), usecase.WithEventStore(store, 2))
+		require.NoError(t, err)
+		return c, func() {
+			require.NoError(t, store.Close())
+			require.NoError(t, db.Close())
+		}
+	}
+
+	c, closeAll := open()
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.BuyToken(1, 1000)
+	closeAll()
+
+	c, closeAll = open()
+	defer closeAll()
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.BuyToken(2, 100)
+	state, err := c.GetStateAt(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, int64(4), state.Seq)
+	require.Equal(t, int64(1050), state.TotalAmount)
+	require.Equal(t, domain.UserState{Name: "testUser1", MemberLevel: 1, Token: 1000}, state.Users[1])
+	require.Equal(t, domain.UserState{Name: "testUser2", Token: 100}, state.Users[2])
+}
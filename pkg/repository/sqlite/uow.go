@@ -0,0 +1,82 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"oa-bitgin/pkg/domain"
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so repositories work the same inside and outside a transaction.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// inTx runs fn in a transaction of its own unless db already is one.
+func inTx(db dbtx, fn func(tx dbtx) error) error {
+	conn, ok := db.(*sql.DB)
+	if !ok {
+		return fn(db)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type repositories struct {
+	db dbtx
+}
+
+func (r *repositories) Users() domain.UserRepository {
+	return &userRepository{db: r.db}
+}
+
+func (r *repositories) Products() domain.ProductRepository {
+	return &productRepository{db: r.db}
+}
+
+func (r *repositories) Activities() domain.ActivityRepository {
+	return &activityRepository{db: r.db}
+}
+
+func (r *repositories) Ledger() domain.LedgerRepository {
+	return &ledgerRepository{db: r.db}
+}
+
+func (r *repositories) Coupons() domain.CouponRepository {
+	return &couponRepository{db: r.db}
+}
+
+type unitOfWork struct {
+	repositories
+	conn *sql.DB
+}
+
+// NewUnitOfWork runs usecase operations in SQLite transactions. Inside Do only the repositories passed to fn
+// may be used, the single database connection is held by the transaction.
+func NewUnitOfWork(db *sql.DB) domain.UnitOfWork {
+	return &unitOfWork{repositories: repositories{db: db}, conn: db}
+}
+
+func (w *unitOfWork) Do(fn func(repos domain.Repositories) error) error {
+	return inTx(w.conn, func(tx dbtx) error {
+		return fn(&repositories{db: tx})
+	})
+}
+
+// UnitOfWork groups the repositories of the database u works on, so usecase.NewCashierUsecase can take SQLite
+// repositories. A repository handed out inside Do is bound to its transaction and cannot start another.
+func (u *userRepository) UnitOfWork() (domain.UnitOfWork, error) {
+	conn, ok := u.db.(*sql.DB)
+	if !ok {
+		return nil, errors.New("sqlite: repository is bound to a transaction")
+	}
+	return NewUnitOfWork(conn), nil
+}
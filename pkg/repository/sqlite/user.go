@@ -0,0 +1,316 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+type userRepository struct {
+	db dbtx
+}
+
+func NewUserRepository(db *sql.DB) domain.UserRepository {
+	return &userRepository{db: db}
+}
+
+const userColumns = `id, name, level, buy_token_default_discount, grace_until, token, point, bonus_token`
+
+func scanUser(row interface{ Scan(dest ...any) error }) (*domain.User, error) {
+	user := &domain.User{}
+	var b domain.Balance
+	var graceUntil int64
+	if err := row.Scan(&user.ID, &user.Name, &user.Member.Level, &user.Member.BuyTokenDefaultDiscount, &graceUntil,
+		&b.Token, &b.Point, &b.BonusToken); err != nil {
+		return &domain.User{}, err
+	}
+	user.Member.GraceUntil = decodeTime(graceUntil)
+	_, _ = user.Account.ApplyBalance(b)
+	return user, nil
+}
+
+func (u *userRepository) GetUser(id int) (*domain.User, error) {
+	user, err := scanUser(u.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return &domain.User{}, errors.New("user not found")
+	}
+	return user, err
+}
+
+func (u *userRepository) ListUsers() ([]*domain.User, error) {
+	rows, err := u.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]*domain.User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, user)
+	}
+	return rtn, rows.Err()
+}
+
+// encodeTime stores the zero time as 0 instead of its far negative UnixNano.
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeTime(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (u *userRepository) NewUser(user domain.User) (int, error) {
+	res, err := u.db.Exec(`INSERT INTO users (name, level, buy_token_default_discount, grace_until) VALUES (?, ?, ?, ?)`,
+		user.Name, user.Member.Level, user.Member.BuyTokenDefaultDiscount, encodeTime(user.Member.GraceUntil))
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+func (u *userRepository) AdjustBalance(id int, token int, point int) (domain.Balance, error) {
+	var b domain.Balance
+	err := u.db.QueryRow(`UPDATE users SET token = token + ?1, point = point + ?2
+		WHERE id = ?3 AND token + ?1 >= 0 AND point + ?2 >= 0
+		RETURNING token, point, bonus_token`, token, point, id).Scan(&b.Token, &b.Point, &b.BonusToken)
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return b, err
+	}
+
+	// nothing updated, find out why
+	user, err := u.GetUser(id)
+	if err != nil {
+		return b, err
+	}
+	b = user.Account.Load()
+	if b.Point+point < 0 {
+		return b, domain.ErrNotEnoughPoint
+	}
+	return b, domain.ErrNotEnoughToken
+}
+
+func (u *userRepository) AdjustBonusToken(id int, bonusToken int) (domain.Balance, error) {
+	var b domain.Balance
+	err := u.db.QueryRow(`UPDATE users SET bonus_token = bonus_token + ?1 WHERE id = ?2 AND bonus_token + ?1 >= 0
+		RETURNING token, point, bonus_token`, bonusToken, id).Scan(&b.Token, &b.Point, &b.BonusToken)
+	if err == nil {
+		return b, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return b, err
+	}
+	user, err := u.GetUser(id)
+	if err != nil {
+		return b, err
+	}
+	return user.Account.Load(), domain.ErrNotEnoughToken
+}
+
+func (u *userRepository) SetVolumeTiers(level int, tiers []domain.VolumeTier) error {
+	return inTx(u.db, func(tx dbtx) error {
+		if _, err := tx.Exec(`DELETE FROM volume_tiers WHERE member_level = ?`, level); err != nil {
+			return err
+		}
+		for _, t := range tiers {
+			if _, err := tx.Exec(`INSERT INTO volume_tiers (member_level, min_token, discount) VALUES (?, ?, ?)`,
+				level, t.MinToken, t.Discount); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (u *userRepository) ListVolumeTiers(level int) ([]domain.VolumeTier, error) {
+	rows, err := u.db.Query(`SELECT member_level, min_token, discount FROM volume_tiers WHERE member_level = ? ORDER BY min_token`, level)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.VolumeTier, 0)
+	for rows.Next() {
+		var t domain.VolumeTier
+		if err := rows.Scan(&t.MemberLevel, &t.MinToken, &t.Discount); err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, t)
+	}
+	return rtn, rows.Err()
+}
+
+func (u *userRepository) GetDefaultBuyTokenDiscount(level int) int {
+	if tier, err := u.GetMemberTier(level); err == nil {
+		return tier.BuyTokenDiscount
+	}
+	return 100
+}
+
+func (u *userRepository) SetMemberTier(tier domain.MemberTier) error {
+	perks, err := json.Marshal(tier.Perks)
+	if err != nil {
+		return err
+	}
+	l := tier.SpendingLimit
+	_, err = u.db.Exec(`INSERT INTO member_tiers (level, name, rank, buy_token_discount, point_multiplier, max_token_per_purchase, max_product_price, perks, upgrade_spend,
+			retain_spend, subscription_fee, subscription_days)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (level) DO UPDATE SET name = excluded.name, rank = excluded.rank, buy_token_discount = excluded.buy_token_discount,
+			point_multiplier = excluded.point_multiplier, max_token_per_purchase = excluded.max_token_per_purchase,
+			max_product_price = excluded.max_product_price, perks = excluded.perks, upgrade_spend = excluded.upgrade_spend,
+			retain_spend = excluded.retain_spend, subscription_fee = excluded.subscription_fee, subscription_days = excluded.subscription_days`,
+		tier.Level, tier.Name, tier.Rank, tier.BuyTokenDiscount, tier.PointMultiplier, l.MaxTokenPerPurchase, l.MaxProductPrice, string(perks),
+		tier.UpgradeSpend, tier.RetainSpend, tier.SubscriptionFee, tier.SubscriptionDays)
+	return err
+}
+
+const memberTierColumns = `level, name, rank, buy_token_discount, point_multiplier, max_token_per_purchase, max_product_price, perks, upgrade_spend, retain_spend,
+	subscription_fee, subscription_days`
+
+func scanMemberTier(row interface{ Scan(dest ...any) error }) (domain.MemberTier, error) {
+	var t domain.MemberTier
+	var perks string
+	if err := row.Scan(&t.Level, &t.Name, &t.Rank, &t.BuyTokenDiscount, &t.PointMultiplier,
+		&t.SpendingLimit.MaxTokenPerPurchase, &t.SpendingLimit.MaxProductPrice, &perks, &t.UpgradeSpend, &t.RetainSpend,
+		&t.SubscriptionFee, &t.SubscriptionDays); err != nil {
+		return t, err
+	}
+	return t, json.Unmarshal([]byte(perks), &t.Perks)
+}
+
+func (u *userRepository) GetMemberTier(level int) (domain.MemberTier, error) {
+	t, err := scanMemberTier(u.db.QueryRow(`SELECT `+memberTierColumns+` FROM member_tiers WHERE level = ?`, level))
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, domain.ErrMemberTierNotFound
+	}
+	return t, err
+}
+
+func (u *userRepository) ListMemberTiers() ([]domain.MemberTier, error) {
+	rows, err := u.db.Query(`SELECT ` + memberTierColumns + ` FROM member_tiers ORDER BY rank, level`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.MemberTier, 0)
+	for rows.Next() {
+		t, err := scanMemberTier(rows)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, t)
+	}
+	return rtn, rows.Err()
+}
+
+func (u *userRepository) AddSubscription(sub domain.Subscription) (int, error) {
+	res, err := u.db.Exec(`INSERT INTO subscriptions (user_id, level, earned_level, earned_grace_until, fee, start_date, end_date, auto_renew, state)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sub.UserID, sub.Level, sub.EarnedLevel, encodeTime(sub.EarnedGraceUntil), sub.Fee, sub.StartDate.UnixNano(), sub.EndDate.UnixNano(),
+		sub.AutoRenew, string(sub.State))
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+const subscriptionColumns = `id, user_id, level, earned_level, earned_grace_until, fee, start_date, end_date, auto_renew, state`
+
+func scanSubscription(row interface{ Scan(dest ...any) error }) (domain.Subscription, error) {
+	var sub domain.Subscription
+	var graceUntil, start, end int64
+	var state string
+	if err := row.Scan(&sub.ID, &sub.UserID, &sub.Level, &sub.EarnedLevel, &graceUntil, &sub.Fee, &start, &end, &sub.AutoRenew, &state); err != nil {
+		return sub, err
+	}
+	sub.EarnedGraceUntil = decodeTime(graceUntil)
+	sub.StartDate, sub.EndDate, sub.State = time.Unix(0, start), time.Unix(0, end), domain.SubscriptionState(state)
+	return sub, nil
+}
+
+func (u *userRepository) GetActiveSubscription(userID int) (domain.Subscription, error) {
+	sub, err := scanSubscription(u.db.QueryRow(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE user_id = ? AND state = ?`,
+		userID, string(domain.SubscriptionActive)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return sub, domain.ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (u *userRepository) UpdateSubscription(sub domain.Subscription) error {
+	res, err := u.db.Exec(`UPDATE subscriptions SET level = ?, earned_level = ?, earned_grace_until = ?, fee = ?, start_date = ?, end_date = ?,
+		auto_renew = ?, state = ? WHERE id = ?`,
+		sub.Level, sub.EarnedLevel, encodeTime(sub.EarnedGraceUntil), sub.Fee, sub.StartDate.UnixNano(), sub.EndDate.UnixNano(),
+		sub.AutoRenew, string(sub.State), sub.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return domain.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (u *userRepository) ListDueSubscriptions(t time.Time) ([]domain.Subscription, error) {
+	rows, err := u.db.Query(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE state = ? AND end_date <= ? ORDER BY id`,
+		string(domain.SubscriptionActive), t.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rtn := make([]domain.Subscription, 0)
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, sub)
+	}
+	return rtn, rows.Err()
+}
+
+func (u *userRepository) SetMember(id int, member domain.Member) error {
+	res, err := u.db.Exec(`UPDATE users SET level = ?, buy_token_default_discount = ?, grace_until = ? WHERE id = ?`,
+		member.Level, member.BuyTokenDefaultDiscount, encodeTime(member.GraceUntil), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
+func (u *userRepository) SetMemberDiscount(level int, discount int) (int, error) {
+	res, err := u.db.Exec(`UPDATE users SET buy_token_default_discount = ? WHERE level = ? AND buy_token_default_discount != ?`,
+		discount, level, discount)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"sync"
+)
+
+// undoLog collects compensating actions of a unit of work, they run in reverse order on rollback.
+// A nil *undoLog records nothing, that is how repositories behave outside a unit of work.
+type undoLog struct {
+	actions []func()
+}
+
+func (l *undoLog) push(fn func()) {
+	if l != nil {
+		l.actions = append(l.actions, fn)
+	}
+}
+
+func (l *undoLog) rollback() {
+	for i := len(l.actions) - 1; i >= 0; i-- {
+		l.actions[i]()
+	}
+	l.actions = nil
+}
+
+type unitOfWork struct {
+	mu         sync.Mutex // units of work run one at a time so undo never races another writer
+	users      *userRepository
+	products   *productRepository
+	activities *activityRepository
+	ledger     *ledgerRepository
+	coupons    *couponRepository
+}
+
+// NewMemoryUnitOfWork returns a unit of work over new, empty in-memory repositories.
+func NewMemoryUnitOfWork() domain.UnitOfWork {
+	w, _ := NewUnitOfWork(NewUserRepository(), NewActivityRepository(), NewProductRepository(), NewLedgerRepository(), NewCouponRepository())
+	return w
+}
+
+// NewUnitOfWork groups in-memory repositories so usecase operations on them commit or roll back together,
+// it fails when any of them is not an in-memory repository of this package.
+func NewUnitOfWork(users domain.UserRepository, activities domain.ActivityRepository, products domain.ProductRepository, ledger domain.LedgerRepository,
+	coupons domain.CouponRepository) (domain.UnitOfWork, error) {
+	w := &unitOfWork{}
+	var ok [5]bool
+	w.users, ok[0] = users.(*userRepository)
+	w.activities, ok[1] = activities.(*activityRepository)
+	w.products, ok[2] = products.(*productRepository)
+	w.ledger, ok[3] = ledger.(*ledgerRepository)
+	w.coupons, ok[4] = coupons.(*couponRepository)
+	for _, v := range ok {
+		if !v {
+			return nil, fmt.Errorf("repository: NewUnitOfWork needs in-memory repositories, got %T %T %T %T %T", users, activities, products, ledger, coupons)
+		}
+	}
+	return w, nil
+}
+
+func (w *unitOfWork) Users() domain.UserRepository {
+	return w.users
+}
+
+func (w *unitOfWork) Products() domain.ProductRepository {
+	return w.products
+}
+
+func (w *unitOfWork) Activities() domain.ActivityRepository {
+	return w.activities
+}
+
+func (w *unitOfWork) Ledger() domain.LedgerRepository {
+	return w.ledger
+}
+
+func (w *unitOfWork) Coupons() domain.CouponRepository {
+	return w.coupons
+}
+
+func (w *unitOfWork) Do(fn func(repos domain.Repositories) error) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log := &undoLog{}
+	defer func() {
+		if r := recover(); r != nil {
+			log.rollback()
+			panic(r)
+		}
+		if err != nil {
+			log.rollback()
+		}
+	}()
+	return fn(&unitOfWork{
+		users:      &userRepository{store: w.users.store, undo: log},
+		products:   &productRepository{store: w.products.store, undo: log},
+		activities: &activityRepository{store: w.activities.store, undo: log},
+		ledger:     &ledgerRepository{store: w.ledger.store, undo: log},
+		coupons:    &couponRepository{store: w.coupons.store, undo: log},
+	})
+}
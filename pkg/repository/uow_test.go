@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"testing"
+)
+
+func Test_unitOfWork_Do(t *testing.T) {
+	uow := NewMemoryUnitOfWork()
+	userID, _ := uow.Users().NewUser(domain.User{Name: "testUser"})
+
+	entry := domain.JournalEntry{Type: domain.TransactionBuyToken, UserID: userID}
+	entry.Credit(domain.UserAccount(userID), domain.UnitToken, 100)
+	entry.Debit(domain.AccountCashierRevenue, domain.UnitToken, 100)
+
+	t.Run("Rollback", func(t *testing.T) {
+		err := uow.Do(func(repos domain.Repositories) error {
+			_, err := repos.Users().AdjustBalance(userID, 100, 10)
+			require.NoError(t, err)
+			_, err = repos.Ledger().Post(entry)
+			require.NoError(t, err)
+			_, err = repos.Products().AddProduct(domain.Product{Name: "testProduct", Price: 100})
+			require.NoError(t, err)
+			_, err = repos.Activities().AddBuyProductActivity(domain.BuyProductActivity{PointDiscount: 90})
+			require.NoError(t, err)
+			_, err = repos.Users().AdjustBalance(userID, -200, 0)
+			return err
+		})
+		require.ErrorIs(t, err, domain.ErrNotEnoughToken)
+
+		user, _ := uow.Users().GetUser(userID)
+		require.Equal(t, domain.Balance{}, user.Account.Load())
+		balance, err := uow.Ledger().GetBalance(domain.UserAccount(userID), domain.UnitToken)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), balance)
+		entries, _ := uow.Ledger().ListEntries(userID, domain.TransactionFilter{})
+		require.Len(t, entries, 0)
+		_, err = uow.Products().GetProduct(1)
+		require.Error(t, err)
+		_, err = uow.Activities().GetBuyProductActivity(1)
+		require.Error(t, err)
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		err := uow.Do(func(repos domain.Repositories) error {
+			if _, err := repos.Users().AdjustBalance(userID, 100, 0); err != nil {
+				return err
+			}
+			_, err := repos.Ledger().Post(entry)
+			return err
+		})
+		require.NoError(t, err)
+
+		user, _ := uow.Users().GetUser(userID)
+		require.Equal(t, 100, user.GetToken())
+		balance, err := uow.Ledger().GetBalance(domain.UserAccount(userID), domain.UnitToken)
+		require.NoError(t, err)
+		require.Equal(t, int64(100), balance)
+	})
+
+	t.Run("RollbackOnPanic", func(t *testing.T) {
+		require.Panics(t, func() {
+			_ = uow.Do(func(repos domain.Repositories) error {
+				_, _ = repos.Users().AdjustBalance(userID, 100, 0)
+				panic(errors.New("testPanic"))
+			})
+		})
+		user, _ := uow.Users().GetUser(userID)
+		require.Equal(t, 100, user.GetToken())
+	})
+
+	t.Run("RollbackKeepsOtherChanges", func(t *testing.T) {
+		productID, _ := uow.Products().AddProduct(domain.Product{Name: "testProduct", Price: 100})
+		err := uow.Do(func(repos domain.Repositories) error {
+			require.NoError(t, repos.Users().SetMember(userID, domain.Member{Level: 2, BuyTokenDefaultDiscount: 90}))
+			require.NoError(t, repos.Products().SetStock(productID, 10, 2))
+			// changes made outside the unit of work while it runs
+			_, err := uow.Users().AdjustBalance(userID, 50, 0)
+			require.NoError(t, err)
+			_, err = uow.Products().AdjustStock(productID, 5)
+			require.NoError(t, err)
+			return errors.New("testRollback")
+		})
+		require.Error(t, err)
+
+		// only what the unit of work changed is put back
+		user, _ := uow.Users().GetUser(userID)
+		require.Equal(t, domain.Member{}, user.Member)
+		require.Equal(t, 150, user.GetToken())
+		product, _ := uow.Products().GetProduct(productID)
+		require.False(t, product.TrackStock)
+		require.Equal(t, "testProduct", product.Name)
+	})
+}
+
+func TestNewUnitOfWork(t *testing.T) {
+	uow, err := NewUnitOfWork(NewUserRepository(), NewActivityRepository(), NewProductRepository(), NewLedgerRepository(), NewCouponRepository())
+	require.NoError(t, err)
+	require.NotNil(t, uow)
+
+	// a repository this package does not own cannot take part in its units of work
+	users := struct{ domain.UserRepository }{NewUserRepository()}
+	_, err = NewUnitOfWork(users, NewActivityRepository(), NewProductRepository(), NewLedgerRepository(), NewCouponRepository())
+	require.Error(t, err)
+}
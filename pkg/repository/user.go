@@ -3,53 +3,268 @@ package repository
 import (
 	"errors"
 	"oa-bitgin/pkg/domain"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-type userRepository struct {
-	IDCounter atomic.Value
-	Users     map[int]*domain.User
+type userStore struct {
+	IDCounter int64
+	Users     *shardedMap[*domain.User]
+
+	tiersMu     sync.RWMutex
+	VolumeTiers map[int][]domain.VolumeTier // key is the member level
+	MemberTiers map[int]domain.MemberTier   // key is the member level
+
+	subsMu        sync.RWMutex
+	SubCounter    int
+	Subscriptions map[int]domain.Subscription
 }
 
-func (u *userRepository) init() {
-	u.IDCounter.Store(0)
-	u.Users = make(map[int]*domain.User)
+func (s *userStore) init() {
+	s.Users = newShardedMap[*domain.User]()
+	s.VolumeTiers = make(map[int][]domain.VolumeTier)
+	s.MemberTiers = make(map[int]domain.MemberTier)
+	s.Subscriptions = make(map[int]domain.Subscription)
+	for _, t := range domain.DefaultMemberTiers() {
+		s.MemberTiers[t.Level] = t
+	}
+}
+
+type userRepository struct {
+	store *userStore
+	undo  *undoLog
 }
 
 func NewUserRepository() domain.UserRepository {
-	store := &userRepository{}
+	store := &userStore{}
 	store.init()
-	return store
+	return &userRepository{store: store}
 }
 
 func (u *userRepository) GetUser(id int) (*domain.User, error) {
-	if user, ok := u.Users[id]; ok {
+	if user, ok := u.store.Users.get(id); ok {
 		return user, nil
 	} else {
 		return &domain.User{}, errors.New("user not found")
 	}
 }
 
+func (u *userRepository) ListUsers() ([]*domain.User, error) {
+	return u.store.Users.values(), nil
+}
+
 func (u *userRepository) NewUser(user domain.User) (int, error) {
-	id := u.IDCounter.Load().(int)
-	id++
-	u.IDCounter.Store(id)
+	id := int(atomic.AddInt64(&u.store.IDCounter, 1))
 	user.ID = id
-	user.Account.Token.Store(0)
-	user.Account.Point.Store(0)
-	u.Users[id] = &user
+	user.Account = domain.Account{}
+	u.store.Users.set(id, &user)
+	u.undo.push(func() { u.store.Users.delete(id) })
 	return id, nil
 }
 
+func (u *userRepository) AdjustBalance(id int, token int, point int) (domain.Balance, error) {
+	user, err := u.GetUser(id)
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	b, err := user.Account.Apply(token, point)
+	if err == nil {
+		u.undo.push(func() { _, _ = user.Account.Apply(-token, -point) })
+	}
+	return b, err
+}
+
+func (u *userRepository) AdjustBonusToken(id int, bonusToken int) (domain.Balance, error) {
+	user, err := u.GetUser(id)
+	if err != nil {
+		return domain.Balance{}, err
+	}
+	b, err := user.Account.ApplyBalance(domain.Balance{BonusToken: bonusToken})
+	if err == nil {
+		u.undo.push(func() { _, _ = user.Account.ApplyBalance(domain.Balance{BonusToken: -bonusToken}) })
+	}
+	return b, err
+}
+
+func (u *userRepository) SetVolumeTiers(level int, tiers []domain.VolumeTier) error {
+	sorted := make([]domain.VolumeTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinToken < sorted[j].MinToken })
+	for i := range sorted {
+		sorted[i].MemberLevel = level
+	}
+
+	s := u.store
+	s.tiersMu.Lock()
+	defer s.tiersMu.Unlock()
+	old := s.VolumeTiers[level]
+	s.VolumeTiers[level] = sorted
+	u.undo.push(func() {
+		s.tiersMu.Lock()
+		defer s.tiersMu.Unlock()
+		s.VolumeTiers[level] = old
+	})
+	return nil
+}
+
+func (u *userRepository) ListVolumeTiers(level int) ([]domain.VolumeTier, error) {
+	u.store.tiersMu.RLock()
+	defer u.store.tiersMu.RUnlock()
+	rtn := make([]domain.VolumeTier, len(u.store.VolumeTiers[level]))
+	copy(rtn, u.store.VolumeTiers[level])
+	return rtn, nil
+}
+
 func (u *userRepository) GetDefaultBuyTokenDiscount(level int) int {
-	switch level {
-	case 1:
-		return 95
-	case 2:
-		return 90
-	case 3:
-		return 85
-	default:
-		return 100
+	if tier, err := u.GetMemberTier(level); err == nil {
+		return tier.BuyTokenDiscount
+	}
+	return 100
+}
+
+func (u *userRepository) SetMemberTier(tier domain.MemberTier) error {
+	tier.Perks = append([]string(nil), tier.Perks...)
+
+	s := u.store
+	s.tiersMu.Lock()
+	defer s.tiersMu.Unlock()
+	old, existed := s.MemberTiers[tier.Level]
+	s.MemberTiers[tier.Level] = tier
+	u.undo.push(func() {
+		s.tiersMu.Lock()
+		defer s.tiersMu.Unlock()
+		if existed {
+			s.MemberTiers[tier.Level] = old
+		} else {
+			delete(s.MemberTiers, tier.Level)
+		}
+	})
+	return nil
+}
+
+func (u *userRepository) GetMemberTier(level int) (domain.MemberTier, error) {
+	u.store.tiersMu.RLock()
+	defer u.store.tiersMu.RUnlock()
+	tier, ok := u.store.MemberTiers[level]
+	if !ok {
+		return domain.MemberTier{}, domain.ErrMemberTierNotFound
+	}
+	tier.Perks = append([]string(nil), tier.Perks...)
+	return tier, nil
+}
+
+func (u *userRepository) ListMemberTiers() ([]domain.MemberTier, error) {
+	u.store.tiersMu.RLock()
+	defer u.store.tiersMu.RUnlock()
+	rtn := make([]domain.MemberTier, 0, len(u.store.MemberTiers))
+	for _, t := range u.store.MemberTiers {
+		t.Perks = append([]string(nil), t.Perks...)
+		rtn = append(rtn, t)
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		if rtn[i].Rank != rtn[j].Rank {
+			return rtn[i].Rank < rtn[j].Rank
+		}
+		return rtn[i].Level < rtn[j].Level
+	})
+	return rtn, nil
+}
+
+func (u *userRepository) AddSubscription(subscription domain.Subscription) (int, error) {
+	s := u.store
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	s.SubCounter++
+	subscription.ID = s.SubCounter
+	s.Subscriptions[subscription.ID] = subscription
+	u.undo.push(func() {
+		s.subsMu.Lock()
+		defer s.subsMu.Unlock()
+		delete(s.Subscriptions, subscription.ID)
+	})
+	return subscription.ID, nil
+}
+
+func (u *userRepository) GetActiveSubscription(userID int) (domain.Subscription, error) {
+	u.store.subsMu.RLock()
+	defer u.store.subsMu.RUnlock()
+	for _, sub := range u.store.Subscriptions {
+		if sub.UserID == userID && sub.State == domain.SubscriptionActive {
+			return sub, nil
+		}
+	}
+	return domain.Subscription{}, domain.ErrSubscriptionNotFound
+}
+
+func (u *userRepository) UpdateSubscription(subscription domain.Subscription) error {
+	s := u.store
+	s.subsMu.Lock()
+	defer s.subsMu.Unlock()
+	old, ok := s.Subscriptions[subscription.ID]
+	if !ok {
+		return domain.ErrSubscriptionNotFound
+	}
+	s.Subscriptions[subscription.ID] = subscription
+	u.undo.push(func() {
+		s.subsMu.Lock()
+		defer s.subsMu.Unlock()
+		s.Subscriptions[old.ID] = old
+	})
+	return nil
+}
+
+func (u *userRepository) ListDueSubscriptions(t time.Time) ([]domain.Subscription, error) {
+	u.store.subsMu.RLock()
+	defer u.store.subsMu.RUnlock()
+	rtn := make([]domain.Subscription, 0)
+	for _, sub := range u.store.Subscriptions {
+		if sub.State == domain.SubscriptionActive && !sub.EndDate.After(t) {
+			rtn = append(rtn, sub)
+		}
+	}
+	sort.Slice(rtn, func(i, j int) bool { return rtn[i].ID < rtn[j].ID })
+	return rtn, nil
+}
+
+// SetMember replaces the user with a copy holding member, so readers holding a *domain.User never see Member
+// change under them. The balance is carried over to the copy, call it in a unit of work so no balance changes in between.
+func (u *userRepository) SetMember(id int, member domain.Member) error {
+	old, ok, err := u.store.Users.update(id, withMember(member))
+	if !ok {
+		return errors.New("user not found")
+	}
+	if err != nil {
+		return err
+	}
+	// only the member is put back, balance changes made since are kept
+	u.undo.push(func() { _, _, _ = u.store.Users.update(id, withMember(old.Member)) })
+	return nil
+}
+
+// withMember copies the user with member, users are replaced rather than changed so readers never see half a member.
+func withMember(member domain.Member) func(old *domain.User) (*domain.User, error) {
+	return func(old *domain.User) (*domain.User, error) {
+		next := &domain.User{ID: old.ID, Name: old.Name, Member: member}
+		_, err := next.Account.ApplyBalance(old.Account.Load())
+		return next, err
+	}
+}
+
+// SetMemberDiscount updates the users with SetMember.
+func (u *userRepository) SetMemberDiscount(level int, discount int) (int, error) {
+	changed := 0
+	for _, user := range u.store.Users.values() {
+		if user.Member.Level != level || user.Member.BuyTokenDefaultDiscount == discount {
+			continue
+		}
+		member := user.Member
+		member.BuyTokenDefaultDiscount = discount
+		if err := u.SetMember(user.ID, member); err != nil {
+			return changed, err
+		}
+		changed++
 	}
+	return changed, nil
 }
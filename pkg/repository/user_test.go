@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"github.com/stretchr/testify/require"
+	"oa-bitgin/pkg/domain"
+	"sync"
+	"testing"
+)
+
+func Test_userRepository_Parallel(t *testing.T) {
+	const workers = 50
+	const rounds = 200
+	r := NewUserRepository()
+
+	ids := make(chan int, workers*rounds)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				id, err := r.NewUser(domain.User{Name: "testUser"})
+				require.NoError(t, err)
+				ids <- id
+				user, err := r.GetUser(id)
+				require.NoError(t, err)
+				require.Equal(t, id, user.ID)
+				user.BuyToken(1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		require.False(t, seen[id], "duplicate id %d", id)
+		seen[id] = true
+	}
+	require.Len(t, seen, workers*rounds)
+	for id := 1; id <= workers*rounds; id++ {
+		user, err := r.GetUser(id)
+		require.NoError(t, err)
+		require.Equal(t, 1, user.GetToken())
+	}
+}
+
+func Test_userRepository_MemberTierPerks(t *testing.T) {
+	u := NewUserRepository()
+	perks := []string{"free shipping"}
+	require.NoError(t, u.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, Perks: perks}))
+	perks[0] = "changed"
+
+	tier, err := u.GetMemberTier(1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"free shipping"}, tier.Perks)
+	tier.Perks[0] = "changed"
+	tiers, err := u.ListMemberTiers()
+	require.NoError(t, err)
+	require.Equal(t, []string{"free shipping"}, tiers[1].Perks)
+}
@@ -0,0 +1,231 @@
+package usecase
+
+import (
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"oa-bitgin/pkg/promotion"
+)
+
+// activityDiscount sums what activity id took off the price in result.
+func activityDiscount(result promotion.Result, id int) int64 {
+	var discount int64
+	for _, s := range result.Steps {
+		if s.ActivityID == id && !s.IsBonus() {
+			discount += s.Discount
+		}
+	}
+	return discount
+}
+
+// activityBonus sums the tokens and points bonus activity id gave in result, a point costs as much as a token.
+func activityBonus(result promotion.Result, id int) int64 {
+	var bonus int64
+	for _, s := range result.Steps {
+		if s.ActivityID == id && s.IsBonus() {
+			bonus += s.BonusToken + s.BonusPoint
+		}
+	}
+	return bonus
+}
+
+// evaluate prices the user's order with the activities whose budget and per-user limit still cover what they would
+// give. A token activity that cannot is left out and the order priced again with the next best offer. The activity
+// chosen for a product purchase fails the purchase when its budget is used up, and is dropped when only the user's
+// quota is. Bonus activities that cannot cover their bonus are left out the same way.
+func (c *cashierUsecase) evaluate(repo domain.ActivityRepository, userID int, order promotion.Order) (promotion.Result, error) {
+	kind := domain.ActivityBuyToken
+	if order.Kind == promotion.KindBuyProduct {
+		kind = domain.ActivityBuyProduct
+	}
+	type usageKey struct {
+		kind domain.ActivityKind
+		id   int
+	}
+	usage := make(map[usageKey]domain.BudgetUsage)
+	kindUsage := func(kind domain.ActivityKind, id int, limit domain.Budget) (domain.BudgetUsage, error) {
+		if limit == (domain.Budget{}) {
+			return domain.BudgetUsage{}, nil
+		}
+		key := usageKey{kind: kind, id: id}
+		if used, ok := usage[key]; ok {
+			return used, nil
+		}
+		used, err := repo.GetUserUsage(kind, id, userID)
+		usage[key] = used
+		return used, err
+	}
+	userUsage := func(id int, limit domain.Budget) (domain.BudgetUsage, error) {
+		return kindUsage(kind, id, limit)
+	}
+
+	candidates := make([]domain.BuyTokenActivity, 0, len(order.BuyTokenActivities))
+	for _, a := range order.BuyTokenActivities {
+		used, err := userUsage(a.GetID(), a.UserLimit)
+		if err != nil {
+			return promotion.Result{}, err
+		}
+		if !a.IsExhausted() && !a.UserLimit.Exhausted(used) {
+			candidates = append(candidates, a)
+		}
+	}
+	order.BuyTokenActivities = candidates
+
+	bonuses := make([]domain.BonusActivity, 0, len(order.BonusActivities))
+	for _, a := range order.BonusActivities {
+		used, err := kindUsage(domain.ActivityBonus, a.GetID(), a.UserLimit)
+		if err != nil {
+			return promotion.Result{}, err
+		}
+		if !a.IsExhausted() && !a.UserLimit.Exhausted(used) {
+			bonuses = append(bonuses, a)
+		}
+	}
+	order.BonusActivities = bonuses
+
+	for {
+		result, err := c.engine.Evaluate(order)
+		if err != nil {
+			return promotion.Result{}, err
+		}
+		if a := order.BuyProductActivity; a != nil {
+			discount := activityDiscount(result, a.GetID())
+			if !a.CanCover(discount) {
+				fmt.Println(fmt.Sprintf("[MSG] Activity %d has used up its budget", a.GetID()))
+				return promotion.Result{}, domain.ErrActivityBudgetExhausted
+			}
+			used, err := userUsage(a.GetID(), a.UserLimit)
+			if err != nil {
+				return promotion.Result{}, err
+			}
+			if !a.UserLimit.Allows(used, discount) {
+				fmt.Println(fmt.Sprintf("[MSG] User %d has used up activity %d, buy without it", userID, a.GetID()))
+				order.BuyProductActivity = nil
+				continue
+			}
+		}
+
+		dropped := false
+		for i, a := range order.BuyTokenActivities {
+			discount := activityDiscount(result, a.GetID())
+			if !a.CanCover(discount) || !a.UserLimit.Allows(usage[usageKey{kind: kind, id: a.GetID()}], discount) {
+				order.BuyTokenActivities = append(order.BuyTokenActivities[:i], order.BuyTokenActivities[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+		for i, a := range order.BonusActivities {
+			bonus := activityBonus(result, a.GetID())
+			if !dropped && (!a.CanCover(bonus) || !a.UserLimit.Allows(usage[usageKey{kind: domain.ActivityBonus, id: a.GetID()}], bonus)) {
+				order.BonusActivities = append(order.BonusActivities[:i], order.BonusActivities[i+1:]...)
+				dropped = true
+				break
+			}
+		}
+		if !dropped {
+			return result, nil
+		}
+	}
+}
+
+// consumeBudgets charges the budgets and the user's usage of the activities applied in result.
+func consumeBudgets(repo domain.ActivityRepository, kind domain.ActivityKind, userID int, result promotion.Result) error {
+	for _, id := range result.ActivityIDs {
+		if err := repo.ConsumeBudget(kind, id, userID, activityDiscount(result, id)); err != nil {
+			return err
+		}
+	}
+	for _, id := range result.BonusActivityIDs {
+		if err := repo.ConsumeBudget(domain.ActivityBonus, id, userID, activityBonus(result, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetActivityBudget caps the total discount and/or redemptions of an activity, zero fields remove the cap.
+func (c *cashierUsecase) SetActivityBudget(kind domain.ActivityKind, activityID int, budget domain.Budget) error {
+	if budget.MaxDiscount < 0 || budget.MaxRedemptions < 0 {
+		return fmt.Errorf("invalid budget %+v", budget)
+	}
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		return repos.Activities().SetBudget(kind, activityID, budget)
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+		return err
+	}
+	return nil
+}
+
+// GetActivityBudget returns how much of an activity's budget is used and left.
+func (c *cashierUsecase) GetActivityBudget(kind domain.ActivityKind, activityID int) (domain.BudgetStatus, error) {
+	switch kind {
+	case domain.ActivityBuyToken:
+		a, err := c.activityRepo.GetBuyTokenActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		return a.BudgetStatus(), nil
+	case domain.ActivityBuyProduct:
+		a, err := c.activityRepo.GetBuyProductActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		return a.BudgetStatus(), nil
+	case domain.ActivityBonus:
+		a, err := c.activityRepo.GetBonusActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		return a.BudgetStatus(), nil
+	}
+	return domain.BudgetStatus{}, fmt.Errorf("unknown activity kind %q", kind)
+}
+
+// SetActivityUserLimit caps what each user may get from an activity, zero fields remove the cap.
+// Users over their limit get the next best offer instead.
+func (c *cashierUsecase) SetActivityUserLimit(kind domain.ActivityKind, activityID int, limit domain.Budget) error {
+	if limit.MaxDiscount < 0 || limit.MaxRedemptions < 0 {
+		return fmt.Errorf("invalid limit %+v", limit)
+	}
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		return repos.Activities().SetUserLimit(kind, activityID, limit)
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+		return err
+	}
+	return nil
+}
+
+// GetActivityUserUsage returns how much of an activity's per-user limit the user has used and has left.
+func (c *cashierUsecase) GetActivityUserUsage(kind domain.ActivityKind, activityID int, userID int) (domain.BudgetStatus, error) {
+	var limit domain.Budget
+	switch kind {
+	case domain.ActivityBuyToken:
+		a, err := c.activityRepo.GetBuyTokenActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		limit = a.UserLimit
+	case domain.ActivityBuyProduct:
+		a, err := c.activityRepo.GetBuyProductActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		limit = a.UserLimit
+	case domain.ActivityBonus:
+		a, err := c.activityRepo.GetBonusActivity(activityID)
+		if err != nil {
+			return domain.BudgetStatus{}, err
+		}
+		limit = a.UserLimit
+	default:
+		return domain.BudgetStatus{}, fmt.Errorf("unknown activity kind %q", kind)
+	}
+	used, err := c.activityRepo.GetUserUsage(kind, activityID, userID)
+	if err != nil {
+		return domain.BudgetStatus{}, err
+	}
+	return limit.Status(used), nil
+}
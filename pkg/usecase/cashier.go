@@ -3,111 +3,523 @@ package usecase
 import (
 	"errors"
 	"fmt"
-	"math"
 	"oa-bitgin/pkg/domain"
+	"oa-bitgin/pkg/promotion"
+	"oa-bitgin/pkg/repository"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type cashierUsecase struct {
-	TotalAmount  int64 // total amount of money that cashier has
-	userRepo     domain.UserRepository
-	activityRepo domain.ActivityRepository
-	productRepo  domain.ProductRepository
+	TotalAmount    int64 // total amount of money that cashier has
+	userRepo       domain.UserRepository
+	activityRepo   domain.ActivityRepository
+	productRepo    domain.ProductRepository
+	ledgerRepo     domain.LedgerRepository
+	uow            domain.UnitOfWork // money-moving operations run as one unit of work
+	idempotency    *idempotencyStore
+	quotes         *quoteStore
+	spendWindow    time.Duration // purchases within this long count toward a member upgrade
+	downgradeGrace time.Duration // how long a member below the tier's RetainSpend keeps the tier
+	events         *eventRecorder
+	engine         *promotion.Engine
+	setupOnce      sync.Once // see setup
 }
 
+type Option func(c *cashierUsecase)
+
+// WithIdempotencyRetention sets how long the result of an idempotent call is kept.
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(c *cashierUsecase) {
+		c.idempotency = newIdempotencyStore(retention)
+	}
+}
+
+// WithPromotionEngine replaces the default pricing rules.
+func WithPromotionEngine(engine *promotion.Engine) Option {
+	return func(c *cashierUsecase) {
+		c.engine = engine
+	}
+}
+
+// NewCashierUsecase runs the cashier on the given repositories. In-memory repositories keep the ledger and coupons
+// in memory too, repositories of sqlite.New*Repository run in transactions of their database. It panics when the
+// repositories cannot be used together, NewCashierUsecaseWithUnitOfWork returns the error and takes options.
 func NewCashierUsecase(userRepo domain.UserRepository, activityRepo domain.ActivityRepository, productRepo domain.ProductRepository) domain.CashierUsecase {
-	return &cashierUsecase{
-		userRepo:     userRepo,
-		activityRepo: activityRepo,
-		productRepo:  productRepo,
+	uow, err := newUnitOfWork(userRepo, activityRepo, productRepo)
+	if err != nil {
+		panic(err)
+	}
+	c, err := NewCashierUsecaseWithUnitOfWork(uow)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// NewCashierUsecaseWithUnitOfWork runs the cashier on the repositories of uow, the backend is picked by the unit of
+// work passed in: repository.NewMemoryUnitOfWork for in-memory state or sqlite.NewUnitOfWork for state that survives
+// restarts. It fails when the money already received cannot be read from the ledger.
+func NewCashierUsecaseWithUnitOfWork(uow domain.UnitOfWork, opts ...Option) (domain.CashierUsecase, error) {
+	c := &cashierUsecase{
+		userRepo:       uow.Users(),
+		activityRepo:   uow.Activities(),
+		productRepo:    uow.Products(),
+		ledgerRepo:     uow.Ledger(),
+		uow:            uow,
+		idempotency:    newIdempotencyStore(DefaultIdempotencyRetention),
+		quotes:         newQuoteStore(),
+		spendWindow:    DefaultSpendWindow,
+		downgradeGrace: DefaultDowngradeGrace,
+		engine:         promotion.NewDefaultEngine(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.events.load(c.userRepo); err != nil {
+		return nil, err
+	}
+	// pick up money received before a restart when the ledger is durable
+	revenue, err := c.ledgerRepo.GetBalance(domain.AccountCashierRevenue, domain.UnitToken)
+	if err != nil {
+		return nil, err
+	}
+	c.TotalAmount = -revenue
+	return c, nil
+}
+
+// unitOfWorkSource is implemented by repositories that know how to group themselves, the SQLite ones do.
+type unitOfWorkSource interface {
+	UnitOfWork() (domain.UnitOfWork, error)
+}
+
+// newUnitOfWork groups the repositories NewCashierUsecase is given, missing ones are replaced by empty in-memory ones.
+func newUnitOfWork(userRepo domain.UserRepository, activityRepo domain.ActivityRepository, productRepo domain.ProductRepository) (domain.UnitOfWork, error) {
+	if source, ok := userRepo.(unitOfWorkSource); ok {
+		return source.UnitOfWork()
+	}
+	if userRepo == nil {
+		userRepo = repository.NewUserRepository()
+	}
+	if activityRepo == nil {
+		activityRepo = repository.NewActivityRepository()
+	}
+	if productRepo == nil {
+		productRepo = repository.NewProductRepository()
+	}
+	return repository.NewUnitOfWork(userRepo, activityRepo, productRepo, repository.NewLedgerRepository(), repository.NewCouponRepository())
+}
+
+// setup fills what a cashier built without a constructor is missing, the defaults of NewCashierUsecase apart from
+// the spend window and downgrade grace.
+func (c *cashierUsecase) setup() {
+	c.setupOnce.Do(func() {
+		if c.uow == nil {
+			uow, err := newUnitOfWork(c.userRepo, c.activityRepo, c.productRepo)
+			if err != nil {
+				panic(err)
+			}
+			c.uow = uow
+			if c.userRepo == nil {
+				c.userRepo = uow.Users()
+			}
+			if c.activityRepo == nil {
+				c.activityRepo = uow.Activities()
+			}
+			if c.productRepo == nil {
+				c.productRepo = uow.Products()
+			}
+		}
+		if c.ledgerRepo == nil {
+			c.ledgerRepo = c.uow.Ledger()
+		}
+		if c.idempotency == nil {
+			c.idempotency = newIdempotencyStore(DefaultIdempotencyRetention)
+		}
+		if c.quotes == nil {
+			c.quotes = newQuoteStore()
+		}
+		if c.engine == nil {
+			c.engine = promotion.NewDefaultEngine()
+		}
+	})
+}
+
+// unitOfWork returns the unit of work the cashier runs in.
+func (c *cashierUsecase) unitOfWork() domain.UnitOfWork {
+	c.setup()
+	return c.uow
+}
+
+// ledger returns the ledger of the cashier's unit of work.
+func (c *cashierUsecase) ledger() domain.LedgerRepository {
+	c.setup()
+	return c.ledgerRepo
+}
+
+func (c *cashierUsecase) BuyTokenIdempotent(key string, userID int, token int64) (int, error) {
+	c.setup()
+	return c.idempotency.do(key, fmt.Sprintf("BuyToken:%d:%d", userID, token), func() (int, error) {
+		return c.BuyToken(userID, token)
+	})
+}
+
+func (c *cashierUsecase) BuyTokenWithActivityIdempotent(key string, userID int, token int64) (int, error) {
+	c.setup()
+	return c.idempotency.do(key, fmt.Sprintf("BuyTokenWithActivity:%d:%d", userID, token), func() (int, error) {
+		return c.BuyTokenWithActivity(userID, token)
+	})
+}
+
+func (c *cashierUsecase) BuyProductIdempotent(key string, userID int, productID int) (int, error) {
+	c.setup()
+	return c.idempotency.do(key, fmt.Sprintf("BuyProduct:%d:%d", userID, productID), func() (int, error) {
+		return c.BuyProduct(userID, productID)
+	})
+}
+
+func (c *cashierUsecase) BuyProductWithActivityIdempotent(key string, userID int, productID int, activityID int) (int, error) {
+	c.setup()
+	return c.idempotency.do(key, fmt.Sprintf("BuyProductWithActivity:%d:%d:%d", userID, productID, activityID), func() (int, error) {
+		return c.BuyProductWithActivity(userID, productID, activityID)
+	})
+}
+
+// post writes entry to the ledger, the entry must be balanced.
+func post(ledger domain.LedgerRepository, entry *domain.JournalEntry) error {
+	entry.CreatedAt = time.Now()
+	id, err := ledger.Post(*entry)
+	entry.ID = id
+	return err
+}
+
+// buyTokenEntry credits the user with token and books the fiat charge and the discount given.
+func buyTokenEntry(userID int, token int64, charged int64, activityIDs []int) *domain.JournalEntry {
+	entry := &domain.JournalEntry{
+		Type:        domain.TransactionBuyToken,
+		UserID:      userID,
+		ActivityIDs: activityIDs,
+		Charged:     charged,
+	}
+	if len(activityIDs) > 0 {
+		entry.ActivityID = activityIDs[0]
+	}
+	entry.Credit(domain.UserAccount(userID), domain.UnitToken, token)
+	entry.Debit(domain.AccountCashierRevenue, domain.UnitToken, charged)
+	entry.Debit(domain.AccountPromotionExpense, domain.UnitToken, token-charged)
+	return entry
+}
+
+// bookBonusPoint gives the user point on top of a purchase at the expense of promotion.
+func bookBonusPoint(entry *domain.JournalEntry, point int64) {
+	if point == 0 {
+		return
+	}
+	entry.Debit(domain.AccountPromotionExpense, domain.UnitPoint, point)
+	entry.Credit(domain.UserAccount(entry.UserID), domain.UnitPoint, point)
+}
+
+// bookBonusToken gives the user bonus token on top of a purchase at the expense of promotion, they are kept apart
+// from the tokens paid for.
+func bookBonusToken(entry *domain.JournalEntry, bonusToken int64) {
+	if bonusToken == 0 {
+		return
+	}
+	entry.Debit(domain.AccountPromotionExpense, domain.UnitBonusToken, bonusToken)
+	entry.Credit(domain.UserAccount(entry.UserID), domain.UnitBonusToken, bonusToken)
+}
+
+// ReconcileUser compares the user's balances with the ledger.
+func (c *cashierUsecase) ReconcileUser(userID int) error {
+	user, err := c.userRepo.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	account := domain.UserAccount(userID)
+	balances := []struct {
+		name string
+		unit domain.Unit
+		want int
+	}{
+		{"token", domain.UnitToken, user.GetToken()},
+		{"point", domain.UnitPoint, user.GetPoint()},
+		{"bonus token", domain.UnitBonusToken, user.GetBonusToken()},
+	}
+	for _, b := range balances {
+		got, err := c.ledger().GetBalance(account, b.unit)
+		if err != nil {
+			return err
+		}
+		if got != int64(b.want) {
+			return fmt.Errorf("user %d %s balance %d does not match ledger %d", userID, b.name, b.want, got)
+		}
 	}
+	return nil
 }
 
+// GetUserTransactions returns the user's transactions in posting order, a page at a time.
+func (c *cashierUsecase) GetUserTransactions(userID int, filter domain.TransactionFilter) (domain.TransactionPage, error) {
+	if _, err := c.userRepo.GetUser(userID); err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] User %d not found", userID))
+		return domain.TransactionPage{}, err
+	}
+	if filter.Limit < 0 {
+		return domain.TransactionPage{}, errors.New("invalid limit")
+	}
+
+	// ask for one more entry to know whether there is a next page
+	pageSize := filter.Limit
+	if pageSize > 0 {
+		filter.Limit++
+	}
+	entries, err := c.ledger().ListEntries(userID, filter)
+	if err != nil {
+		return domain.TransactionPage{}, err
+	}
+
+	page := domain.TransactionPage{Transactions: make([]domain.Transaction, 0, len(entries))}
+	if pageSize > 0 && len(entries) > pageSize {
+		entries = entries[:pageSize]
+		page.NextCursor = entries[pageSize-1].ID
+	}
+	for i := range entries {
+		page.Transactions = append(page.Transactions, entries[i].Transaction())
+	}
+	return page, nil
+}
+
+// GetTotalAmount returns the money the cashier has received for tokens.
 func (c *cashierUsecase) GetTotalAmount() int64 {
-	return c.TotalAmount
+	return atomic.LoadInt64(&c.TotalAmount)
 }
 
 func (c *cashierUsecase) NewUser(name string, memberLevel int) (int, error) {
-	user := domain.User{
-		Name: name,
-		Member: domain.Member{
-			Level:                   memberLevel,
-			BuyTokenDefaultDiscount: c.userRepo.GetDefaultBuyTokenDiscount(memberLevel),
-		},
+	id := -1
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		user := domain.User{
+			Name: name,
+			Member: domain.Member{
+				Level:                   memberLevel,
+				BuyTokenDefaultDiscount: repos.Users().GetDefaultBuyTokenDiscount(memberLevel),
+			},
+		}
+		var err error
+		if id, err = repos.Users().NewUser(user); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventUserCreated, UserID: id, Name: name, MemberLevel: memberLevel})
+	})
+	if err != nil {
+		return -1, err
 	}
-	user.Account.Token.Store(0)
-	user.Account.Point.Store(0)
-	return c.userRepo.NewUser(user)
+	return id, nil
 }
 
-func (c *cashierUsecase) BuyToken(userID int, token int64) (int, error) {
-	user, err := c.userRepo.GetUser(userID)
+func (c *cashierUsecase) BuyToken(userID int, token int64, coupon ...string) (int, error) {
+	code, err := couponCode(coupon)
+	if err != nil {
+		return -1, err
+	}
+	result, err := c.buyToken(userID, token, false, code)
 	if err != nil {
 		return -1, err
 	}
+	fmt.Println("[MSG] Need to charge: ", result.Charge)
+	return int(result.Charge), nil
+}
 
-	user.BuyToken(int(token))
-	rtn := token * int64(user.Member.BuyTokenDefaultDiscount) / 100
-	c.TotalAmount += rtn
-	fmt.Println("[MSG] Need to charge: ", rtn)
-	return int(rtn), nil
+// buyToken prices the purchase with the promotion engine, activities are only considered when withActivity is set
+// and code is the coupon entered at checkout, empty for none.
+func (c *cashierUsecase) buyToken(userID int, token int64, withActivity bool, code string) (promotion.Result, error) {
+	return c.purchaseToken(userID, token, code, func(repos domain.Repositories) (promotion.Result, error) {
+		return c.priceToken(repos, userID, token, withActivity, code)
+	})
 }
 
-func (c *cashierUsecase) AddPoint(userID int, point int64) error {
-	user, err := c.userRepo.GetUser(userID)
+// priceToken prices a token purchase without changing anything.
+func (c *cashierUsecase) priceToken(repos domain.Repositories, userID int, token int64, withActivity bool, code string) (promotion.Result, error) {
+	user, err := repos.Users().GetUser(userID)
 	if err != nil {
-		return err
+		return promotion.Result{}, err
 	}
 
-	user.AddPoint(int(point))
-	return nil
+	tier, err := memberTier(repos.Users(), user.Member.Level)
+	if err != nil {
+		return promotion.Result{}, err
+	}
+	if !tier.SpendingLimit.AllowsToken(token) {
+		fmt.Println(fmt.Sprintf("[MSG] User %d cannot buy %d tokens at once", userID, token))
+		return promotion.Result{}, domain.ErrSpendingLimit
+	}
+
+	order := promotion.Order{Kind: promotion.KindBuyToken, Member: user.Member, PointMultiplier: tier.PointMultiplier, Token: token}
+	if order.VolumeTiers, err = repos.Users().ListVolumeTiers(user.Member.Level); err != nil {
+		return promotion.Result{}, err
+	}
+	if withActivity {
+		if order.BuyTokenActivities, err = repos.Activities().ListBuyTokenActivity(); err != nil {
+			return promotion.Result{}, err
+		}
+		if order.BonusActivities, err = repos.Activities().ListBonusActivity(); err != nil {
+			return promotion.Result{}, err
+		}
+	}
+	if order.Coupon, err = couponBatch(repos.Coupons(), code); err != nil {
+		return promotion.Result{}, err
+	}
+	return c.evaluate(repos.Activities(), userID, order)
+}
+
+// purchaseToken credits the user with token at the price returned by price, which runs in the same unit of work.
+func (c *cashierUsecase) purchaseToken(userID int, token int64, code string,
+	price func(repos domain.Repositories) (promotion.Result, error)) (promotion.Result, error) {
+	var result promotion.Result
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if result, err = price(repos); err != nil {
+			return err
+		}
+
+		entry := buyTokenEntry(userID, token, result.Charge, result.ActivityIDs)
+		entry.Coupon = code
+		entry.BonusActivityIDs = result.BonusActivityIDs
+		bookBonusPoint(entry, result.BonusPoint)
+		bookBonusToken(entry, result.BonusToken)
+		if _, err := repos.Users().AdjustBalance(userID, int(token), int(result.BonusPoint)); err != nil {
+			return err
+		}
+		if result.BonusToken > 0 {
+			if _, err := repos.Users().AdjustBonusToken(userID, int(result.BonusToken)); err != nil {
+				return err
+			}
+		}
+		if err := post(repos.Ledger(), entry); err != nil {
+			return err
+		}
+		if err := redeemCoupon(repos.Coupons(), entry, result); err != nil {
+			return err
+		}
+		if err := consumeBudgets(repos.Activities(), domain.ActivityBuyToken, userID, result); err != nil {
+			return err
+		}
+		upgraded, err := c.upgradeMember(repos, userID)
+		if err != nil {
+			return err
+		}
+		if err := events.emit(domain.Event{Type: domain.EventTokensPurchased, UserID: userID, ActivityID: entry.ActivityID, Token: token,
+			BonusToken: result.BonusToken, Point: result.BonusPoint, Amount: result.Charge}); err != nil {
+			return err
+		}
+		if upgraded != nil {
+			return events.emit(*upgraded)
+		}
+		return nil
+	})
+	if err != nil {
+		return promotion.Result{}, err
+	}
+	atomic.AddInt64(&c.TotalAmount, result.Charge)
+	return result, nil
+}
+
+// AddPoint gives the user point scaled by the point multiplier of their member tier.
+func (c *cashierUsecase) AddPoint(userID int, point int64) error {
+	return c.do(func(repos domain.Repositories, events *eventBatch) error {
+		user, err := repos.Users().GetUser(userID)
+		if err != nil {
+			return err
+		}
+		tier, err := memberTier(repos.Users(), user.Member.Level)
+		if err != nil {
+			return err
+		}
+		point := domain.MultiplyPoint(point, tier.PointMultiplier)
+
+		entry := domain.JournalEntry{
+			Type:   domain.TransactionAddPoint,
+			UserID: userID,
+		}
+		entry.Debit(domain.AccountPromotionExpense, domain.UnitPoint, point)
+		entry.Credit(domain.UserAccount(userID), domain.UnitPoint, point)
+
+		if _, err := repos.Users().AdjustBalance(userID, 0, int(point)); err != nil {
+			return err
+		}
+		if err := post(repos.Ledger(), &entry); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventPointsAdded, UserID: userID, Point: point})
+	})
 }
 
 func (c *cashierUsecase) NewBuyTokenActivity(memberLevel int, startTime time.Time, endTime time.Time, discount int) (int, error) {
+	return c.NewStackableBuyTokenActivity(memberLevel, startTime, endTime, discount, domain.Stacking{})
+}
+
+func (c *cashierUsecase) NewStackableBuyTokenActivity(memberLevel int, startTime time.Time, endTime time.Time, discount int, stacking domain.Stacking) (int, error) {
 	a := domain.BuyTokenActivity{
 		MemberLevel:      memberLevel,
 		BuyTokenDiscount: discount,
+		Stacking:         stacking,
 	}
 	_ = a.SetPeriod(startTime, endTime)
-	aID, _ := c.activityRepo.AddBuyTokenActivity(a)
+	aID := -1
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if aID, err = repos.Activities().AddBuyTokenActivity(a); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventActivityCreated, ActivityID: aID, MemberLevel: memberLevel})
+	})
+	if err != nil {
+		return -1, err
+	}
 	return aID, nil
 }
 
-func (c *cashierUsecase) BuyTokenWithActivity(userID int, token int64) (int, error) {
-	user, err := c.userRepo.GetUser(userID)
+// NewBonusActivity creates an activity giving bonus tokens and/or points for every Threshold tokens bought
+// with BuyTokenWithActivity.
+func (c *cashierUsecase) NewBonusActivity(startTime time.Time, endTime time.Time, bonus domain.BonusActivity) (int, error) {
+	if bonus.Threshold < 1 || bonus.BonusToken < 0 || bonus.BonusPoint < 0 || bonus.BonusToken+bonus.BonusPoint == 0 ||
+		bonus.MaxBonusToken < 0 || bonus.MaxBonusPoint < 0 {
+		return -1, errors.New("invalid bonus activity")
+	}
+	if err := bonus.SetPeriod(startTime, endTime); err != nil {
+		return -1, err
+	}
+	aID := -1
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if aID, err = repos.Activities().AddBonusActivity(bonus); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventActivityCreated, ActivityID: aID})
+	})
 	if err != nil {
 		return -1, err
 	}
+	return aID, nil
+}
 
-	activities, err := c.activityRepo.ListBuyTokenActivity()
+func (c *cashierUsecase) BuyTokenWithActivity(userID int, token int64, coupon ...string) (int, error) {
+	code, err := couponCode(coupon)
 	if err != nil {
 		return -1, err
 	}
-
-	// find the best price for user
-	find := false
-	bestPrice := int64(math.MaxInt64)
-	for _, a := range activities {
-		if a.IsInPeriod(time.Now()) && a.MemberLevel == user.Member.Level {
-			find = true
-			tmp := token * int64(a.BuyTokenDiscount) / 100
-			if tmp < bestPrice {
-				bestPrice = tmp
-			}
-		}
+	result, err := c.buyToken(userID, token, true, code)
+	if err != nil {
+		return -1, err
 	}
-	if find == true {
-		user.BuyToken(int(token))
-		fmt.Println("[MSG] Need to charge: ", bestPrice)
-		c.TotalAmount += bestPrice
-		return int(bestPrice), nil
+	if len(result.ActivityIDs) > 0 || len(result.BonusActivityIDs) > 0 {
+		fmt.Println("[MSG] Need to charge: ", result.Charge)
+	} else {
+		fmt.Println("[MSG] Need to charge (without activity because no activity matched): ", result.Charge)
 	}
-
-	user.BuyToken(int(token))
-	bestPrice = token * int64(user.Member.BuyTokenDefaultDiscount) / 100
-	c.TotalAmount += bestPrice
-	fmt.Println("[MSG] Need to charge (without activity because no activity matched): ", token*int64(user.Member.BuyTokenDefaultDiscount)/100)
-	return int(bestPrice), nil
+	if result.BonusToken > 0 || result.BonusPoint > 0 {
+		fmt.Println(fmt.Sprintf("[MSG] User %d gets bonus token %d, bonus point %d", userID, result.BonusToken, result.BonusPoint))
+	}
+	return int(result.Charge), nil
 }
 
 func (c *cashierUsecase) GetUserToken(userID int) (int, error) {
@@ -130,36 +542,199 @@ func (c *cashierUsecase) GetUserPoint(userID int) (int, error) {
 	return user.GetPoint(), err
 }
 
-func (c *cashierUsecase) BuyProduct(userID int, productID int) (int, error) {
+func (c *cashierUsecase) GetUserBonusToken(userID int) (int, error) {
 	user, err := c.userRepo.GetUser(userID)
 	if err != nil {
 		fmt.Println(fmt.Sprintf("[MSG] User %d not found", userID))
 		return -1, err
 	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d has %d bonus token", user.ID, user.GetBonusToken()))
+	return user.GetBonusToken(), err
+}
 
-	product, err := c.productRepo.GetProduct(productID)
+func (c *cashierUsecase) BuyProduct(userID int, productID int, coupon ...string) (int, error) {
+	code, err := couponCode(coupon)
+	if err != nil {
+		return -1, err
+	}
+	result, err := c.buyProduct(userID, productID, 0, code)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("[MSG] Product %d not found", productID))
 		return -1, err
 	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d has bought product %d use price %d", userID, productID, result.Charge))
+	return int(result.Charge), nil
+}
+
+// buyProduct prices the purchase with the promotion engine, activityID 0 means no point redemption
+// and code is the coupon entered at checkout, empty for none.
+func (c *cashierUsecase) buyProduct(userID int, productID int, activityID int, code string) (promotion.Result, error) {
+	return c.purchaseProduct(userID, productID, code, func(repos domain.Repositories) (promotion.Result, error) {
+		return c.priceProduct(repos, userID, productID, activityID, code)
+	})
+}
+
+// priceProduct prices a product purchase without changing anything.
+func (c *cashierUsecase) priceProduct(repos domain.Repositories, userID int, productID int, activityID int, code string) (promotion.Result, error) {
+	user, err := repos.Users().GetUser(userID)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] User %d not found", userID))
+		return promotion.Result{}, err
+	}
+
+	product, err := repos.Products().GetProduct(productID)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Product %d not found", productID))
+		return promotion.Result{}, err
+	}
+	if !product.InStock() {
+		fmt.Println(fmt.Sprintf("[MSG] Product %d is out of stock", productID))
+		return promotion.Result{}, domain.ErrOutOfStock
+	}
 
-	if user.GetToken() < product.Price {
-		fmt.Println(fmt.Sprintf("[MSG] User %d has not enough token to buy product %d", userID, productID))
-		return -1, errors.New("not enough token")
+	tier, err := memberTier(repos.Users(), user.Member.Level)
+	if err != nil {
+		return promotion.Result{}, err
+	}
+	if !tier.SpendingLimit.AllowsProduct(product) {
+		fmt.Println(fmt.Sprintf("[MSG] User %d cannot buy product %d at price %d", userID, productID, product.Price))
+		return promotion.Result{}, domain.ErrSpendingLimit
 	}
 
-	user.UseToken(product.Price)
-	fmt.Println(fmt.Sprintf("[MSG] User %d has bought product %d use price %d", userID, productID, product.Price))
-	return product.Price, nil
+	order := promotion.Order{Kind: promotion.KindBuyProduct, Member: user.Member, PointMultiplier: tier.PointMultiplier, Product: product}
+	if activityID != 0 {
+		activity, err := repos.Activities().GetBuyProductActivity(activityID)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+			return promotion.Result{}, err
+		}
+		if !activity.IsRunning(time.Now()) {
+			fmt.Println(fmt.Sprintf("[MSG] Activity %d is not running now", activityID))
+			return promotion.Result{}, domain.ErrActivityNotRunning
+		}
+		if !activity.Covers(product) {
+			fmt.Println(fmt.Sprintf("[MSG] Activity %d does not cover product %d", activityID, productID))
+			return promotion.Result{}, domain.ErrActivityNotApplicable
+		}
+		order.BuyProductActivity = &activity
+	}
+	if order.Coupon, err = couponBatch(repos.Coupons(), code); err != nil {
+		return promotion.Result{}, err
+	}
+	return c.evaluate(repos.Activities(), userID, order)
+}
+
+// purchaseProduct debits the user at the price returned by price, which runs in the same unit of work.
+func (c *cashierUsecase) purchaseProduct(userID int, productID int, code string,
+	price func(repos domain.Repositories) (promotion.Result, error)) (promotion.Result, error) {
+	var result promotion.Result
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if result, err = price(repos); err != nil {
+			return err
+		}
+		user, err := repos.Users().GetUser(userID)
+		if err != nil {
+			return err
+		}
+		product, err := repos.Products().AdjustStock(productID, -1)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("[MSG] Product %d: %s", productID, err))
+			return err
+		}
+		// the activity is left out when the user's quota of it is used up
+		activityID := 0
+		if len(result.ActivityIDs) > 0 {
+			activityID = result.ActivityIDs[0]
+		}
+
+		entry := domain.JournalEntry{
+			Type:        domain.TransactionBuyProduct,
+			UserID:      userID,
+			ProductID:   productID,
+			ActivityID:  activityID,
+			ActivityIDs: result.ActivityIDs,
+			Coupon:      code,
+		}
+		// bonus tokens are spent before the tokens the user paid for
+		bonusToken := int64(user.GetBonusToken())
+		if bonusToken > result.Charge {
+			bonusToken = result.Charge
+		}
+		token := result.Charge - bonusToken
+
+		entry.Debit(domain.UserAccount(userID), domain.UnitPoint, result.Point)
+		entry.Credit(domain.AccountCashierSales, domain.UnitPoint, result.Point)
+		entry.Debit(domain.UserAccount(userID), domain.UnitBonusToken, bonusToken)
+		entry.Credit(domain.AccountCashierSales, domain.UnitBonusToken, bonusToken)
+		entry.Debit(domain.UserAccount(userID), domain.UnitToken, token)
+		entry.Debit(domain.AccountPromotionExpense, domain.UnitToken, result.ListPrice-result.Point-result.Charge)
+		entry.Credit(domain.AccountCashierSales, domain.UnitToken, result.ListPrice-result.Point-bonusToken)
+		bookBonusPoint(&entry, result.BonusPoint)
+
+		// points and tokens are checked and debited in one step
+		if _, err := repos.Users().AdjustBalance(userID, -int(token), -int(result.Point)); err != nil {
+			fmt.Println(fmt.Sprintf("[MSG] User %d has %s to buy product %d", userID, err, productID))
+			return err
+		}
+		if bonusToken > 0 {
+			if _, err := repos.Users().AdjustBonusToken(userID, -int(bonusToken)); err != nil {
+				return err
+			}
+		}
+		// bonus points are given after the debit so they cannot pay for the purchase itself
+		if _, err := repos.Users().AdjustBalance(userID, 0, int(result.BonusPoint)); err != nil {
+			return err
+		}
+		if err := post(repos.Ledger(), &entry); err != nil {
+			return err
+		}
+		if err := redeemCoupon(repos.Coupons(), &entry, result); err != nil {
+			return err
+		}
+		if err := consumeBudgets(repos.Activities(), domain.ActivityBuyProduct, userID, result); err != nil {
+			return err
+		}
+		upgraded, err := c.upgradeMember(repos, userID)
+		if err != nil {
+			return err
+		}
+		if err := events.emit(domain.Event{Type: domain.EventProductPurchased, UserID: userID, ProductID: productID, ActivityID: activityID,
+			Token: -token, BonusToken: -bonusToken, Point: result.BonusPoint - result.Point}); err != nil {
+			return err
+		}
+		if upgraded != nil {
+			if err := events.emit(*upgraded); err != nil {
+				return err
+			}
+		}
+		if product.IsLowStock() {
+			fmt.Println(fmt.Sprintf("[MSG] Product %d is low on stock, %d left", productID, product.Stock))
+			return events.emit(domain.Event{Type: domain.EventProductLowStock, ProductID: productID, Stock: product.Stock})
+		}
+		return nil
+	})
+	return result, err
 }
 
 func (c *cashierUsecase) NewProduct(name string, price int) (int, error) {
+	return c.NewCategorizedProduct(name, price, "")
+}
+
+func (c *cashierUsecase) NewCategorizedProduct(name string, price int, category string) (int, error) {
 	p := domain.Product{
-		Name:  name,
-		Price: price,
+		Name:     name,
+		Price:    price,
+		Category: category,
 	}
 
-	id, err := c.productRepo.AddProduct(p)
+	id := -1
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if id, err = repos.Products().AddProduct(p); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventProductCreated, ProductID: id, Name: name, Price: price})
+	})
 	if err != nil {
 		return -1, err
 	}
@@ -167,54 +742,147 @@ func (c *cashierUsecase) NewProduct(name string, price int) (int, error) {
 }
 
 func (c *cashierUsecase) NewBuyProductActivity(startTime time.Time, endTime time.Time, discount int) (int, error) {
+	return c.NewScopedBuyProductActivity(startTime, endTime, discount, domain.ProductScope{})
+}
+
+// NewScopedBuyProductActivity creates a point redemption activity that only covers the products in scope.
+func (c *cashierUsecase) NewScopedBuyProductActivity(startTime time.Time, endTime time.Time, discount int, scope domain.ProductScope) (int, error) {
+	if scope.MinPrice < 0 || scope.MaxPrice < 0 || scope.MaxPrice > 0 && scope.MaxPrice < scope.MinPrice {
+		return -1, errors.New("invalid product scope")
+	}
 	a := domain.BuyProductActivity{
 		PointDiscount: discount,
+		Scope:         scope,
 	}
 	_ = a.SetPeriod(startTime, endTime)
-	aID, _ := c.activityRepo.AddBuyProductActivity(a)
-	return aID, nil
-}
-
-func (c *cashierUsecase) BuyProductWithActivity(userID int, productID int, activityID int) (int, error) {
-	user, err := c.userRepo.GetUser(userID)
+	aID := -1
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if aID, err = repos.Activities().AddBuyProductActivity(a); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventActivityCreated, ActivityID: aID})
+	})
 	if err != nil {
-		fmt.Println(fmt.Sprintf("[MSG] User %d not found", userID))
 		return -1, err
 	}
+	return aID, nil
+}
 
-	product, err := c.productRepo.GetProduct(productID)
+func (c *cashierUsecase) BuyProductWithActivity(userID int, productID int, activityID int, coupon ...string) (int, error) {
+	code, err := couponCode(coupon)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("[MSG] Product %d not found", productID))
 		return -1, err
 	}
-
-	activity, err := c.activityRepo.GetBuyProductActivity(activityID)
+	result, err := c.buyProduct(userID, productID, activityID, code)
 	if err != nil {
-		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
 		return -1, err
 	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d has bought product %d use price %d, point %d", userID, productID, result.Charge, result.Point))
+	return int(result.Charge), nil
+}
 
-	needPoint := product.Price * (100 - activity.GetPointDiscount()) / 100
-	if user.GetPoint() < needPoint {
-		fmt.Println(fmt.Sprintf("[MSG] User %d has not enough point to buy product %d", userID, productID))
-		return -1, errors.New("not enough point")
-	}
+// refundAmount is the part of amount refunded when the refunded percent goes from `from` to `to`,
+// so that refunding 100% in several steps returns exactly amount.
+func refundAmount(amount int64, from, to int) int64 {
+	return amount*int64(to)/100 - amount*int64(from)/100
+}
 
-	// 平台後來新增了另一個收費模式，如果有VIP身份扣100點以上折抵，另外享再九折優惠。
-	var needToken int
-	if user.Member.Level > 0 && needPoint > 100 {
-		needToken = (product.Price - needPoint) * 90 / 100
-	} else {
-		needToken = product.Price - needPoint
+// RefundPurchase returns percent of the tokens and points consumed by a product purchase to the user.
+func (c *cashierUsecase) RefundPurchase(purchaseID int, percent int, reason string) (domain.Transaction, error) {
+	if percent < 1 || percent > 100 {
+		return domain.Transaction{}, errors.New("invalid refund percent")
 	}
 
-	if user.GetToken() < needToken {
-		fmt.Println(fmt.Sprintf("[MSG] User %d has not enough token to buy product %d", userID, productID))
-		return -1, errors.New("not enough token")
+	var entry domain.JournalEntry
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		purchase, err := repos.Ledger().GetEntry(purchaseID)
+		if err != nil || purchase.Type != domain.TransactionBuyProduct {
+			fmt.Println(fmt.Sprintf("[MSG] Purchase %d not found", purchaseID))
+			return errors.New("purchase not found")
+		}
+
+		if _, err := repos.Users().GetUser(purchase.UserID); err != nil {
+			return err
+		}
+
+		refunds, err := repos.Ledger().ListRefunds(purchaseID)
+		if err != nil {
+			return err
+		}
+		refunded := 0
+		for _, r := range refunds {
+			refunded += r.Percent
+		}
+		if refunded+percent > 100 {
+			fmt.Println(fmt.Sprintf("[MSG] Purchase %d has already refunded %d%%", purchaseID, refunded))
+			return domain.ErrPurchaseRefunded
+		}
+
+		account := domain.UserAccount(purchase.UserID)
+		token := refundAmount(-purchase.Movement(account, domain.UnitToken), refunded, refunded+percent)
+		// bonus tokens spent are returned as bonus tokens so they never become refundable
+		bonusToken := refundAmount(-purchase.Movement(account, domain.UnitBonusToken), refunded, refunded+percent)
+		// bonus points given with the purchase are kept by the user, only the points paid are returned
+		point := refundAmount(purchase.Movement(domain.AccountCashierSales, domain.UnitPoint), refunded, refunded+percent)
+		discount := refundAmount(-purchase.Movement(domain.AccountPromotionExpense, domain.UnitToken), refunded, refunded+percent)
+
+		entry = domain.JournalEntry{
+			Type:       domain.TransactionRefund,
+			UserID:     purchase.UserID,
+			ProductID:  purchase.ProductID,
+			ActivityID: purchase.ActivityID,
+			RefundOf:   purchaseID,
+			Percent:    percent,
+			Memo:       reason,
+		}
+		entry.Debit(domain.AccountCashierSales, domain.UnitToken, token+discount)
+		entry.Credit(account, domain.UnitToken, token)
+		entry.Credit(domain.AccountPromotionExpense, domain.UnitToken, discount)
+		entry.Debit(domain.AccountCashierSales, domain.UnitPoint, point)
+		entry.Credit(account, domain.UnitPoint, point)
+		entry.Debit(domain.AccountCashierSales, domain.UnitBonusToken, bonusToken)
+		entry.Credit(account, domain.UnitBonusToken, bonusToken)
+
+		if _, err := repos.Users().AdjustBalance(purchase.UserID, int(token), int(point)); err != nil {
+			return err
+		}
+		if bonusToken > 0 {
+			if _, err := repos.Users().AdjustBonusToken(purchase.UserID, int(bonusToken)); err != nil {
+				return err
+			}
+		}
+		// the product is only back in stock once the whole purchase is refunded, a partial refund keeps it sold
+		if refunded+percent == 100 {
+			if _, err := repos.Products().AdjustStock(purchase.ProductID, 1); err != nil {
+				return err
+			}
+		}
+		if err := post(repos.Ledger(), &entry); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventPurchaseRefunded, UserID: purchase.UserID, ProductID: purchase.ProductID,
+			ActivityID: purchase.ActivityID, Token: token, BonusToken: bonusToken, Point: point})
+	})
+	if err != nil {
+		return domain.Transaction{}, err
 	}
 
-	user.UsePoint(needPoint)
-	user.UseToken(needToken)
-	fmt.Println(fmt.Sprintf("[MSG] User %d has bought product %d use price %d, point %d", userID, productID, needToken, needPoint))
-	return needToken, nil
+	tx := entry.Transaction()
+	fmt.Println(fmt.Sprintf("[MSG] Purchase %d refunded %d%%, token %d, point %d", purchaseID, percent, tx.Token, tx.Point))
+	return tx, nil
+}
+
+// GetTotalSales returns the tokens earned by selling products, net of refunds, bonus tokens spent included.
+// Refunds give tokens back rather than money, so GetTotalAmount is not affected by them.
+func (c *cashierUsecase) GetTotalSales() (int64, error) {
+	token, err := c.ledger().GetBalance(domain.AccountCashierSales, domain.UnitToken)
+	if err != nil {
+		return 0, err
+	}
+	bonus, err := c.ledger().GetBalance(domain.AccountCashierSales, domain.UnitBonusToken)
+	if err != nil {
+		return 0, err
+	}
+	return token + bonus, nil
 }
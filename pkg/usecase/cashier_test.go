@@ -1,13 +1,27 @@
 package usecase
 
 import (
+	"errors"
 	"github.com/stretchr/testify/require"
 	"oa-bitgin/pkg/domain"
 	repo "oa-bitgin/pkg/repository"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+func newTestUnitOfWork() domain.UnitOfWork {
+	return repo.NewMemoryUnitOfWork()
+}
+
+func newTestCashier(t *testing.T, uow domain.UnitOfWork, opts ...Option) domain.CashierUsecase {
+	c, err := NewCashierUsecaseWithUnitOfWork(uow, opts...)
+	require.NoError(t, err)
+	return c
+}
+
 func Test_cashierUsecase_NewUser(t *testing.T) {
 	type fields struct {
 		userRepo domain.UserRepository
@@ -513,3 +527,1964 @@ func Test_cashierUsecase_BuyProductWithActivity(t *testing.T) {
 		})
 	}
 }
+
+func Test_cashierUsecase_Ledger(t *testing.T) {
+	uow := newTestUnitOfWork()
+	ledgerRepo := uow.Ledger()
+	c := newTestCashier(t, uow)
+
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 80)
+	_, err := c.BuyToken(1, 10000)
+	require.NoError(t, err)
+	require.NoError(t, c.AddPoint(1, 1000))
+	_, err = c.BuyProduct(1, 1)
+	require.NoError(t, err)
+	_, err = c.BuyProductWithActivity(1, 1, 1)
+	require.NoError(t, err)
+
+	require.NoError(t, c.ReconcileUser(1))
+	balance := func(account string, unit domain.Unit) int64 {
+		b, err := ledgerRepo.GetBalance(account, unit)
+		require.NoError(t, err)
+		return b
+	}
+	require.Equal(t, int64(8280), balance(domain.UserAccount(1), domain.UnitToken))
+	require.Equal(t, int64(800), balance(domain.UserAccount(1), domain.UnitPoint))
+	require.Equal(t, -c.GetTotalAmount(), balance(domain.AccountCashierRevenue, domain.UnitToken))
+	require.Equal(t, int64(1800), balance(domain.AccountCashierSales, domain.UnitToken))
+	require.Equal(t, int64(200), balance(domain.AccountCashierSales, domain.UnitPoint))
+	require.Equal(t, int64(-580), balance(domain.AccountPromotionExpense, domain.UnitToken))
+
+	entries, err := ledgerRepo.ListEntries(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	require.Equal(t, 1, entries[3].ActivityID)
+}
+
+func Test_cashierUsecase_NewCashierUsecase(t *testing.T) {
+	userRepo := repo.NewUserRepository()
+	c := NewCashierUsecase(userRepo, repo.NewActivityRepository(), repo.NewProductRepository())
+
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_, _ = c.NewBuyTokenActivity(1, time.Now(), time.Now().Add(time.Hour*24*30), 80)
+	got, err := c.BuyTokenWithActivity(1, 10000)
+	require.NoError(t, err)
+	require.Equal(t, 8000, got)
+	_, err = c.BuyProduct(1, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(8000), c.GetTotalAmount())
+
+	// the cashier works on the repositories it was given
+	user, err := userRepo.GetUser(1)
+	require.NoError(t, err)
+	require.Equal(t, 9000, user.GetToken())
+	require.NoError(t, c.ReconcileUser(1))
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 2)
+}
+
+func Test_cashierUsecase_GetUserTransactions(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 80)
+	_, _ = c.BuyToken(1, 10000)
+	_, _ = c.BuyToken(2, 100)
+	_ = c.AddPoint(1, 1000)
+	_, _ = c.BuyProduct(1, 1)
+	_, _ = c.BuyProductWithActivity(1, 1, 1)
+
+	type args struct {
+		userID int
+		filter domain.TransactionFilter
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantIDs    []int
+		wantCursor int
+		wantErr    bool
+	}{
+		{
+			name:    "OKAll",
+			args:    args{userID: 1},
+			wantIDs: []int{1, 3, 4, 5},
+		},
+		{
+			name:    "OKFilterType",
+			args:    args{userID: 1, filter: domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}}},
+			wantIDs: []int{4, 5},
+		},
+		{
+			name:    "OKFilterPeriod",
+			args:    args{userID: 1, filter: domain.TransactionFilter{EndTime: time.Now().Add(-time.Hour)}},
+			wantIDs: []int{},
+		},
+		{
+			name:       "OKFirstPage",
+			args:       args{userID: 1, filter: domain.TransactionFilter{Limit: 2}},
+			wantIDs:    []int{1, 3},
+			wantCursor: 3,
+		},
+		{
+			name:    "OKLastPage",
+			args:    args{userID: 1, filter: domain.TransactionFilter{Limit: 2, Cursor: 3}},
+			wantIDs: []int{4, 5},
+		},
+		{
+			name:    "UserNotFound",
+			args:    args{userID: 3},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.GetUserTransactions(tt.args.userID, tt.args.filter)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetUserTransactions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			ids := make([]int, 0)
+			for _, tx := range got.Transactions {
+				ids = append(ids, tx.ID)
+			}
+			require.Equal(t, tt.wantIDs, ids)
+			require.Equal(t, tt.wantCursor, got.NextCursor)
+		})
+	}
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	last := page.Transactions[3]
+	require.Equal(t, 1, last.ActivityID)
+	require.Equal(t, int64(-720), last.Token)
+	require.Equal(t, int64(-200), last.Point)
+	require.Equal(t, int64(9500), page.Transactions[0].Charged)
+}
+
+// failingActivityInsert is a unit of work whose activity repository fails to add activities.
+type failingActivityInsert struct {
+	domain.UnitOfWork
+}
+
+func (w failingActivityInsert) Do(fn func(repos domain.Repositories) error) error {
+	return w.UnitOfWork.Do(func(repos domain.Repositories) error {
+		return fn(activityInsertFails{repos})
+	})
+}
+
+type activityInsertFails struct {
+	domain.Repositories
+}
+
+func (r activityInsertFails) Activities() domain.ActivityRepository {
+	return failingActivityRepository{r.Repositories.Activities()}
+}
+
+type failingActivityRepository struct {
+	domain.ActivityRepository
+}
+
+func (failingActivityRepository) AddBuyTokenActivity(domain.BuyTokenActivity) (int, error) {
+	return -1, errors.New("insert failed")
+}
+
+func (failingActivityRepository) AddBuyProductActivity(domain.BuyProductActivity) (int, error) {
+	return -1, errors.New("insert failed")
+}
+
+func Test_cashierUsecase_NewActivityInsertFails(t *testing.T) {
+	c := newTestCashier(t, failingActivityInsert{newTestUnitOfWork()})
+	id, err := c.NewStackableBuyTokenActivity(0, time.Now(), time.Now().Add(time.Hour), 90, domain.Stacking{Stackable: true})
+	require.Error(t, err)
+	require.Equal(t, -1, id)
+	id, err = c.NewScopedBuyProductActivity(time.Now(), time.Now().Add(time.Hour), 90, domain.ProductScope{MaxPrice: 500})
+	require.Error(t, err)
+	require.Equal(t, -1, id)
+}
+
+func Test_cashierUsecase_StackableBuyTokenActivity(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	levelID, err := c.NewStackableBuyTokenActivity(1, start, end, 90, domain.Stacking{Stackable: true, Priority: 1})
+	require.NoError(t, err)
+	weekendID, err := c.NewStackableBuyTokenActivity(1, start, end, 80, domain.Stacking{Stackable: true})
+	require.NoError(t, err)
+
+	charged, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 684, charged) // 1000 * 95% * 90% * 80%
+
+	exclusiveID, err := c.NewStackableBuyTokenActivity(1, start, end, 70, domain.Stacking{Exclusive: true})
+	require.NoError(t, err)
+	charged, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 700, charged)
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 2)
+	require.Equal(t, []int{levelID, weekendID}, page.Transactions[0].ActivityIDs)
+	require.Equal(t, []int{exclusiveID}, page.Transactions[1].ActivityIDs)
+}
+
+func Test_cashierUsecase_RefundPurchase(t *testing.T) {
+	type args struct {
+		purchaseID int
+		percent    int
+	}
+	tests := []struct {
+		name       string
+		buildStubs func(usecase domain.CashierUsecase)
+		args       args
+		wantToken  int64
+		wantPoint  int64
+		wantErr    error
+		check      func(t *testing.T, usecase domain.CashierUsecase)
+	}{
+		{
+			name: "OKFullRefund",
+			buildStubs: func(usecase domain.CashierUsecase) {
+				_, _ = usecase.NewUser("testUser1", 0) // id = 1
+				_, _ = usecase.BuyToken(1, 1000)       // tx = 1
+				_, _ = usecase.NewProduct("testProduct1", 100)
+				_, _ = usecase.BuyProduct(1, 1) // tx = 2
+			},
+			args:      args{purchaseID: 2, percent: 100},
+			wantToken: 100,
+			check: func(t *testing.T, usecase domain.CashierUsecase) {
+				remain, _ := usecase.GetUserToken(1)
+				require.Equal(t, 1000, remain)
+				require.Equal(t, int64(1000), usecase.GetTotalAmount())
+				sales, err := usecase.GetTotalSales()
+				require.NoError(t, err)
+				require.Equal(t, int64(0), sales)
+				require.NoError(t, usecase.ReconcileUser(1))
+			},
+		},
+		{
+			name: "OKVIPExtraDiscount",
+			buildStubs: func(usecase domain.CashierUsecase) {
+				_, _ = usecase.NewUser("testUser1", 1) // id = 1
+				_, _ = usecase.BuyToken(1, 10000)      // tx = 1
+				_ = usecase.AddPoint(1, 1000)          // tx = 2
+				_, _ = usecase.NewProduct("testProduct1", 1000)
+				_, _ = usecase.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 80)
+				_, _ = usecase.BuyProductWithActivity(1, 1, 1) // tx = 3
+			},
+			args:      args{purchaseID: 3, percent: 100},
+			wantToken: 720,
+			wantPoint: 200,
+			check: func(t *testing.T, usecase domain.CashierUsecase) {
+				remainToken, _ := usecase.GetUserToken(1)
+				require.Equal(t, 10000, remainToken)
+				remainPoint, _ := usecase.GetUserPoint(1)
+				require.Equal(t, 1000, remainPoint)
+				// VIP1 pays 9500 for 10000 tokens, refunds give back tokens and not money
+				require.Equal(t, int64(9500), usecase.GetTotalAmount())
+				require.NoError(t, usecase.ReconcileUser(1))
+			},
+		},
+		{
+			name: "OKPartialRefunds",
+			buildStubs: func(usecase domain.CashierUsecase) {
+				_, _ = usecase.NewUser("testUser1", 0) // id = 1
+				_, _ = usecase.BuyToken(1, 1000)       // tx = 1
+				_, _ = usecase.NewProduct("testProduct1", 45)
+				_, _ = usecase.BuyProduct(1, 1)          // tx = 2
+				_, _ = usecase.RefundPurchase(2, 50, "") // tx = 3, 22 token
+			},
+			args:      args{purchaseID: 2, percent: 50},
+			wantToken: 23,
+			check: func(t *testing.T, usecase domain.CashierUsecase) {
+				remain, _ := usecase.GetUserToken(1)
+				require.Equal(t, 1000, remain)
+			},
+		},
+		{
+			name: "DoubleRefund",
+			buildStubs: func(usecase domain.CashierUsecase) {
+				_, _ = usecase.NewUser("testUser1", 0) // id = 1
+				_, _ = usecase.BuyToken(1, 1000)       // tx = 1
+				_, _ = usecase.NewProduct("testProduct1", 100)
+				_, _ = usecase.BuyProduct(1, 1)           // tx = 2
+				_, _ = usecase.RefundPurchase(2, 100, "") // tx = 3
+			},
+			args:    args{purchaseID: 2, percent: 10},
+			wantErr: domain.ErrPurchaseRefunded,
+			check: func(t *testing.T, usecase domain.CashierUsecase) {
+				remain, _ := usecase.GetUserToken(1)
+				require.Equal(t, 1000, remain)
+			},
+		},
+		{
+			name: "NotAPurchase",
+			buildStubs: func(usecase domain.CashierUsecase) {
+				_, _ = usecase.NewUser("testUser1", 0) // id = 1
+				_, _ = usecase.BuyToken(1, 1000)       // tx = 1
+			},
+			args:    args{purchaseID: 1, percent: 100},
+			wantErr: errors.New("purchase not found"),
+			check:   func(t *testing.T, usecase domain.CashierUsecase) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCashier(t, newTestUnitOfWork())
+			tt.buildStubs(c)
+			got, err := c.RefundPurchase(tt.args.purchaseID, tt.args.percent, "testReason")
+			tt.check(t, c)
+			if tt.wantErr != nil {
+				require.EqualError(t, err, tt.wantErr.Error())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantToken, got.Token)
+			require.Equal(t, tt.wantPoint, got.Point)
+			require.Equal(t, tt.args.purchaseID, got.RefundOf)
+		})
+	}
+}
+
+func Test_cashierUsecase_Idempotency(t *testing.T) {
+	t.Run("OKRepeat", func(t *testing.T) {
+		c := newTestCashier(t, newTestUnitOfWork())
+		_, _ = c.NewUser("testUser1", 1) // id = 1
+		for i := 0; i < 3; i++ {
+			got, err := c.BuyTokenIdempotent("key1", 1, 100)
+			require.NoError(t, err)
+			require.Equal(t, 95, got)
+		}
+		_, _ = c.BuyTokenIdempotent("key2", 1, 100)
+		remain, _ := c.GetUserToken(1)
+		require.Equal(t, 200, remain)
+		require.Equal(t, int64(190), c.GetTotalAmount())
+
+		_, err := c.BuyTokenIdempotent("key1", 1, 200)
+		require.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	})
+	t.Run("OKRepeatError", func(t *testing.T) {
+		c := newTestCashier(t, newTestUnitOfWork())
+		_, _ = c.NewUser("testUser1", 0) // id = 1
+		_, _ = c.NewProduct("testProduct1", 100)
+		_, err := c.BuyProductIdempotent("key1", 1, 1)
+		require.EqualError(t, err, "not enough token")
+		_, _ = c.BuyToken(1, 1000)
+		_, err = c.BuyProductIdempotent("key1", 1, 1)
+		require.EqualError(t, err, "not enough token")
+		remain, _ := c.GetUserToken(1)
+		require.Equal(t, 1000, remain)
+	})
+	t.Run("OKExpired", func(t *testing.T) {
+		c := newTestCashier(t, newTestUnitOfWork(), WithIdempotencyRetention(time.Millisecond))
+		_, _ = c.NewUser("testUser1", 0) // id = 1
+		_, _ = c.BuyTokenWithActivityIdempotent("key1", 1, 100)
+		time.Sleep(2 * time.Millisecond)
+		_, _ = c.BuyTokenWithActivityIdempotent("key1", 1, 100)
+		remain, _ := c.GetUserToken(1)
+		require.Equal(t, 200, remain)
+	})
+	t.Run("OKConcurrent", func(t *testing.T) {
+		c := newTestCashier(t, newTestUnitOfWork())
+		_, _ = c.NewUser("testUser1", 0) // id = 1
+		_, _ = c.BuyToken(1, 1000)
+		_ = c.AddPoint(1, 1000)
+		_, _ = c.NewProduct("testProduct1", 100)
+		_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 90)
+
+		gots := make([]int, 50)
+		errs := make([]error, 50)
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				gots[i], errs[i] = c.BuyProductWithActivityIdempotent("key1", 1, 1, 1)
+			}(i)
+		}
+		wg.Wait()
+		for i := range gots {
+			require.NoError(t, errs[i])
+			require.Equal(t, 90, gots[i])
+		}
+		remain, _ := c.GetUserToken(1)
+		require.Equal(t, 910, remain)
+		require.NoError(t, c.ReconcileUser(1))
+	})
+	t.Run("OKRetryAfterPanic", func(t *testing.T) {
+		s := newIdempotencyStore(DefaultIdempotencyRetention)
+		require.Panics(t, func() {
+			_, _ = s.do("key1", "request1", func() (int, error) { panic("testPanic") })
+		})
+		got, err := s.do("key1", "request1", func() (int, error) { return 100, nil })
+		require.NoError(t, err)
+		require.Equal(t, 100, got)
+	})
+}
+
+func Test_cashierUsecase_ConcurrentBuyProduct(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.BuyToken(1, 10000)
+	_ = c.AddPoint(1, 1000)
+	_, _ = c.NewProduct("testProduct1", 100)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 90)
+
+	var spent int64
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var got int
+			var err error
+			if i%2 == 0 {
+				got, err = c.BuyProduct(1, 1)
+			} else {
+				got, err = c.BuyProductWithActivity(1, 1, 1)
+			}
+			if err == nil {
+				atomic.AddInt64(&spent, int64(got))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	remainToken, _ := c.GetUserToken(1)
+	remainPoint, _ := c.GetUserPoint(1)
+	require.GreaterOrEqual(t, remainToken, 0)
+	require.GreaterOrEqual(t, remainPoint, 0)
+	require.Less(t, remainToken, 100)
+	require.Equal(t, int64(10000)-spent, int64(remainToken))
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_GetStateAt(t *testing.T) {
+	dir := t.TempDir()
+	store, err := repo.NewFileEventStore(dir)
+	require.NoError(t, err)
+	c := newTestCashier(t, newTestUnitOfWork(), WithEventStore(store, 3))
+	clock := time.Now()
+	c.(*cashierUsecase).events.now = func() time.Time { return clock }
+
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.BuyToken(1, 1000)
+	_ = c.AddPoint(1, 100)
+	before := clock
+	clock = clock.Add(time.Second)
+
+	_, _ = c.NewProduct("testProduct1", 100)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour*24*30), 90)
+	_, _ = c.BuyProductWithActivity(1, 1, 1)
+	_, _ = c.BuyToken(2, 500)
+	_, _ = c.BuyProduct(2, 1)
+
+	state, err := c.GetStateAt(before)
+	require.NoError(t, err)
+	require.Equal(t, int64(950), state.TotalAmount)
+	require.Equal(t, domain.UserState{Name: "testUser1", MemberLevel: 1, Token: 1000, Point: 100}, state.Users[1])
+	require.Equal(t, domain.UserState{Name: "testUser2"}, state.Users[2])
+
+	state, err = c.GetStateAt(clock)
+	require.NoError(t, err)
+	require.Equal(t, c.GetTotalAmount(), state.TotalAmount)
+	require.Equal(t, int64(910), state.Users[1].Token)
+	require.Equal(t, int64(90), state.Users[1].Point)
+	require.Equal(t, int64(400), state.Users[2].Token)
+	require.NoError(t, store.Close())
+
+	// the log does not rebuild in-memory repositories, the users it records would be mixed with new ones
+	store, err = repo.NewFileEventStore(dir)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = NewCashierUsecaseWithUnitOfWork(newTestUnitOfWork(), WithEventStore(store, 3))
+	require.Error(t, err)
+}
+
+// failingCommit is a unit of work whose commit fails after fn succeeds, the changes are rolled back.
+type failingCommit struct {
+	domain.UnitOfWork
+	fail           bool
+	beforeRollback func()
+}
+
+func (w *failingCommit) Do(fn func(repos domain.Repositories) error) error {
+	return w.UnitOfWork.Do(func(repos domain.Repositories) error {
+		if err := fn(repos); err != nil || !w.fail {
+			return err
+		}
+		if w.beforeRollback != nil {
+			w.beforeRollback()
+		}
+		return errors.New("commit failed")
+	})
+}
+
+func Test_cashierUsecase_GetStateAtRollback(t *testing.T) {
+	store, err := repo.NewFileEventStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	uow := &failingCommit{UnitOfWork: newTestUnitOfWork()}
+	c := newTestCashier(t, uow, WithEventStore(store, 0))
+
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewProduct("testProduct1", 100)
+	_, err = c.BuyToken(1, 1000)
+	require.NoError(t, err)
+
+	uow.fail = true
+	_, err = c.BuyToken(1, 500)
+	require.Error(t, err)
+	_, err = c.BuyProduct(1, 1)
+	require.Error(t, err)
+	require.Error(t, c.AddPoint(1, 100))
+	uow.fail = false
+	_, err = c.BuyProduct(1, 1)
+	require.NoError(t, err)
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	require.NoError(t, err)
+	require.Len(t, page.Transactions, 1)
+	_, err = c.RefundPurchase(page.Transactions[0].ID, 100, "testReason")
+	require.NoError(t, err)
+
+	token, err := c.GetUserToken(1)
+	require.NoError(t, err)
+	require.Equal(t, 1000, token)
+	state, err := c.GetStateAt(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), state.Users[1].Token)
+	require.Equal(t, int64(0), state.Users[1].Point)
+	require.Equal(t, int64(1000), state.TotalAmount)
+	require.Equal(t, c.GetTotalAmount(), state.TotalAmount)
+}
+
+// failingEventStore is an event store whose writes fail while fail is set.
+type failingEventStore struct {
+	domain.EventStore
+	fail bool
+}
+
+func (s *failingEventStore) Append(event domain.Event) (domain.Event, error) {
+	if s.fail {
+		return event, errors.New("append failed")
+	}
+	return s.EventStore.Append(event)
+}
+
+func (s *failingEventStore) SaveSnapshot(state domain.CashierState) error {
+	if s.fail {
+		return errors.New("snapshot failed")
+	}
+	return s.EventStore.SaveSnapshot(state)
+}
+
+func Test_cashierUsecase_EventStoreFailure(t *testing.T) {
+	fileStore, err := repo.NewFileEventStore(t.TempDir())
+	require.NoError(t, err)
+	defer fileStore.Close()
+	store := &failingEventStore{EventStore: fileStore}
+	c := newTestCashier(t, newTestUnitOfWork(), WithEventStore(store, 1))
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+
+	// committed work is not reported as failed, its events wait for the store
+	store.fail = true
+	got, err := c.BuyToken(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+	require.NoError(t, c.AddPoint(1, 100))
+	require.Equal(t, int64(1000), c.GetTotalAmount())
+	_, err = c.GetStateAt(time.Now())
+	require.Error(t, err)
+
+	store.fail = false
+	state, err := c.GetStateAt(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, int64(3), state.Seq)
+	require.Equal(t, int64(1000), state.TotalAmount)
+	require.Equal(t, domain.UserState{Name: "testUser1", Token: 1000, Point: 100}, state.Users[1])
+}
+
+func Test_cashierUsecase_AdminWritesDuringRollback(t *testing.T) {
+	base := newTestUnitOfWork()
+	c := newTestCashier(t, base)
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 10000)
+	_ = c.AddPoint(1, 10000)
+	_, _ = c.NewProduct("testProduct1", 100)
+	_, _ = c.NewBuyProductActivity(time.Now(), time.Now().Add(time.Hour), 80)
+	require.NoError(t, c.SetProductStock(1, 10, 0))
+
+	// the admin changes the budget and stock while a purchase that consumed them is about to roll back,
+	// the rollback must not undo the admin's changes
+	done := make(chan struct{})
+	uow := &failingCommit{UnitOfWork: base, fail: true, beforeRollback: func() {
+		go func() {
+			defer close(done)
+			_ = c.SetActivityBudget(domain.ActivityBuyProduct, 1, domain.Budget{MaxRedemptions: 100})
+			_ = c.SetProductStock(1, 20, 0)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}}
+	_, err := newTestCashier(t, uow).BuyProductWithActivity(1, 1, 1)
+	require.Error(t, err)
+	<-done
+
+	status, err := c.GetActivityBudget(domain.ActivityBuyProduct, 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.Budget{MaxRedemptions: 100}, status.Budget)
+	require.Equal(t, domain.BudgetUsage{}, status.Used)
+	product, err := c.GetProduct(1)
+	require.NoError(t, err)
+	require.Equal(t, 20, product.Stock)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 10000, token)
+}
+
+func Test_cashierUsecase_Coupon(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewUser("testUser3", 0) // id = 3
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_, _ = c.BuyToken(1, 10000)
+
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	discountID, discountCodes, err := c.NewCouponBatch(domain.CouponBatch{Name: "90%", Kind: domain.CouponDiscount, Value: 90,
+		StartDate: start, EndDate: end, MaxUses: 2, PerUserLimit: 1}, 1)
+	require.NoError(t, err)
+	_, bonusCodes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponPointBonus, Value: 50, StartDate: start, EndDate: end}, 1)
+	require.NoError(t, err)
+	_, offCodes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponTokenOff, Value: 300, StartDate: start, EndDate: end}, 1)
+	require.NoError(t, err)
+	_, expiredCodes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponTokenOff, Value: 300,
+		StartDate: start.Add(-time.Hour), EndDate: start}, 1)
+	require.NoError(t, err)
+	_, _, err = c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponDiscount, Value: 120, StartDate: start, EndDate: end}, 1)
+	require.Error(t, err)
+
+	// codes are typed by users, case and dashes do not matter
+	typed := strings.ToLower(strings.ReplaceAll(discountCodes[0], "-", ""))
+
+	tests := []struct {
+		name    string
+		buy     func() (int, error)
+		want    int
+		wantErr error
+	}{
+		{
+			name: "OKDiscount",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000, typed) },
+			want: 855, // 1000 * 95% * 90%
+		},
+		{
+			name:    "PerUserLimit",
+			buy:     func() (int, error) { return c.BuyTokenWithActivity(1, 1000, discountCodes[0]) },
+			wantErr: domain.ErrCouponUserLimit,
+		},
+		{
+			name: "OKSecondUse",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(2, 1000, discountCodes[0]) },
+			want: 900,
+		},
+		{
+			name:    "UsedUp",
+			buy:     func() (int, error) { return c.BuyTokenWithActivity(3, 1000, discountCodes[0]) },
+			wantErr: domain.ErrCouponUsedUp,
+		},
+		{
+			name:    "Expired",
+			buy:     func() (int, error) { return c.BuyProduct(1, 1, expiredCodes[0]) },
+			wantErr: domain.ErrCouponExpired,
+		},
+		{
+			name:    "NotFound",
+			buy:     func() (int, error) { return c.BuyProduct(1, 1, "AAAA-AAAA") },
+			wantErr: domain.ErrCouponNotFound,
+		},
+		{
+			name: "OKTokenOff",
+			buy:  func() (int, error) { return c.BuyProduct(1, 1, offCodes[0]) },
+			want: 700,
+		},
+		{
+			name: "OKPointBonus",
+			buy:  func() (int, error) { return c.BuyProduct(1, 1, bonusCodes[0]) },
+			want: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	// failed redemptions rolled back the purchase
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 10000+1000-700-1000, token)
+	point, _ := c.GetUserPoint(1)
+	require.Equal(t, 50, point)
+	require.NoError(t, c.ReconcileUser(1))
+
+	report, err := c.GetCouponReport(discountID)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Issued)
+	require.Equal(t, 2, report.Redeemed)
+	require.Equal(t, int64(95+100), report.TotalDiscount)
+	require.Equal(t, []int{1, 2}, []int{report.Redemptions[0].UserID, report.Redemptions[1].UserID})
+}
+
+func Test_cashierUsecase_CouponWithoutActivity(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewBuyTokenActivity(0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 80)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	_, codes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponDiscount, Value: 90, StartDate: start, EndDate: end, MaxUses: 3}, 2)
+	require.NoError(t, err)
+
+	// the coupon does not turn activities on, the purchase path chooses
+	got, err := c.BuyToken(1, 1000, codes[0])
+	require.NoError(t, err)
+	require.Equal(t, 900, got)
+	got, err = c.BuyTokenWithActivity(1, 1000, codes[0])
+	require.NoError(t, err)
+	require.Equal(t, 720, got) // 1000 * 80% * 90%
+	got, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 800, got)
+
+	_, err = c.BuyToken(1, 1000, codes[0], codes[1])
+	require.Error(t, err)
+	report, err := c.GetCouponReport(1)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Redeemed)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_ActivityBudget(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	_, _ = c.NewProduct("testProduct1", 1000)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	bestID, _ := c.NewBuyTokenActivity(1, start, end, 50)
+	nextID, _ := c.NewBuyTokenActivity(1, start, end, 80)
+	productActivityID, _ := c.NewBuyProductActivity(start, end, 80)
+
+	_ = c.AddPoint(1, 1000)
+
+	// 1000 tokens at 50% instead of the member price 950 gives 450, the budget covers two such purchases
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyToken, bestID, domain.Budget{MaxDiscount: 1200}))
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyToken, nextID, domain.Budget{MaxRedemptions: 1}))
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyProduct, productActivityID, domain.Budget{MaxRedemptions: 1}))
+	require.Error(t, c.SetActivityBudget(domain.ActivityBuyToken, 100, domain.Budget{MaxRedemptions: 1}))
+
+	tests := []struct {
+		name    string
+		buy     func() (int, error)
+		want    int
+		wantErr error
+	}{
+		{
+			name: "OKBest",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 500,
+		},
+		{
+			name: "OKBestAgain",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 500,
+		},
+		{
+			name: "OKFallbackWhenBudgetCannotCover",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 800,
+		},
+		{
+			name: "OKBestStillCoversSmallPurchase",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 400) },
+			want: 200,
+		},
+		{
+			name: "OKAllExhausted",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 950,
+		},
+		{
+			name: "OKProductActivity",
+			buy:  func() (int, error) { return c.BuyProductWithActivity(1, 1, productActivityID) },
+			want: 720,
+		},
+		{
+			name:    "ProductActivityExhausted",
+			buy:     func() (int, error) { return c.BuyProductWithActivity(1, 1, productActivityID) },
+			wantErr: domain.ErrActivityBudgetExhausted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	status, err := c.GetActivityBudget(domain.ActivityBuyToken, bestID)
+	require.NoError(t, err)
+	require.Equal(t, domain.BudgetUsage{Discount: 450 + 450 + 180, Redemptions: 3}, status.Used)
+	require.Equal(t, int64(120), status.RemainingDiscount)
+	require.Equal(t, -1, status.RemainingRedemptions)
+	status, err = c.GetActivityBudget(domain.ActivityBuyProduct, productActivityID)
+	require.NoError(t, err)
+	require.Equal(t, 0, status.RemainingRedemptions)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_ConcurrentActivityBudget(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	activityID, _ := c.NewBuyTokenActivity(0, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 90)
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyToken, activityID, domain.Budget{MaxRedemptions: 10}))
+
+	var wg sync.WaitGroup
+	var discounted, failed int64
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			charged, err := c.BuyTokenWithActivity(1, 100)
+			if err != nil {
+				atomic.AddInt64(&failed, 1)
+			} else if charged == 90 {
+				atomic.AddInt64(&discounted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(0), failed)
+
+	require.Equal(t, int64(10), discounted)
+	status, err := c.GetActivityBudget(domain.ActivityBuyToken, activityID)
+	require.NoError(t, err)
+	require.Equal(t, 0, status.RemainingRedemptions)
+}
+
+func Test_cashierUsecase_ActivityUserLimit(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewProduct("testProduct1", 1000)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	bestID, _ := c.NewBuyTokenActivity(0, start, end, 50)
+	nextID, _ := c.NewBuyTokenActivity(0, start, end, 80)
+	productActivityID, _ := c.NewBuyProductActivity(start, end, 80)
+	_ = c.AddPoint(1, 1000)
+
+	require.NoError(t, c.SetActivityUserLimit(domain.ActivityBuyToken, bestID, domain.Budget{MaxRedemptions: 2}))
+	require.NoError(t, c.SetActivityUserLimit(domain.ActivityBuyToken, nextID, domain.Budget{MaxDiscount: 300}))
+	require.NoError(t, c.SetActivityUserLimit(domain.ActivityBuyProduct, productActivityID, domain.Budget{MaxRedemptions: 1}))
+
+	tests := []struct {
+		name string
+		buy  func() (int, error)
+		want int
+	}{
+		{
+			name: "OKBest",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 500,
+		},
+		{
+			name: "OKBestAgain",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 500,
+		},
+		{
+			name: "OKFallbackToNext",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 800,
+		},
+		{
+			name: "OKFallbackToDefault",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want: 1000,
+		},
+		{
+			name: "OKOtherUserUnaffected",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(2, 1000) },
+			want: 500,
+		},
+		{
+			name: "OKProductActivity",
+			buy:  func() (int, error) { return c.BuyProductWithActivity(1, 1, productActivityID) },
+			want: 800,
+		},
+		{
+			name: "OKProductWithoutActivity",
+			buy:  func() (int, error) { return c.BuyProductWithActivity(1, 1, productActivityID) },
+			want: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	usage, err := c.GetActivityUserUsage(domain.ActivityBuyToken, nextID, 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.BudgetUsage{Discount: 200, Redemptions: 1}, usage.Used)
+	require.Equal(t, int64(100), usage.RemainingDiscount)
+	usage, err = c.GetActivityUserUsage(domain.ActivityBuyToken, bestID, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, usage.RemainingRedemptions)
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	require.NoError(t, err)
+	require.Equal(t, productActivityID, page.Transactions[0].ActivityID)
+	require.Equal(t, 0, page.Transactions[1].ActivityID)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_VolumeTiers(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewBuyTokenActivity(1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), 80)
+	require.Error(t, c.SetVolumeTiers(1, []domain.VolumeTier{{MinToken: 1000, Discount: 0}}))
+	require.Error(t, c.SetVolumeTiers(1, []domain.VolumeTier{{MinToken: 1000, Discount: 97}, {MinToken: 1000, Discount: 93}}))
+	require.NoError(t, c.SetVolumeTiers(1, []domain.VolumeTier{{MinToken: 10000, Discount: 93}, {MinToken: 1000, Discount: 97}}))
+
+	tiers, err := c.GetVolumeTiers(1)
+	require.NoError(t, err)
+	require.Equal(t, []domain.VolumeTier{{MemberLevel: 1, MinToken: 1000, Discount: 97}, {MemberLevel: 1, MinToken: 10000, Discount: 93}}, tiers)
+
+	tests := []struct {
+		name string
+		buy  func() (int, error)
+		want int
+	}{
+		{
+			name: "OKBelowTiers",
+			buy:  func() (int, error) { return c.BuyToken(1, 100) },
+			want: 95,
+		},
+		{
+			name: "OKFirstTier",
+			buy:  func() (int, error) { return c.BuyToken(1, 1000) },
+			want: 921, // 1000 * 95% * 97%
+		},
+		{
+			name: "OKSecondTier",
+			buy:  func() (int, error) { return c.BuyToken(1, 10000) },
+			want: 8835, // 10000 * 95% * 93%
+		},
+		{
+			name: "OKTierWithActivity",
+			buy:  func() (int, error) { return c.BuyTokenWithActivity(1, 10000) },
+			want: 7440, // 10000 * 80% * 93%
+		},
+		{
+			name: "OKOtherLevelHasNoTiers",
+			buy:  func() (int, error) { return c.BuyToken(2, 10000) },
+			want: 10000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_BonusActivity(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewProduct("testProduct1", 300)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	_, err := c.NewBonusActivity(start, end, domain.BonusActivity{Threshold: 0, BonusToken: 100})
+	require.Error(t, err)
+	bonusID, err := c.NewBonusActivity(start, end, domain.BonusActivity{Threshold: 1000, BonusToken: 100, BonusPoint: 10, MaxBonusToken: 200})
+	require.NoError(t, err)
+	require.NoError(t, c.SetActivityUserLimit(domain.ActivityBonus, bonusID, domain.Budget{MaxRedemptions: 2}))
+
+	tests := []struct {
+		name      string
+		buy       func() (int, error)
+		want      int
+		wantToken int
+		wantBonus int
+	}{
+		{
+			name:      "OKNoBonusWithoutActivity",
+			buy:       func() (int, error) { return c.BuyToken(1, 1000) },
+			want:      1000,
+			wantToken: 1000,
+		},
+		{
+			name:      "OKBonus",
+			buy:       func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want:      1000,
+			wantToken: 2000,
+			wantBonus: 100,
+		},
+		{
+			name:      "OKBonusCapped",
+			buy:       func() (int, error) { return c.BuyTokenWithActivity(1, 5000) },
+			want:      5000,
+			wantToken: 7000,
+			wantBonus: 300,
+		},
+		{
+			name:      "OKUserLimitReached",
+			buy:       func() (int, error) { return c.BuyTokenWithActivity(1, 1000) },
+			want:      1000,
+			wantToken: 8000,
+			wantBonus: 300,
+		},
+		{
+			name:      "OKProductSpendsBonusFirst",
+			buy:       func() (int, error) { return c.BuyProduct(1, 1) },
+			want:      300,
+			wantToken: 8000,
+			wantBonus: 0,
+		},
+		{
+			name:      "OKProductSpendsTokenAfterBonus",
+			buy:       func() (int, error) { return c.BuyProduct(1, 1) },
+			want:      300,
+			wantToken: 7700,
+			wantBonus: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			token, _ := c.GetUserToken(1)
+			require.Equal(t, tt.wantToken, token)
+			bonus, _ := c.GetUserBonusToken(1)
+			require.Equal(t, tt.wantBonus, bonus)
+			require.NoError(t, c.ReconcileUser(1))
+		})
+	}
+	point, _ := c.GetUserPoint(1)
+	require.Equal(t, 60, point) // bonus points are not capped
+	usage, err := c.GetActivityUserUsage(domain.ActivityBonus, bonusID, 1)
+	require.NoError(t, err)
+	require.Equal(t, domain.BudgetUsage{Discount: 360, Redemptions: 2}, usage.Used)
+	sales, err := c.GetTotalSales()
+	require.NoError(t, err)
+	require.Equal(t, int64(600), sales)
+
+	page, err := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), page.Transactions[0].Token)
+	require.Equal(t, int64(-300), page.Transactions[0].BonusToken)
+
+	// bonus tokens spent come back as bonus tokens, never as tokens that could be refunded
+	refund, err := c.RefundPurchase(page.Transactions[0].ID, 100, "testReason")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), refund.Token)
+	require.Equal(t, int64(300), refund.BonusToken)
+	bonus, _ := c.GetUserBonusToken(1)
+	require.Equal(t, 300, bonus)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 7700, token)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_ScopedBuyProductActivity(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 10000)
+	_ = c.AddPoint(1, 10000)
+	bookID, _ := c.NewCategorizedProduct("testBook", 1000, "book")
+	gameID, _ := c.NewCategorizedProduct("testGame", 1000, "game")
+	expensiveBookID, _ := c.NewCategorizedProduct("testExpensiveBook", 5000, "book")
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	_, err := c.NewScopedBuyProductActivity(start, end, 80, domain.ProductScope{MinPrice: 2000, MaxPrice: 1000})
+	require.Error(t, err)
+	bookActivityID, _ := c.NewScopedBuyProductActivity(start, end, 80, domain.ProductScope{Categories: []string{"book"}, MaxPrice: 2000})
+	gameActivityID, _ := c.NewScopedBuyProductActivity(start, end, 80, domain.ProductScope{ProductIDs: []int{gameID}})
+	anyActivityID, _ := c.NewBuyProductActivity(start, end, 80)
+
+	tests := []struct {
+		name       string
+		productID  int
+		activityID int
+		want       int
+		wantErr    error
+	}{
+		{
+			name:       "OKCategory",
+			productID:  bookID,
+			activityID: bookActivityID,
+			want:       800,
+		},
+		{
+			name:       "FailedOtherCategory",
+			productID:  gameID,
+			activityID: bookActivityID,
+			want:       -1,
+			wantErr:    domain.ErrActivityNotApplicable,
+		},
+		{
+			name:       "FailedAbovePriceRange",
+			productID:  expensiveBookID,
+			activityID: bookActivityID,
+			want:       -1,
+			wantErr:    domain.ErrActivityNotApplicable,
+		},
+		{
+			name:       "OKProduct",
+			productID:  gameID,
+			activityID: gameActivityID,
+			want:       800,
+		},
+		{
+			name:       "FailedOtherProduct",
+			productID:  bookID,
+			activityID: gameActivityID,
+			want:       -1,
+			wantErr:    domain.ErrActivityNotApplicable,
+		},
+		{
+			name:       "OKUnscoped",
+			productID:  expensiveBookID,
+			activityID: anyActivityID,
+			want:       4000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.BuyProductWithActivity(1, tt.productID, tt.activityID)
+			require.ErrorIs(t, err, tt.wantErr)
+			require.Equal(t, tt.want, got)
+		})
+	}
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_ActivitySchedule(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_ = c.AddPoint(1, 1000)
+	_, _ = c.BuyToken(1, 10000)
+	now := time.Now().UTC()
+	start, end := now.Add(-time.Hour*24*7), now.Add(time.Hour*24*7)
+	hour := time.Duration(now.Hour()) * time.Hour
+	running := &domain.Schedule{Frequency: domain.FrequencyDaily, StartTime: (hour + 23*time.Hour) % (24 * time.Hour), Duration: 2 * time.Hour}
+	later := &domain.Schedule{Frequency: domain.FrequencyDaily, StartTime: (hour + 2*time.Hour) % (24 * time.Hour), Duration: time.Hour}
+
+	runningID, _ := c.NewBuyTokenActivity(0, start, end, 90)
+	laterID, _ := c.NewBuyTokenActivity(0, start, end, 50)
+	productActivityID, _ := c.NewBuyProductActivity(start, end, 80)
+	require.ErrorIs(t, c.SetActivitySchedule(domain.ActivityBuyToken, runningID, &domain.Schedule{Frequency: domain.FrequencyWeekly}),
+		domain.ErrInvalidSchedule)
+	require.NoError(t, c.SetActivitySchedule(domain.ActivityBuyToken, runningID, running))
+	require.NoError(t, c.SetActivitySchedule(domain.ActivityBuyToken, laterID, later))
+	require.NoError(t, c.SetActivitySchedule(domain.ActivityBuyProduct, productActivityID, later))
+
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 900, got)
+	_, err = c.BuyProductWithActivity(1, 1, productActivityID)
+	require.ErrorIs(t, err, domain.ErrActivityNotRunning)
+
+	occurrences, err := c.ListActivityOccurrences(domain.ActivityBuyToken, laterID, now, 3)
+	require.NoError(t, err)
+	require.Len(t, occurrences, 3)
+	require.True(t, occurrences[0].Start.After(now))
+	require.Equal(t, 24*time.Hour, occurrences[1].Start.Sub(occurrences[0].Start))
+	require.Equal(t, time.Hour, occurrences[0].End.Sub(occurrences[0].Start))
+
+	// removing the schedule makes the activity run for its whole period again
+	require.NoError(t, c.SetActivitySchedule(domain.ActivityBuyToken, laterID, nil))
+	got, err = c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 500, got)
+	occurrences, err = c.ListActivityOccurrences(domain.ActivityBuyToken, laterID, now, 3)
+	require.NoError(t, err)
+	require.Equal(t, []domain.Occurrence{{Start: start, End: end}}, occurrences)
+}
+
+func Test_cashierUsecase_ActivityLifecycle(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_ = c.AddPoint(1, 1000)
+	_, _ = c.BuyToken(1, 10000)
+	now := time.Now()
+	tokenID, _ := c.NewBuyTokenActivity(1, now.Add(-time.Hour), now.Add(time.Hour), 80)
+	otherLevelID, _ := c.NewBuyTokenActivity(2, now.Add(-time.Hour), now.Add(time.Hour), 70)
+	futureID, _ := c.NewBuyTokenActivity(1, now.Add(time.Hour*24), now.Add(time.Hour*48), 50)
+	productID, _ := c.NewBuyProductActivity(now.Add(-time.Hour), now.Add(time.Hour), 80)
+
+	ids := func(activities []domain.BuyTokenActivity) []int {
+		rtn := make([]int, 0)
+		for _, a := range activities {
+			rtn = append(rtn, a.GetID())
+		}
+		return rtn
+	}
+	listed, err := c.ListBuyTokenActivities(domain.ActivityFilter{RunningAt: now})
+	require.NoError(t, err)
+	require.Equal(t, []int{tokenID, otherLevelID}, ids(listed))
+	listed, _ = c.ListBuyTokenActivities(domain.ActivityFilter{MemberLevels: []int{1}})
+	require.Equal(t, []int{tokenID, futureID}, ids(listed))
+	listed, _ = c.ListBuyTokenActivities(domain.ActivityFilter{StartTime: now.Add(time.Hour * 2)})
+	require.Equal(t, []int{futureID}, ids(listed))
+
+	// edit the discount and the period
+	require.Error(t, c.UpdateActivityDiscount(domain.ActivityBuyToken, tokenID, 0))
+	require.NoError(t, c.UpdateActivityDiscount(domain.ActivityBuyToken, tokenID, 60))
+	got, err := c.BuyTokenWithActivity(1, 1000)
+	require.NoError(t, err)
+	require.Equal(t, 600, got)
+	require.NoError(t, c.UpdateActivityPeriod(domain.ActivityBuyToken, futureID, now.Add(-time.Hour), now.Add(time.Hour)))
+	got, _ = c.BuyTokenWithActivity(1, 1000)
+	require.Equal(t, 500, got)
+
+	// a paused activity is not applied until it is resumed
+	require.NoError(t, c.PauseActivity(domain.ActivityBuyToken, futureID))
+	require.ErrorIs(t, c.PauseActivity(domain.ActivityBuyToken, futureID), domain.ErrActivityState)
+	got, _ = c.BuyTokenWithActivity(1, 1000)
+	require.Equal(t, 600, got)
+	require.NoError(t, c.ResumeActivity(domain.ActivityBuyToken, futureID))
+	got, _ = c.BuyTokenWithActivity(1, 1000)
+	require.Equal(t, 500, got)
+
+	// canceled activities cannot come back nor be edited
+	require.NoError(t, c.CancelActivity(domain.ActivityBuyToken, futureID, "testReason"))
+	require.ErrorIs(t, c.ResumeActivity(domain.ActivityBuyToken, futureID), domain.ErrActivityState)
+	require.ErrorIs(t, c.UpdateActivityDiscount(domain.ActivityBuyToken, futureID, 40), domain.ErrActivityState)
+	got, _ = c.BuyTokenWithActivity(1, 1000)
+	require.Equal(t, 600, got)
+
+	require.NoError(t, c.PauseActivity(domain.ActivityBuyProduct, productID))
+	_, err = c.BuyProductWithActivity(1, 1, productID)
+	require.ErrorIs(t, err, domain.ErrActivityNotRunning)
+	require.NoError(t, c.DeleteActivity(domain.ActivityBuyProduct, productID, "testReason"))
+	products, err := c.ListBuyProductActivities(domain.ActivityFilter{})
+	require.NoError(t, err)
+	require.Empty(t, products)
+	products, _ = c.ListBuyProductActivities(domain.ActivityFilter{IncludeDeleted: true})
+	require.Len(t, products, 1)
+	deleted, err := c.GetBuyProductActivity(productID)
+	require.NoError(t, err)
+	require.Equal(t, domain.ActivityDeleted, deleted.GetState())
+
+	history, err := c.GetActivityHistory(domain.ActivityBuyToken, futureID)
+	require.NoError(t, err)
+	actions := make([]domain.ActivityAction, 0)
+	for _, h := range history {
+		actions = append(actions, h.Action)
+	}
+	require.Equal(t, []domain.ActivityAction{domain.ActionUpdatePeriod, domain.ActionPause, domain.ActionResume, domain.ActionCancel}, actions)
+	require.Equal(t, "testReason", history[3].Reason)
+	require.Equal(t, "state running -> canceled", history[3].Detail)
+	history, _ = c.GetActivityHistory(domain.ActivityBuyToken, tokenID)
+	require.Equal(t, "discount 80 -> 60", history[0].Detail)
+	_, err = c.GetActivityHistory(domain.ActivityBuyToken, 99)
+	require.Error(t, err)
+}
+
+func Test_cashierUsecase_Quote(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	_, _ = c.NewUser("testUser2", 1) // id = 2
+	_, _ = c.NewProduct("testProduct1", 1000)
+	_ = c.AddPoint(1, 1000)
+	_, _ = c.BuyToken(1, 10000)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tokenActivityID, _ := c.NewBuyTokenActivity(1, start, end, 80)
+	productActivityID, _ := c.NewBuyProductActivity(start, end, 80)
+	require.NoError(t, c.SetActivityBudget(domain.ActivityBuyToken, tokenActivityID, domain.Budget{MaxRedemptions: 5}))
+
+	quote, err := c.QuoteBuyToken(1, 1000, 0)
+	require.NoError(t, err)
+	require.Empty(t, quote.ID)
+	require.Equal(t, int64(1000), quote.ListPrice)
+	require.Equal(t, int64(800), quote.Charge)
+	require.Equal(t, []int{tokenActivityID}, quote.ActivityIDs)
+	require.Equal(t, []domain.QuoteLine{{Rule: "member_level_discount", Discount: 50}, {Rule: "buy_token_activity", ActivityID: tokenActivityID, Discount: 150}},
+		quote.Lines)
+
+	quote, err = c.QuoteBuyProduct(1, 1, productActivityID, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(720), quote.Charge) // the VIP extra 10% off
+	require.Equal(t, int64(200), quote.Point)
+	require.Len(t, quote.Lines, 2)
+	require.Equal(t, "point_redemption", quote.Lines[0].Rule)
+	require.Equal(t, int64(200), quote.Lines[0].Point)
+	require.Equal(t, "vip_point_bonus", quote.Lines[1].Rule)
+	require.Equal(t, int64(80), quote.Lines[1].Discount)
+
+	// quoting has no side effects and matches the purchase
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 10000, token)
+	status, _ := c.GetActivityBudget(domain.ActivityBuyToken, tokenActivityID)
+	require.Equal(t, 0, status.Used.Redemptions)
+	got, err := c.BuyProductWithActivity(1, 1, productActivityID)
+	require.NoError(t, err)
+	require.Equal(t, int(quote.Charge), got)
+
+	_, err = c.QuoteBuyProduct(1, 99, 0, 0)
+	require.Error(t, err)
+
+	// a held quote is honored after the activity stops, once, by the user it was given to
+	held, err := c.QuoteBuyToken(1, 1000, time.Minute)
+	require.NoError(t, err)
+	require.NotEmpty(t, held.ID)
+	require.NoError(t, c.PauseActivity(domain.ActivityBuyToken, tokenActivityID))
+	_, err = c.BuyWithQuote(2, held.ID)
+	require.ErrorIs(t, err, domain.ErrQuoteNotFound)
+	got, err = c.BuyWithQuote(1, held.ID)
+	require.NoError(t, err)
+	require.Equal(t, 800, got)
+	_, err = c.BuyWithQuote(1, held.ID)
+	require.ErrorIs(t, err, domain.ErrQuoteNotFound)
+	status, _ = c.GetActivityBudget(domain.ActivityBuyToken, tokenActivityID)
+	require.Equal(t, 1, status.Used.Redemptions)
+
+	expiring, err := c.QuoteBuyToken(1, 1000, time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 5)
+	_, err = c.BuyWithQuote(1, expiring.ID)
+	require.ErrorIs(t, err, domain.ErrQuoteExpired)
+
+	// a failed purchase leaves the quote usable
+	held, err = c.QuoteBuyProduct(2, 1, 0, time.Minute)
+	require.NoError(t, err)
+	_, err = c.BuyWithQuote(2, held.ID)
+	require.ErrorIs(t, err, domain.ErrNotEnoughToken)
+	_, _ = c.BuyToken(2, 1000)
+	got, err = c.BuyWithQuote(2, held.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1000, got)
+
+	token, _ = c.GetUserToken(1)
+	require.Equal(t, 10280, token)
+	require.NoError(t, c.ReconcileUser(1))
+	require.NoError(t, c.ReconcileUser(2))
+}
+
+func Test_cashierUsecase_MemberTiers(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 1) // id = 1, 95%
+	_, _ = c.NewUser("testUser2", 1) // id = 2, 95%
+	_, _ = c.NewUser("testUser3", 4) // id = 3, no tier yet
+	productID, _ := c.NewProduct("testProduct", 500)
+	_, _ = c.BuyToken(1, 1000)
+
+	tiers, err := c.ListMemberTiers()
+	require.NoError(t, err)
+	require.Len(t, tiers, 4)
+	require.Equal(t, "VIP3", tiers[3].Name)
+	require.Equal(t, 85, tiers[3].BuyTokenDiscount)
+
+	_, err = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", BuyTokenDiscount: 0})
+	require.ErrorIs(t, err, domain.ErrInvalidMemberTier)
+	_, err = c.SetMemberTier(domain.MemberTier{Level: 1, BuyTokenDiscount: 90})
+	require.ErrorIs(t, err, domain.ErrInvalidMemberTier)
+
+	changed, err := c.SetMemberTier(domain.MemberTier{Level: 1, Name: "Silver", Rank: 1, BuyTokenDiscount: 80, PointMultiplier: 150,
+		SpendingLimit: domain.SpendingLimit{MaxTokenPerPurchase: 5000, MaxProductPrice: 300}, Perks: []string{"free shipping"}})
+	require.NoError(t, err)
+	require.Equal(t, 2, changed)
+	changed, err = c.SetMemberTier(domain.MemberTier{Level: 4, Name: "Black", Rank: 10, BuyTokenDiscount: 70, PointMultiplier: 200})
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+
+	tier, err := c.GetMemberTier(1)
+	require.NoError(t, err)
+	require.Equal(t, "Silver", tier.Name)
+	require.Equal(t, 150, tier.PointMultiplier)
+	require.Equal(t, []string{"free shipping"}, tier.Perks)
+	_, err = c.GetMemberTier(5)
+	require.ErrorIs(t, err, domain.ErrMemberTierNotFound)
+	tiers, _ = c.ListMemberTiers()
+	require.Equal(t, "Black", tiers[len(tiers)-1].Name)
+
+	tests := []struct {
+		name    string
+		buy     func() (int, error)
+		want    int
+		wantErr error
+	}{
+		{
+			name: "OKRecomputedDiscount",
+			buy:  func() (int, error) { return c.BuyToken(2, 1000) },
+			want: 800,
+		},
+		{
+			name: "OKNewTier",
+			buy:  func() (int, error) { return c.BuyToken(3, 1000) },
+			want: 700,
+		},
+		{
+			name: "OKNewUserGetsTierDiscount",
+			buy: func() (int, error) {
+				id, _ := c.NewUser("testUser4", 1)
+				return c.BuyToken(id, 1000)
+			},
+			want: 800,
+		},
+		{
+			name:    "FailTokenOverLimit",
+			buy:     func() (int, error) { return c.BuyToken(2, 5001) },
+			wantErr: domain.ErrSpendingLimit,
+		},
+		{
+			name:    "FailProductOverLimit",
+			buy:     func() (int, error) { return c.BuyProduct(1, productID) },
+			wantErr: domain.ErrSpendingLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.buy()
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	// the balance is kept when the user is recomputed
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 1000, token)
+}
+
+func Test_cashierUsecase_PointMultiplier(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1, 100%
+	_, _ = c.NewUser("testUser2", 2) // id = 2, 150%
+	_, _ = c.NewUser("testUser3", 5) // id = 3, no tier
+	_, err := c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 100, PointMultiplier: 150})
+	require.NoError(t, err)
+	start, end := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	_, err = c.NewBonusActivity(start, end, domain.BonusActivity{Threshold: 1000, BonusPoint: 10})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		userID    int
+		give      func(userID int) error
+		wantPoint int
+	}{
+		{
+			name:      "OKAddPoint",
+			userID:    1,
+			give:      func(userID int) error { return c.AddPoint(userID, 100) },
+			wantPoint: 100,
+		},
+		{
+			name:      "OKAddPointMultiplied",
+			userID:    2,
+			give:      func(userID int) error { return c.AddPoint(userID, 100) },
+			wantPoint: 150,
+		},
+		{
+			name:      "OKAddPointWithoutTier",
+			userID:    3,
+			give:      func(userID int) error { return c.AddPoint(userID, 100) },
+			wantPoint: 100,
+		},
+		{
+			name:   "OKBonusActivityMultiplied",
+			userID: 2,
+			give: func(userID int) error {
+				_, err := c.BuyTokenWithActivity(userID, 2000)
+				return err
+			},
+			wantPoint: 180, // 150 + 2 * 10 * 150%
+		},
+		{
+			name:   "OKCouponPointBonusMultiplied",
+			userID: 2,
+			give: func(userID int) error {
+				_, codes, err := c.NewCouponBatch(domain.CouponBatch{Kind: domain.CouponPointBonus, Value: 40, StartDate: start, EndDate: end}, 1)
+				if err != nil {
+					return err
+				}
+				_, err = c.BuyTokenWithActivity(userID, 100, codes[0])
+				return err
+			},
+			wantPoint: 240, // 180 + 40 * 150%
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.give(tt.userID))
+			point, err := c.GetUserPoint(tt.userID)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPoint, point)
+			require.NoError(t, c.ReconcileUser(tt.userID))
+		})
+	}
+}
+
+func Test_cashierUsecase_MemberUpgrade(t *testing.T) {
+	store, err := repo.NewFileEventStore(t.TempDir())
+	require.NoError(t, err)
+	defer store.Close()
+	c := newTestCashier(t, newTestUnitOfWork(), WithEventStore(store, 0))
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2
+	_, _ = c.NewUser("testUser3", 3) // id = 3
+	productID, _ := c.NewProduct("testProduct", 300)
+	_, err = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, UpgradeSpend: 1000})
+	require.NoError(t, err)
+	_, err = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, UpgradeSpend: 5000})
+	require.NoError(t, err)
+
+	level := func(userID int) int {
+		state, err := c.GetStateAt(time.Now())
+		require.NoError(t, err)
+		return state.Users[userID].MemberLevel
+	}
+
+	tests := []struct {
+		name      string
+		buy       func() (int, error)
+		userID    int
+		wantSpend int64
+		wantLevel int
+		wantPrice int // what the next 1000 tokens cost
+	}{
+		{
+			name:      "OKBelowThreshold",
+			buy:       func() (int, error) { return c.BuyToken(1, 500) },
+			userID:    1,
+			wantSpend: 500,
+			wantLevel: 0,
+			wantPrice: 1000,
+		},
+		{
+			name:      "OKUpgradeOnThreshold",
+			buy:       func() (int, error) { return c.BuyToken(1, 500) },
+			userID:    1,
+			wantSpend: 1000,
+			wantLevel: 1,
+			wantPrice: 950,
+		},
+		{
+			name:      "OKProductSpendCounts",
+			buy:       func() (int, error) { return c.BuyProduct(1, productID) },
+			userID:    1,
+			wantSpend: 1300,
+			wantLevel: 1,
+			wantPrice: 950,
+		},
+		{
+			name:      "OKSkipToHighestTier",
+			buy:       func() (int, error) { return c.BuyToken(2, 6000) },
+			userID:    2,
+			wantSpend: 6000,
+			wantLevel: 2,
+			wantPrice: 900,
+		},
+		{
+			name:      "OKNoDowngrade",
+			buy:       func() (int, error) { return c.BuyToken(3, 2000) },
+			userID:    3,
+			wantSpend: 1700,
+			wantLevel: 3,
+			wantPrice: 850,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.buy()
+			require.NoError(t, err)
+			spend, err := c.GetUserSpend(tt.userID)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSpend, spend)
+			require.Equal(t, tt.wantLevel, level(tt.userID))
+			quote, err := c.QuoteBuyToken(tt.userID, 1000, 0)
+			require.NoError(t, err)
+			require.Equal(t, int64(tt.wantPrice), quote.Charge)
+		})
+	}
+
+	// refunds are taken off the spend
+	page, _ := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	_, err = c.RefundPurchase(page.Transactions[0].ID, 100, "testReason")
+	require.NoError(t, err)
+	spend, _ := c.GetUserSpend(1)
+	require.Equal(t, int64(1000), spend)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_MemberUpgradeSpendWindow(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork(), WithSpendWindow(200*time.Millisecond))
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, UpgradeSpend: 1000})
+
+	_, _ = c.BuyToken(1, 600)
+	time.Sleep(300 * time.Millisecond)
+	_, _ = c.BuyToken(1, 600)
+	spend, _ := c.GetUserSpend(1)
+	require.Equal(t, int64(600), spend)
+	got, _ := c.BuyToken(1, 400)
+	require.Equal(t, 400, got)
+	got, _ = c.BuyToken(1, 100)
+	require.Equal(t, 95, got)
+}
+
+func Test_cashierUsecase_ReassessMembers(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork(), WithDowngradeGrace(200*time.Millisecond))
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, RetainSpend: 1000})
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, RetainSpend: 5000})
+	_, _ = c.NewUser("testUser1", 2) // id = 1, keeps VIP2
+	_, _ = c.NewUser("testUser2", 2) // id = 2, falls to VIP1
+	_, _ = c.NewUser("testUser3", 1) // id = 3, falls to normal
+	_, _ = c.NewUser("testUser4", 2) // id = 4, recovers in the grace period
+	_, _ = c.NewUser("testUser5", 3) // id = 5, VIP3 is never reassessed
+	_, _ = c.BuyToken(1, 6000)
+	_, _ = c.BuyToken(2, 2000)
+
+	actions := func(report domain.ReassessmentReport) map[int]domain.ReassessmentAction {
+		rtn := make(map[int]domain.ReassessmentAction)
+		for _, m := range report.Changes {
+			rtn[m.UserID] = m.Action
+		}
+		return rtn
+	}
+	grace := map[int]domain.ReassessmentAction{2: domain.ReassessGrace, 3: domain.ReassessGrace, 4: domain.ReassessGrace}
+
+	report, err := c.ReassessMembers(true)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, 5, report.Users)
+	require.Equal(t, grace, actions(report))
+	require.Equal(t, domain.MemberReassessment{UserID: 2, Name: "testUser2", Spend: 1800, FromLevel: 2, ToLevel: 2,
+		Action: domain.ReassessGrace, GraceUntil: report.Changes[0].GraceUntil}, report.Changes[0])
+	report, _ = c.ReassessMembers(true)
+	require.Equal(t, grace, actions(report))
+
+	report, err = c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Equal(t, grace, actions(report))
+	report, _ = c.ReassessMembers(false)
+	require.Empty(t, report.Changes)
+
+	_, _ = c.BuyToken(4, 6000)
+	time.Sleep(300 * time.Millisecond)
+	report, _ = c.ReassessMembers(true)
+	want := map[int]domain.ReassessmentAction{2: domain.ReassessDowngrade, 3: domain.ReassessDowngrade, 4: domain.ReassessRecovered}
+	require.Equal(t, want, actions(report))
+	report, err = c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Equal(t, want, actions(report))
+	require.Equal(t, 1, report.Changes[0].ToLevel)
+	require.Equal(t, 0, report.Changes[1].ToLevel)
+
+	tests := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{name: "OKKept", userID: 1, want: 900},
+		{name: "OKDowngradedOneTier", userID: 2, want: 950},
+		{name: "OKDowngradedToNormal", userID: 3, want: 1000},
+		{name: "OKRecovered", userID: 4, want: 900},
+		{name: "OKNoRetention", userID: 5, want: 850},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.BuyToken(tt.userID, 1000)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+	report, _ = c.ReassessMembers(false)
+	require.Empty(t, report.Changes)
+}
+
+func Test_cashierUsecase_Subscription(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, SubscriptionFee: 100, SubscriptionDays: 30})
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, SubscriptionFee: 300, SubscriptionDays: 30})
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewUser("testUser2", 1) // id = 2
+	_, _ = c.NewUser("testUser3", 0) // id = 3
+	_, _ = c.BuyToken(1, 1000)
+	_, _ = c.BuyToken(2, 300)
+	now := time.Now()
+
+	price := func(userID int) int64 {
+		quote, err := c.QuoteBuyToken(userID, 1000, 0)
+		require.NoError(t, err)
+		return quote.Charge
+	}
+
+	_, err := c.Subscribe(1, 3, true)
+	require.ErrorIs(t, err, domain.ErrSubscriptionNotAvailable)
+	_, err = c.Subscribe(2, 1, true)
+	require.ErrorIs(t, err, domain.ErrSubscriptionNotAvailable)
+	_, err = c.Subscribe(3, 1, true)
+	require.ErrorIs(t, err, domain.ErrNotEnoughToken)
+	_, err = c.GetSubscription(1)
+	require.ErrorIs(t, err, domain.ErrSubscriptionNotFound)
+
+	sub, err := c.Subscribe(1, 1, true)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), sub.Fee)
+	require.Equal(t, 0, sub.EarnedLevel)
+	require.Equal(t, int64(950), price(1))
+	_, err = c.Subscribe(1, 1, true)
+	require.ErrorIs(t, err, domain.ErrSubscriptionActive)
+
+	// upgrading takes the unused part of the VIP1 fee off the VIP2 fee
+	sub, err = c.Subscribe(1, 2, true)
+	require.NoError(t, err)
+	require.InDelta(t, 200, sub.Fee, 1)
+	require.Equal(t, 0, sub.EarnedLevel)
+	require.Equal(t, int64(900), price(1))
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 1000-100-int(sub.Fee), token)
+	got, err := c.GetSubscription(1)
+	require.NoError(t, err)
+	require.Equal(t, sub, got)
+
+	_, err = c.Subscribe(2, 2, true)
+	require.NoError(t, err)
+
+	renewed, expired, err := c.RenewSubscriptions(now)
+	require.NoError(t, err)
+	require.Equal(t, 0, renewed+expired)
+
+	// user 1 pays for another period, user 2 cannot and goes back to VIP1
+	renewed, expired, err = c.RenewSubscriptions(now.Add(31 * 24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, renewed)
+	require.Equal(t, 1, expired)
+	got, _ = c.GetSubscription(1)
+	require.Equal(t, sub.EndDate.Add(30*24*time.Hour), got.EndDate)
+	require.Equal(t, int64(300), got.Fee)
+	token, _ = c.GetUserToken(1)
+	require.Equal(t, 1000-100-int(sub.Fee)-300, token)
+	_, err = c.GetSubscription(2)
+	require.ErrorIs(t, err, domain.ErrSubscriptionNotFound)
+	require.Equal(t, int64(950), price(2))
+
+	require.NoError(t, c.SetSubscriptionAutoRenew(1, false))
+	renewed, expired, err = c.RenewSubscriptions(now.Add(61 * 24 * time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 0, renewed)
+	require.Equal(t, 1, expired)
+	require.Equal(t, int64(1000), price(1))
+	require.ErrorIs(t, c.SetSubscriptionAutoRenew(1, true), domain.ErrSubscriptionNotFound)
+
+	page, _ := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionSubscribe}})
+	require.Len(t, page.Transactions, 3)
+	require.Equal(t, int64(-300), page.Transactions[2].Token)
+	require.NoError(t, c.ReconcileUser(1))
+	require.NoError(t, c.ReconcileUser(2))
+}
+
+func Test_cashierUsecase_SubscriptionKeepsEarnedLevel(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, UpgradeSpend: 500, RetainSpend: 10000})
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, SubscriptionFee: 300, SubscriptionDays: 30})
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 300)
+	_, err := c.Subscribe(1, 2, true)
+	require.NoError(t, err)
+
+	// the user earns VIP1 while subscribed to VIP2
+	got, _ := c.BuyToken(1, 300)
+	require.Equal(t, 270, got)
+	sub, _ := c.GetSubscription(1)
+	require.Equal(t, 1, sub.EarnedLevel)
+	require.True(t, sub.AutoRenew)
+
+	// the earned level is reassessed, the subscribed level is kept
+	report, err := c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1)
+	require.Equal(t, domain.ReassessGrace, report.Changes[0].Action)
+	require.Equal(t, 1, report.Changes[0].FromLevel)
+	require.True(t, report.Changes[0].Subscribed)
+	sub, _ = c.GetSubscription(1)
+	require.Equal(t, 2, sub.Level)
+	require.Equal(t, 1, sub.EarnedLevel)
+	require.True(t, sub.EarnedGraceUntil.Equal(report.Changes[0].GraceUntil))
+	got, _ = c.BuyToken(1, 100)
+	require.Equal(t, 90, got)
+
+	require.NoError(t, c.SetSubscriptionAutoRenew(1, false))
+	_, expired, err := c.RenewSubscriptions(sub.EndDate)
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	got, _ = c.BuyToken(1, 100)
+	require.Equal(t, 95, got)
+
+	// the grace period given while subscribed carries over
+	report, err = c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Empty(t, report.Changes)
+}
+
+func Test_cashierUsecase_ReassessSubscriber(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork(), WithDowngradeGrace(0))
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 1, Name: "VIP1", Rank: 1, BuyTokenDiscount: 95, RetainSpend: 10000})
+	_, _ = c.SetMemberTier(domain.MemberTier{Level: 2, Name: "VIP2", Rank: 2, BuyTokenDiscount: 90, SubscriptionFee: 300, SubscriptionDays: 30})
+	_, _ = c.NewUser("testUser1", 1) // id = 1
+	_, _ = c.BuyToken(1, 400)
+	_, err := c.Subscribe(1, 2, false)
+	require.NoError(t, err)
+
+	report, err := c.ReassessMembers(true)
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1)
+	sub, _ := c.GetSubscription(1)
+	require.Equal(t, 1, sub.EarnedLevel) // dry run
+
+	report, err = c.ReassessMembers(false)
+	require.NoError(t, err)
+	require.Len(t, report.Changes, 1)
+	require.Equal(t, domain.MemberReassessment{UserID: 1, Name: "testUser1", Spend: 380, FromLevel: 1, ToLevel: 0,
+		Action: domain.ReassessDowngrade, Subscribed: true}, report.Changes[0])
+	sub, _ = c.GetSubscription(1)
+	require.Equal(t, 0, sub.EarnedLevel)
+	got, _ := c.BuyToken(1, 100)
+	require.Equal(t, 90, got) // still VIP2 until the subscription expires
+
+	_, expired, err := c.RenewSubscriptions(sub.EndDate)
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	got, _ = c.BuyToken(1, 100)
+	require.Equal(t, 100, got)
+}
+
+func Test_cashierUsecase_Inventory(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.NewUser("testUser2", 0) // id = 2, no token
+	_, _ = c.BuyToken(1, 10000)
+	unlimitedID, _ := c.NewProduct("testProduct1", 100)
+	productID, _ := c.NewProduct("testProduct2", 100)
+
+	_, err := c.Restock(productID, 1)
+	require.Error(t, err)
+	require.Error(t, c.SetProductStock(productID, -1, 0))
+	require.NoError(t, c.SetProductStock(productID, 3, 1))
+
+	stock := func() int {
+		product, err := c.GetProduct(productID)
+		require.NoError(t, err)
+		return product.Stock
+	}
+
+	// a purchase that fails gives the stock back
+	_, err = c.BuyProduct(2, productID)
+	require.ErrorIs(t, err, domain.ErrNotEnoughToken)
+	require.Equal(t, 3, stock())
+
+	for i := 0; i < 3; i++ {
+		_, err = c.BuyProduct(1, productID)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 0, stock())
+	low, err := c.ListLowStockProducts()
+	require.NoError(t, err)
+	require.Len(t, low, 1)
+	require.Equal(t, productID, low[0].ID)
+
+	_, err = c.BuyProduct(1, productID)
+	require.ErrorIs(t, err, domain.ErrOutOfStock)
+	_, err = c.QuoteBuyProduct(1, productID, 0, 0)
+	require.ErrorIs(t, err, domain.ErrOutOfStock)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 9700, token)
+
+	// only a full refund puts the product back in stock
+	page, _ := c.GetUserTransactions(1, domain.TransactionFilter{Types: []domain.TransactionType{domain.TransactionBuyProduct}})
+	_, err = c.RefundPurchase(page.Transactions[0].ID, 50, "testReason")
+	require.NoError(t, err)
+	require.Equal(t, 0, stock())
+	_, err = c.RefundPurchase(page.Transactions[0].ID, 50, "testReason")
+	require.NoError(t, err)
+	require.Equal(t, 1, stock())
+
+	got, err := c.Restock(productID, 10)
+	require.NoError(t, err)
+	require.Equal(t, 11, got)
+	low, _ = c.ListLowStockProducts()
+	require.Empty(t, low)
+
+	for i := 0; i < 20; i++ {
+		_, err = c.BuyProduct(1, unlimitedID)
+		require.NoError(t, err)
+	}
+	product, _ := c.GetProduct(unlimitedID)
+	require.False(t, product.TrackStock)
+	require.NoError(t, c.ReconcileUser(1))
+}
+
+func Test_cashierUsecase_ConcurrentStock(t *testing.T) {
+	c := newTestCashier(t, newTestUnitOfWork())
+	_, _ = c.NewUser("testUser1", 0) // id = 1
+	_, _ = c.BuyToken(1, 10000)
+	productID, _ := c.NewProduct("testProduct1", 100)
+	require.NoError(t, c.SetProductStock(productID, 5, 0))
+
+	var wg sync.WaitGroup
+	var sold, outOfStock int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.BuyProduct(1, productID)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&sold, 1)
+			case errors.Is(err, domain.ErrOutOfStock):
+				atomic.AddInt64(&outOfStock, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int64(5), sold)
+	require.Equal(t, int64(15), outOfStock)
+	product, _ := c.GetProduct(productID)
+	require.Equal(t, 0, product.Stock)
+	token, _ := c.GetUserToken(1)
+	require.Equal(t, 9500, token)
+}
@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"oa-bitgin/pkg/promotion"
+	"time"
+)
+
+// maxCodeAttempts bounds the retries when a generated code is already taken.
+const maxCodeAttempts = 10
+
+// NewCouponBatch creates a coupon batch with count unique codes and returns the batch ID and the codes.
+// MaxUses defaults to 1, a single-use code.
+func (c *cashierUsecase) NewCouponBatch(batch domain.CouponBatch, count int) (int, []string, error) {
+	if count < 1 {
+		return -1, nil, errors.New("invalid coupon count")
+	}
+	if batch.Value < 1 || batch.Kind == domain.CouponDiscount && batch.Value > 100 {
+		return -1, nil, errors.New("invalid coupon value")
+	}
+	if batch.MaxUses == 0 {
+		batch.MaxUses = 1
+	}
+
+	var id int
+	codes := make([]string, 0, count)
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		var err error
+		if id, err = repos.Coupons().AddBatch(batch); err != nil {
+			return err
+		}
+		for len(codes) < count {
+			code, err := newCouponCode(repos.Coupons(), id)
+			if err != nil {
+				return err
+			}
+			codes = append(codes, code)
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Coupon batch %d created with %d codes", id, count))
+	return id, codes, nil
+}
+
+func newCouponCode(repo domain.CouponRepository, batchID int) (string, error) {
+	for i := 0; i < maxCodeAttempts; i++ {
+		code, err := domain.GenerateCouponCode()
+		if err != nil {
+			return "", err
+		}
+		err = repo.AddCoupon(domain.Coupon{Code: code, BatchID: batchID})
+		if errors.Is(err, domain.ErrCouponCodeExists) {
+			continue
+		}
+		return code, err
+	}
+	return "", errors.New("could not generate a unique coupon code")
+}
+
+// couponBatch returns the batch of code when it can be redeemed now, nil when no code is given.
+func couponBatch(repo domain.CouponRepository, code string) (*domain.CouponBatch, error) {
+	if code == "" {
+		return nil, nil
+	}
+	coupon, err := repo.GetCoupon(code)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Coupon %s not found", code))
+		return nil, err
+	}
+	batch, err := repo.GetBatch(coupon.BatchID)
+	if err != nil {
+		return nil, err
+	}
+	if !batch.IsValidAt(time.Now()) {
+		fmt.Println(fmt.Sprintf("[MSG] Coupon %s is not valid now", code))
+		return nil, domain.ErrCouponExpired
+	}
+	if coupon.Used >= batch.MaxUses {
+		fmt.Println(fmt.Sprintf("[MSG] Coupon %s has been used up", code))
+		return nil, domain.ErrCouponUsedUp
+	}
+	return &batch, nil
+}
+
+// redeemCoupon consumes the code used by entry and records what it gave, the limits are enforced by the repository.
+func redeemCoupon(repo domain.CouponRepository, entry *domain.JournalEntry, result promotion.Result) error {
+	if entry.Coupon == "" {
+		return nil
+	}
+	r := domain.CouponRedemption{
+		Code:      entry.Coupon,
+		UserID:    entry.UserID,
+		EntryID:   entry.ID,
+		CreatedAt: entry.CreatedAt,
+	}
+	for _, s := range result.Steps {
+		if s.Rule == (promotion.CouponBenefit{}).Name() {
+			r.Discount += s.Discount
+			r.BonusPoint += s.BonusPoint
+		}
+	}
+	if _, err := repo.Redeem(r); err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] User %d cannot use coupon %s: %s", entry.UserID, entry.Coupon, err))
+		return err
+	}
+	return nil
+}
+
+// couponCode returns the coupon code entered at checkout, empty for none. A purchase takes one code at most.
+func couponCode(coupon []string) (string, error) {
+	switch len(coupon) {
+	case 0:
+		return "", nil
+	case 1:
+		return domain.NormalizeCouponCode(coupon[0]), nil
+	}
+	return "", errors.New("only one coupon code can be used")
+}
+
+// GetCouponReport returns how the codes of a batch have been used.
+func (c *cashierUsecase) GetCouponReport(batchID int) (domain.CouponReport, error) {
+	batch, err := c.unitOfWork().Coupons().GetBatch(batchID)
+	if err != nil {
+		return domain.CouponReport{}, err
+	}
+	coupons, err := c.unitOfWork().Coupons().ListCoupons(batchID)
+	if err != nil {
+		return domain.CouponReport{}, err
+	}
+	redemptions, err := c.unitOfWork().Coupons().ListRedemptions(batchID)
+	if err != nil {
+		return domain.CouponReport{}, err
+	}
+
+	report := domain.CouponReport{Batch: batch, Issued: len(coupons), Redeemed: len(redemptions), Redemptions: redemptions}
+	for _, r := range redemptions {
+		report.TotalDiscount += r.Discount
+		report.TotalBonusPoint += r.BonusPoint
+	}
+	return report, nil
+}
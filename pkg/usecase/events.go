@@ -0,0 +1,149 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"sync"
+	"time"
+)
+
+const DefaultSnapshotEvery = 1000
+
+// eventRecorder appends events to the store and keeps a live projection to snapshot from.
+// A nil *eventRecorder records nothing, that is the cashier without event store mode.
+type eventRecorder struct {
+	mu            sync.Mutex
+	store         domain.EventStore
+	snapshotEvery int
+	now           func() time.Time // stamps the events
+	state         domain.CashierState
+	pending       []domain.Event // events of committed work the store has not taken yet, written before newer ones
+}
+
+// WithEventStore turns on event store mode, a snapshot is saved every snapshotEvery events. The log is kept next to
+// durable repositories, NewCashierUsecaseWithUnitOfWork fails when the repositories do not hold the users the log records.
+func WithEventStore(store domain.EventStore, snapshotEvery int) Option {
+	return func(c *cashierUsecase) {
+		if snapshotEvery <= 0 {
+			snapshotEvery = DefaultSnapshotEvery
+		}
+		c.events = &eventRecorder{store: store, snapshotEvery: snapshotEvery, now: time.Now}
+	}
+}
+
+// stateAt rebuilds the state at the given time from the latest snapshot before it plus the events after that.
+func (r *eventRecorder) stateAt(at time.Time) (domain.CashierState, error) {
+	state, ok, err := r.store.LoadSnapshot(at)
+	if err != nil {
+		return domain.CashierState{}, err
+	}
+	if !ok {
+		state = domain.NewCashierState()
+	}
+	err = r.store.Replay(state.Seq, func(e domain.Event) bool {
+		if e.Time.After(at) {
+			return false
+		}
+		state.Apply(e)
+		return true
+	})
+	return state, err
+}
+
+// record queues the events of committed work and writes the queue to the store. The work cannot be undone, so a
+// write that fails is only reported and the events are written again with the next ones.
+func (r *eventRecorder) record(events ...domain.Event) {
+	if r == nil || len(events) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	for _, event := range events {
+		event.Time = now
+		r.pending = append(r.pending, event)
+	}
+	if err := r.flush(); err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] %d events wait to be written to the event store: %s", len(r.pending), err))
+	}
+}
+
+// load replays the log into the live projection. The repositories must already hold every user the log records:
+// the log does not rebuild them, and new users given the IDs of the old ones would be mixed into their history.
+func (r *eventRecorder) load(users domain.UserRepository) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, err := r.stateAt(r.now())
+	if err != nil {
+		return err
+	}
+	for id := range state.Users {
+		if _, err := users.GetUser(id); err != nil {
+			return fmt.Errorf("event log records user %d the repositories do not hold, it belongs to another store: %w", id, err)
+		}
+	}
+	r.state = state
+	return nil
+}
+
+// flush appends the pending events in order, r.mu must be held.
+func (r *eventRecorder) flush() error {
+	for len(r.pending) > 0 {
+		event, err := r.store.Append(r.pending[0])
+		if err != nil {
+			return err
+		}
+		r.pending = r.pending[1:]
+		r.state.Apply(event)
+		if event.Seq%int64(r.snapshotEvery) == 0 {
+			// a missing snapshot only makes replay longer
+			if err := r.store.SaveSnapshot(r.state.Clone()); err != nil {
+				fmt.Println(fmt.Sprintf("[MSG] Snapshot at event %d not saved: %s", event.Seq, err))
+			}
+		}
+	}
+	return nil
+}
+
+// eventBatch holds the events of a unit of work until it commits,
+// a unit of work that is rolled back must not leave events in the log.
+type eventBatch struct {
+	events []domain.Event
+}
+
+func (b *eventBatch) emit(event domain.Event) error {
+	b.events = append(b.events, event)
+	return nil
+}
+
+// do runs fn in a unit of work and records the events fn emits once the unit of work has committed.
+func (c *cashierUsecase) do(fn func(repos domain.Repositories, events *eventBatch) error) error {
+	batch := &eventBatch{}
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		batch.events = batch.events[:0]
+		return fn(repos, batch)
+	})
+	if err != nil {
+		return err
+	}
+	c.events.record(batch.events...)
+	return nil
+}
+
+// GetStateAt rebuilds every user's balances and the cashier's total amount as they were at the given time.
+func (c *cashierUsecase) GetStateAt(at time.Time) (domain.CashierState, error) {
+	if c.events == nil {
+		return domain.CashierState{}, errors.New("event store mode is not enabled")
+	}
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	// the state must not miss committed work
+	if err := c.events.flush(); err != nil {
+		return domain.CashierState{}, err
+	}
+	return c.events.stateAt(at)
+}
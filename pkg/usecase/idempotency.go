@@ -0,0 +1,93 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused with a different request")
+
+type idempotencyRecord struct {
+	key      string
+	request  string
+	done     chan struct{}
+	amount   int
+	err      error
+	expireAt time.Time
+}
+
+// idempotencyStore remembers the result of keyed requests for the retention window.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	records   map[string]*idempotencyRecord
+	order     []*idempotencyRecord // records in creation order, used for eviction
+}
+
+func newIdempotencyStore(retention time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		retention: retention,
+		records:   make(map[string]*idempotencyRecord),
+	}
+}
+
+// evict drops expired records, records expire in creation order since retention is fixed.
+func (s *idempotencyStore) evict(now time.Time) {
+	i := 0
+	for ; i < len(s.order) && !now.Before(s.order[i].expireAt); i++ {
+		if s.records[s.order[i].key] == s.order[i] {
+			delete(s.records, s.order[i].key)
+		}
+	}
+	s.order = s.order[i:]
+}
+
+// do runs fn once per key, repeats of the same key get the first result.
+// Concurrent duplicates wait until the first call finishes.
+// If fn panics the key is forgotten so a retry runs fn again, duplicates already waiting get an error.
+func (s *idempotencyStore) do(key string, request string, fn func() (int, error)) (int, error) {
+	if key == "" {
+		return -1, errors.New("empty idempotency key")
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	s.evict(now)
+	if r, ok := s.records[key]; ok {
+		s.mu.Unlock()
+		if r.request != request {
+			return -1, ErrIdempotencyKeyReused
+		}
+		<-r.done
+		return r.amount, r.err
+	}
+	r := &idempotencyRecord{
+		key:      key,
+		request:  request,
+		done:     make(chan struct{}),
+		expireAt: now.Add(s.retention),
+	}
+	s.records[key] = r
+	s.order = append(s.order, r)
+	s.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			s.mu.Lock()
+			if s.records[key] == r {
+				delete(s.records, key)
+			}
+			s.mu.Unlock()
+			r.amount, r.err = -1, fmt.Errorf("idempotent request %q panicked: %v", key, p)
+			close(r.done)
+			panic(p)
+		}
+		close(r.done)
+	}()
+	r.amount, r.err = fn()
+	return r.amount, r.err
+}
@@ -0,0 +1,71 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+)
+
+func (c *cashierUsecase) GetProduct(productID int) (domain.Product, error) {
+	return c.productRepo.GetProduct(productID)
+}
+
+// SetProductStock starts tracking the stock of a product, or corrects the stock already tracked after a count.
+// A lowStockThreshold of 0 turns the low stock alert off.
+func (c *cashierUsecase) SetProductStock(productID int, stock int, lowStockThreshold int) error {
+	if stock < 0 || lowStockThreshold < 0 {
+		return errors.New("invalid stock")
+	}
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		if err := repos.Products().SetStock(productID, stock, lowStockThreshold); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventProductRestocked, ProductID: productID, Stock: stock})
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Product %d has %d in stock", productID, stock))
+	return nil
+}
+
+// Restock adds quantity to the stock of a product and returns the new stock.
+func (c *cashierUsecase) Restock(productID int, quantity int) (int, error) {
+	if quantity < 1 {
+		return -1, errors.New("invalid restock quantity")
+	}
+	var product domain.Product
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		var err error
+		if product, err = repos.Products().GetProduct(productID); err != nil {
+			return err
+		}
+		if !product.TrackStock {
+			return errors.New("product stock is not tracked")
+		}
+		if product, err = repos.Products().AdjustStock(productID, quantity); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventProductRestocked, ProductID: productID, Stock: product.Stock})
+	})
+	if err != nil {
+		return -1, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Product %d restocked with %d, %d in stock", productID, quantity, product.Stock))
+	return product.Stock, nil
+}
+
+// ListLowStockProducts returns the products whose stock has fallen to their low stock threshold, ordered by ID.
+func (c *cashierUsecase) ListLowStockProducts() ([]domain.Product, error) {
+	products, err := c.productRepo.ListProducts()
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]domain.Product, 0)
+	for _, p := range products {
+		if p.IsLowStock() {
+			rtn = append(rtn, p)
+		}
+	}
+	return rtn, nil
+}
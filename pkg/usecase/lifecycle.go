@@ -0,0 +1,162 @@
+package usecase
+
+import (
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+func (c *cashierUsecase) GetBuyTokenActivity(activityID int) (domain.BuyTokenActivity, error) {
+	a, err := c.activityRepo.GetBuyTokenActivity(activityID)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+	}
+	return a, err
+}
+
+func (c *cashierUsecase) GetBuyProductActivity(activityID int) (domain.BuyProductActivity, error) {
+	a, err := c.activityRepo.GetBuyProductActivity(activityID)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+	}
+	return a, err
+}
+
+// ListBuyTokenActivities returns the buy token activities selected by filter ordered by ID.
+func (c *cashierUsecase) ListBuyTokenActivities(filter domain.ActivityFilter) ([]domain.BuyTokenActivity, error) {
+	activities, err := c.activityRepo.ListBuyTokenActivity()
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]domain.BuyTokenActivity, 0, len(activities))
+	for i := range activities {
+		if filter.MatchBuyToken(&activities[i]) {
+			rtn = append(rtn, activities[i])
+		}
+	}
+	return rtn, nil
+}
+
+// ListBuyProductActivities returns the buy product activities selected by filter ordered by ID,
+// MemberLevels does not apply to them.
+func (c *cashierUsecase) ListBuyProductActivities(filter domain.ActivityFilter) ([]domain.BuyProductActivity, error) {
+	activities, err := c.activityRepo.ListBuyProductActivity()
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]domain.BuyProductActivity, 0, len(activities))
+	for i := range activities {
+		if filter.Match(&activities[i]) {
+			rtn = append(rtn, activities[i])
+		}
+	}
+	return rtn, nil
+}
+
+// UpdateActivityPeriod moves the period of a running or paused activity.
+func (c *cashierUsecase) UpdateActivityPeriod(kind domain.ActivityKind, activityID int, startTime time.Time, endTime time.Time) error {
+	if !startTime.Before(endTime) {
+		return fmt.Errorf("invalid period %s - %s", startTime, endTime)
+	}
+	return c.changeActivity(kind, activityID, domain.ActionUpdatePeriod, "",
+		func(repo domain.ActivityRepository, a domain.Activity) (string, error) {
+			if err := editable(a); err != nil {
+				return "", err
+			}
+			start, end := a.GetPeriod()
+			detail := fmt.Sprintf("period %s - %s -> %s - %s", start.Format(time.RFC3339), end.Format(time.RFC3339),
+				startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+			return detail, repo.SetPeriod(kind, activityID, startTime, endTime)
+		})
+}
+
+// UpdateActivityDiscount changes the discount of a running or paused buy token or buy product activity.
+func (c *cashierUsecase) UpdateActivityDiscount(kind domain.ActivityKind, activityID int, discount int) error {
+	if discount < 1 || discount > 100 {
+		return fmt.Errorf("invalid discount %d", discount)
+	}
+	return c.changeActivity(kind, activityID, domain.ActionUpdateDiscount, "",
+		func(repo domain.ActivityRepository, a domain.Activity) (string, error) {
+			if err := editable(a); err != nil {
+				return "", err
+			}
+			var old int
+			switch a := a.(type) {
+			case *domain.BuyTokenActivity:
+				old = a.BuyTokenDiscount
+			case *domain.BuyProductActivity:
+				old = a.PointDiscount
+			default:
+				return "", fmt.Errorf("%s activity has no discount", kind)
+			}
+			return fmt.Sprintf("discount %d -> %d", old, discount), repo.SetDiscount(kind, activityID, discount)
+		})
+}
+
+// PauseActivity stops a running activity from being applied until it is resumed.
+func (c *cashierUsecase) PauseActivity(kind domain.ActivityKind, activityID int) error {
+	return c.setActivityState(kind, activityID, domain.ActionPause, domain.ActivityPaused, "")
+}
+
+func (c *cashierUsecase) ResumeActivity(kind domain.ActivityKind, activityID int) error {
+	return c.setActivityState(kind, activityID, domain.ActionResume, domain.ActivityRunning, "")
+}
+
+// CancelActivity ends an activity for good, it stays listed with its history.
+func (c *cashierUsecase) CancelActivity(kind domain.ActivityKind, activityID int, reason string) error {
+	return c.setActivityState(kind, activityID, domain.ActionCancel, domain.ActivityCanceled, reason)
+}
+
+// DeleteActivity soft-deletes an activity, it is no longer applied nor listed unless asked for but its history is kept.
+func (c *cashierUsecase) DeleteActivity(kind domain.ActivityKind, activityID int, reason string) error {
+	return c.setActivityState(kind, activityID, domain.ActionDelete, domain.ActivityDeleted, reason)
+}
+
+// GetActivityHistory returns the changes made to an activity, oldest first.
+func (c *cashierUsecase) GetActivityHistory(kind domain.ActivityKind, activityID int) ([]domain.ActivityChange, error) {
+	if _, err := getActivity(c.activityRepo, kind, activityID); err != nil {
+		return nil, err
+	}
+	return c.activityRepo.ListChanges(kind, activityID)
+}
+
+func (c *cashierUsecase) setActivityState(kind domain.ActivityKind, activityID int, action domain.ActivityAction,
+	state domain.ActivityState, reason string) error {
+	return c.changeActivity(kind, activityID, action, reason, func(repo domain.ActivityRepository, a domain.Activity) (string, error) {
+		if !a.GetState().CanBecome(state) {
+			fmt.Println(fmt.Sprintf("[MSG] Activity %d is %s, cannot %s", activityID, a.GetState(), action))
+			return "", domain.ErrActivityState
+		}
+		return fmt.Sprintf("state %s -> %s", a.GetState(), state), repo.SetState(kind, activityID, state)
+	})
+}
+
+// editable fails for activities that are over, only running and paused activities may be edited.
+func editable(a domain.Activity) error {
+	if s := a.GetState(); s != domain.ActivityRunning && s != domain.ActivityPaused {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d is %s, cannot be edited", a.GetID(), s))
+		return domain.ErrActivityState
+	}
+	return nil
+}
+
+// changeActivity applies fn to the activity and records the change it describes in the activity's history.
+func (c *cashierUsecase) changeActivity(kind domain.ActivityKind, activityID int, action domain.ActivityAction, reason string,
+	fn func(repo domain.ActivityRepository, a domain.Activity) (string, error)) error {
+	return c.do(func(repos domain.Repositories, events *eventBatch) error {
+		a, err := getActivity(repos.Activities(), kind, activityID)
+		if err != nil {
+			fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+			return err
+		}
+		detail, err := fn(repos.Activities(), a)
+		if err != nil {
+			return err
+		}
+		change := domain.ActivityChange{Kind: kind, ActivityID: activityID, Action: action, Detail: detail, Reason: reason, CreatedAt: time.Now()}
+		if err := repos.Activities().AddChange(change); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventActivityUpdated, ActivityID: activityID, Name: string(action)})
+	})
+}
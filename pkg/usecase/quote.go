@@ -0,0 +1,144 @@
+package usecase
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"oa-bitgin/pkg/promotion"
+	"sync"
+	"time"
+)
+
+type heldQuote struct {
+	quote  domain.Quote
+	result promotion.Result
+}
+
+// quoteStore keeps the quotes held for a later purchase until they expire or are used.
+type quoteStore struct {
+	mu     sync.Mutex
+	quotes map[string]heldQuote
+}
+
+func newQuoteStore() *quoteStore {
+	return &quoteStore{quotes: make(map[string]heldQuote)}
+}
+
+func (s *quoteStore) hold(q heldQuote) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, h := range s.quotes {
+		if !now.Before(h.quote.ExpiresAt) {
+			delete(s.quotes, id)
+		}
+	}
+	s.quotes[q.quote.ID] = q
+}
+
+// take removes the quote so it cannot be used twice at the same time, put it back if the purchase fails.
+func (s *quoteStore) take(id string, userID int) (heldQuote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.quotes[id]
+	if !ok || q.quote.UserID != userID {
+		return heldQuote{}, domain.ErrQuoteNotFound
+	}
+	delete(s.quotes, id)
+	if !time.Now().Before(q.quote.ExpiresAt) {
+		return heldQuote{}, domain.ErrQuoteExpired
+	}
+	return q, nil
+}
+
+func (s *quoteStore) put(q heldQuote) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotes[q.quote.ID] = q
+}
+
+func newQuoteID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newQuote itemizes result, a quote ID valid for hold is issued when hold is positive.
+func (c *cashierUsecase) newQuote(quote domain.Quote, result promotion.Result, hold time.Duration) (domain.Quote, error) {
+	quote.ListPrice = result.ListPrice
+	quote.Charge = result.Charge
+	quote.Point = result.Point
+	quote.BonusToken = result.BonusToken
+	quote.BonusPoint = result.BonusPoint
+	quote.ActivityIDs = append(append([]int{}, result.ActivityIDs...), result.BonusActivityIDs...)
+	quote.Lines = make([]domain.QuoteLine, 0, len(result.Steps))
+	for _, s := range result.Steps {
+		quote.Lines = append(quote.Lines, domain.QuoteLine{Rule: s.Rule, ActivityID: s.ActivityID, Discount: s.Discount, Point: s.Point,
+			BonusToken: s.BonusToken, BonusPoint: s.BonusPoint})
+	}
+	if hold <= 0 {
+		return quote, nil
+	}
+
+	id, err := newQuoteID()
+	if err != nil {
+		return domain.Quote{}, err
+	}
+	quote.ID = id
+	quote.ExpiresAt = time.Now().Add(hold)
+	c.quotes.hold(heldQuote{quote: quote, result: result})
+	fmt.Println(fmt.Sprintf("[MSG] Quote %s held for user %d until %s", id, quote.UserID, quote.ExpiresAt.Format(time.RFC3339)))
+	return quote, nil
+}
+
+// QuoteBuyToken returns what BuyTokenWithActivity would charge now without buying anything.
+// When hold is positive the quote gets an ID that BuyWithQuote honors until it expires.
+func (c *cashierUsecase) QuoteBuyToken(userID int, token int64, hold time.Duration) (domain.Quote, error) {
+	result, err := c.priceToken(c.unitOfWork(), userID, token, true, "")
+	if err != nil {
+		return domain.Quote{}, err
+	}
+	return c.newQuote(domain.Quote{Type: domain.TransactionBuyToken, UserID: userID, Token: token}, result, hold)
+}
+
+// QuoteBuyProduct returns what BuyProductWithActivity would debit now without buying anything, activityID 0 means no
+// point redemption. When hold is positive the quote gets an ID that BuyWithQuote honors until it expires.
+func (c *cashierUsecase) QuoteBuyProduct(userID int, productID int, activityID int, hold time.Duration) (domain.Quote, error) {
+	result, err := c.priceProduct(c.unitOfWork(), userID, productID, activityID, "")
+	if err != nil {
+		return domain.Quote{}, err
+	}
+	return c.newQuote(domain.Quote{Type: domain.TransactionBuyProduct, UserID: userID, ProductID: productID, ActivityID: activityID},
+		result, hold)
+}
+
+// BuyWithQuote makes the purchase of a held quote at the quoted price, a quote can be used once.
+// The activities applied still count against their budgets and the purchase fails if those are used up meanwhile.
+func (c *cashierUsecase) BuyWithQuote(userID int, quoteID string) (int, error) {
+	c.setup()
+	held, err := c.quotes.take(quoteID, userID)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] User %d cannot use quote %s: %s", userID, quoteID, err))
+		return -1, err
+	}
+	quoted := func(repos domain.Repositories) (promotion.Result, error) {
+		return held.result, nil
+	}
+
+	q := held.quote
+	var result promotion.Result
+	if q.Type == domain.TransactionBuyToken {
+		result, err = c.purchaseToken(userID, q.Token, "", quoted)
+	} else {
+		result, err = c.purchaseProduct(userID, q.ProductID, "", quoted)
+	}
+	if err != nil {
+		c.quotes.put(held)
+		return -1, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d used quote %s, charge %d, point %d", userID, quoteID, result.Charge, result.Point))
+	return int(result.Charge), nil
+}
@@ -0,0 +1,137 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+// DefaultDowngradeGrace is how long a member whose spend fell below their tier's RetainSpend keeps the tier.
+const DefaultDowngradeGrace = 30 * 24 * time.Hour
+
+// WithDowngradeGrace sets how long a member keeps a tier after a reassessment finds their spend too low,
+// 0 downgrades at once.
+func WithDowngradeGrace(grace time.Duration) Option {
+	return func(c *cashierUsecase) {
+		c.downgradeGrace = grace
+	}
+}
+
+// ReassessMembers checks every user's spend in the spend window against their tier's RetainSpend. A user below it
+// enters the grace period, and is downgraded by a later reassessment once the grace period is over and the spend is
+// still too low. For users with an active subscription the level they earned is reassessed instead, the level they pay
+// for is kept until the subscription expires. A dry run reports the same changes without making them.
+func (c *cashierUsecase) ReassessMembers(dryRun bool) (domain.ReassessmentReport, error) {
+	report := domain.ReassessmentReport{At: time.Now(), DryRun: dryRun, Changes: make([]domain.MemberReassessment, 0)}
+	users, err := c.userRepo.ListUsers()
+	if err != nil {
+		return report, err
+	}
+	report.Users = len(users)
+
+	for _, user := range users {
+		var change *domain.MemberReassessment
+		if dryRun {
+			if change, _, err = c.reassess(c.unitOfWork(), user.ID, report.At); err != nil {
+				return report, err
+			}
+		} else {
+			err = c.do(func(repos domain.Repositories, events *eventBatch) error {
+				var member domain.Member
+				var err error
+				if change, member, err = c.reassess(repos, user.ID, report.At); err != nil || change == nil {
+					return err
+				}
+				if change.Subscribed {
+					sub, err := repos.Users().GetActiveSubscription(user.ID)
+					if err != nil {
+						return err
+					}
+					sub.EarnedLevel, sub.EarnedGraceUntil = member.Level, member.GraceUntil
+					return repos.Users().UpdateSubscription(sub)
+				}
+				if err := repos.Users().SetMember(user.ID, member); err != nil {
+					return err
+				}
+				if change.Action == domain.ReassessDowngrade {
+					return events.emit(domain.Event{Type: domain.EventMemberDowngraded, UserID: user.ID, MemberLevel: change.ToLevel})
+				}
+				return nil
+			})
+			if err != nil {
+				return report, err
+			}
+		}
+		if change != nil {
+			report.Changes = append(report.Changes, *change)
+		}
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Reassessed %d users, %d changes (dry run: %t)", report.Users, len(report.Changes), dryRun))
+	return report, nil
+}
+
+// reassess works out what a reassessment at now does to the user and the member they become,
+// the change is nil when nothing happens. For a subscriber the member is the one they earned, held by the subscription.
+func (c *cashierUsecase) reassess(repos domain.Repositories, userID int, now time.Time) (*domain.MemberReassessment, domain.Member, error) {
+	user, err := repos.Users().GetUser(userID)
+	if err != nil {
+		return nil, domain.Member{}, err
+	}
+	member := user.Member
+	// subscribers keep the level they pay for, they go back to the earned level when the subscription expires
+	sub, err := repos.Users().GetActiveSubscription(userID)
+	subscribed := err == nil
+	if err != nil && !errors.Is(err, domain.ErrSubscriptionNotFound) {
+		return nil, member, err
+	}
+	if subscribed {
+		member = domain.Member{Level: sub.EarnedLevel, BuyTokenDefaultDiscount: repos.Users().GetDefaultBuyTokenDiscount(sub.EarnedLevel),
+			GraceUntil: sub.EarnedGraceUntil}
+	}
+	tiers, err := repos.Users().ListMemberTiers()
+	if err != nil {
+		return nil, member, err
+	}
+	current := findTier(tiers, member.Level)
+	if current == nil || current.RetainSpend == 0 && member.GraceUntil.IsZero() {
+		return nil, member, nil
+	}
+
+	spend, err := c.userSpend(repos.Ledger(), userID, now)
+	if err != nil {
+		return nil, member, err
+	}
+	change := &domain.MemberReassessment{UserID: userID, Name: user.Name, Spend: spend, FromLevel: member.Level, ToLevel: member.Level,
+		Subscribed: subscribed}
+	switch {
+	case spend >= current.RetainSpend:
+		if member.GraceUntil.IsZero() {
+			return nil, member, nil
+		}
+		change.Action = domain.ReassessRecovered
+		member.GraceUntil = time.Time{}
+	case member.GraceUntil.IsZero() && c.downgradeGrace > 0:
+		change.Action = domain.ReassessGrace
+		member.GraceUntil = now.Add(c.downgradeGrace)
+		change.GraceUntil = member.GraceUntil
+	case now.Before(member.GraceUntil):
+		// still in the grace period
+		return nil, member, nil
+	default:
+		// the highest tier below the current one the spend still retains, tiers are ordered by rank
+		var target *domain.MemberTier
+		for i := range tiers {
+			if tiers[i].Rank < current.Rank && spend >= tiers[i].RetainSpend {
+				target = &tiers[i]
+			}
+		}
+		if target == nil {
+			return nil, member, nil
+		}
+		change.Action = domain.ReassessDowngrade
+		change.ToLevel = target.Level
+		member = domain.Member{Level: target.Level, BuyTokenDefaultDiscount: target.BuyTokenDiscount}
+	}
+	return change, member, nil
+}
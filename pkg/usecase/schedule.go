@@ -0,0 +1,52 @@
+package usecase
+
+import (
+	"fmt"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+// getActivity returns activity id of kind.
+func getActivity(repo domain.ActivityRepository, kind domain.ActivityKind, id int) (domain.Activity, error) {
+	switch kind {
+	case domain.ActivityBuyToken:
+		a, err := repo.GetBuyTokenActivity(id)
+		return &a, err
+	case domain.ActivityBuyProduct:
+		a, err := repo.GetBuyProductActivity(id)
+		return &a, err
+	case domain.ActivityBonus:
+		a, err := repo.GetBonusActivity(id)
+		return &a, err
+	}
+	return nil, fmt.Errorf("unknown activity kind %q", kind)
+}
+
+// SetActivitySchedule makes an activity recur within its period, e.g. every Friday 18:00-23:00, nil removes the schedule.
+func (c *cashierUsecase) SetActivitySchedule(kind domain.ActivityKind, activityID int, schedule *domain.Schedule) error {
+	if schedule != nil {
+		if err := schedule.Validate(); err != nil {
+			return err
+		}
+	}
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		return repos.Activities().SetSchedule(kind, activityID, schedule)
+	})
+	if err != nil {
+		fmt.Println(fmt.Sprintf("[MSG] Activity %d not found", activityID))
+		return err
+	}
+	return nil
+}
+
+// ListActivityOccurrences returns the next n windows in which an activity runs, starting with the one open at from.
+func (c *cashierUsecase) ListActivityOccurrences(kind domain.ActivityKind, activityID int, from time.Time, n int) ([]domain.Occurrence, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid occurrence count %d", n)
+	}
+	a, err := getActivity(c.activityRepo, kind, activityID)
+	if err != nil {
+		return nil, err
+	}
+	return a.NextOccurrences(from, n), nil
+}
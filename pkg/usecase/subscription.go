@@ -0,0 +1,173 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+// Subscribe buys one period of a member level with the user's tokens, bonus tokens cannot be used. Subscribing to a
+// higher tier while a subscription is active replaces it, the unused part of its fee is taken off the new fee.
+func (c *cashierUsecase) Subscribe(userID int, level int, autoRenew bool) (domain.Subscription, error) {
+	var sub domain.Subscription
+	now := time.Now()
+	err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+		users := repos.Users()
+		user, err := users.GetUser(userID)
+		if err != nil {
+			return err
+		}
+		tiers, err := users.ListMemberTiers()
+		if err != nil {
+			return err
+		}
+		target := findTier(tiers, level)
+		if target == nil || !target.Subscribable() {
+			return domain.ErrSubscriptionNotAvailable
+		}
+		rank := math.MinInt
+		if current := findTier(tiers, user.Member.Level); current != nil {
+			rank = current.Rank
+		}
+
+		sub = domain.Subscription{UserID: userID, Level: level, EarnedLevel: user.Member.Level, EarnedGraceUntil: user.Member.GraceUntil,
+			Fee: target.SubscriptionFee, StartDate: now, EndDate: now.Add(target.SubscriptionPeriod()), AutoRenew: autoRenew,
+			State: domain.SubscriptionActive}
+		old, err := users.GetActiveSubscription(userID)
+		switch {
+		case err == nil:
+			if target.Rank <= rank {
+				return domain.ErrSubscriptionActive
+			}
+			// upgrade, the rest of the old period pays for part of the new one
+			sub.EarnedLevel, sub.EarnedGraceUntil = old.EarnedLevel, old.EarnedGraceUntil
+			if sub.Fee -= old.Credit(now); sub.Fee < 0 {
+				sub.Fee = 0
+			}
+			old.State = domain.SubscriptionUpgraded
+			if err := users.UpdateSubscription(old); err != nil {
+				return err
+			}
+		case !errors.Is(err, domain.ErrSubscriptionNotFound):
+			return err
+		case target.Rank <= rank:
+			return domain.ErrSubscriptionNotAvailable
+		}
+
+		if _, err := users.AdjustBalance(userID, -int(sub.Fee), 0); err != nil {
+			fmt.Println(fmt.Sprintf("[MSG] User %d has %s to subscribe to member level %d", userID, err, level))
+			return err
+		}
+		if sub.ID, err = users.AddSubscription(sub); err != nil {
+			return err
+		}
+		if err := users.SetMember(userID, domain.Member{Level: level, BuyTokenDefaultDiscount: target.BuyTokenDiscount}); err != nil {
+			return err
+		}
+		if err := post(repos.Ledger(), subscriptionEntry(sub)); err != nil {
+			return err
+		}
+		return events.emit(domain.Event{Type: domain.EventMemberSubscribed, UserID: userID, MemberLevel: level, Token: -sub.Fee})
+	})
+	if err != nil {
+		return domain.Subscription{}, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d subscribed to member level %d until %s for %d tokens", userID, level, sub.EndDate, sub.Fee))
+	return sub, nil
+}
+
+// GetSubscription returns the user's active subscription.
+func (c *cashierUsecase) GetSubscription(userID int) (domain.Subscription, error) {
+	return c.userRepo.GetActiveSubscription(userID)
+}
+
+func (c *cashierUsecase) SetSubscriptionAutoRenew(userID int, autoRenew bool) error {
+	return c.unitOfWork().Do(func(repos domain.Repositories) error {
+		sub, err := repos.Users().GetActiveSubscription(userID)
+		if err != nil {
+			return err
+		}
+		sub.AutoRenew = autoRenew
+		return repos.Users().UpdateSubscription(sub)
+	})
+}
+
+// RenewSubscriptions renews the subscriptions that end at or before at from the users' tokens, a subscription that is
+// not renewed, or whose user cannot pay, expires and the user goes back to their earned level. It is meant to be run
+// periodically and returns how many subscriptions were renewed and expired.
+func (c *cashierUsecase) RenewSubscriptions(at time.Time) (renewed int, expired int, err error) {
+	due, err := c.userRepo.ListDueSubscriptions(at)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, s := range due {
+		var outcome domain.SubscriptionState
+		err := c.do(func(repos domain.Repositories, events *eventBatch) error {
+			users := repos.Users()
+			sub, err := users.GetActiveSubscription(s.UserID)
+			if errors.Is(err, domain.ErrSubscriptionNotFound) || err == nil && (sub.ID != s.ID || sub.EndDate.After(at)) {
+				// changed since it was listed
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if tier, err := users.GetMemberTier(sub.Level); sub.AutoRenew && err == nil && tier.Subscribable() {
+				_, err := users.AdjustBalance(sub.UserID, -int(tier.SubscriptionFee), 0)
+				if err == nil {
+					sub.Fee, sub.StartDate, sub.EndDate = tier.SubscriptionFee, sub.EndDate, sub.EndDate.Add(tier.SubscriptionPeriod())
+					if err := users.UpdateSubscription(sub); err != nil {
+						return err
+					}
+					if err := post(repos.Ledger(), subscriptionEntry(sub)); err != nil {
+						return err
+					}
+					outcome = domain.SubscriptionActive
+					return events.emit(domain.Event{Type: domain.EventSubscriptionRenewed, UserID: sub.UserID, Token: -sub.Fee})
+				}
+				if !errors.Is(err, domain.ErrNotEnoughToken) {
+					return err
+				}
+				fmt.Println(fmt.Sprintf("[MSG] User %d has not enough token to renew member level %d", sub.UserID, sub.Level))
+			}
+
+			sub.State = domain.SubscriptionExpired
+			if err := users.UpdateSubscription(sub); err != nil {
+				return err
+			}
+			member := domain.Member{Level: sub.EarnedLevel, BuyTokenDefaultDiscount: users.GetDefaultBuyTokenDiscount(sub.EarnedLevel),
+				GraceUntil: sub.EarnedGraceUntil}
+			if err := users.SetMember(sub.UserID, member); err != nil {
+				return err
+			}
+			outcome = domain.SubscriptionExpired
+			return events.emit(domain.Event{Type: domain.EventSubscriptionExpired, UserID: sub.UserID, MemberLevel: sub.EarnedLevel})
+		})
+		if err != nil {
+			return renewed, expired, err
+		}
+		switch outcome {
+		case domain.SubscriptionActive:
+			renewed++
+		case domain.SubscriptionExpired:
+			expired++
+		}
+	}
+	fmt.Println(fmt.Sprintf("[MSG] %d subscriptions renewed, %d expired", renewed, expired))
+	return renewed, expired, nil
+}
+
+// subscriptionEntry moves the fee of one period of sub from the user to the cashier.
+func subscriptionEntry(sub domain.Subscription) *domain.JournalEntry {
+	entry := &domain.JournalEntry{
+		Type:   domain.TransactionSubscribe,
+		UserID: sub.UserID,
+		Memo:   fmt.Sprintf("member level %d until %s", sub.Level, sub.EndDate.Format(time.RFC3339)),
+	}
+	entry.Debit(domain.UserAccount(sub.UserID), domain.UnitToken, sub.Fee)
+	entry.Credit(domain.AccountCashierMembers, domain.UnitToken, sub.Fee)
+	return entry
+}
@@ -0,0 +1,58 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"oa-bitgin/pkg/domain"
+)
+
+// SetMemberTier adds or edits the member tier of tier.Level, users at that level get the new BuyTokenDiscount.
+// It returns how many users had their discount changed.
+func (c *cashierUsecase) SetMemberTier(tier domain.MemberTier) (int, error) {
+	if err := tier.Validate(); err != nil {
+		return 0, err
+	}
+	changed := 0
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		if err := repos.Users().SetMemberTier(tier); err != nil {
+			return err
+		}
+		var err error
+		changed, err = repos.Users().SetMemberDiscount(tier.Level, tier.BuyTokenDiscount)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Member tier %d (%s) saved, %d users updated", tier.Level, tier.Name, changed))
+	return changed, nil
+}
+
+func (c *cashierUsecase) GetMemberTier(level int) (domain.MemberTier, error) {
+	return c.userRepo.GetMemberTier(level)
+}
+
+// ListMemberTiers returns the member tiers ordered by Rank then Level.
+func (c *cashierUsecase) ListMemberTiers() ([]domain.MemberTier, error) {
+	return c.userRepo.ListMemberTiers()
+}
+
+// memberTier returns the tier of a member level, levels without a tier get the zero tier:
+// no spending limit and points given as they are.
+func memberTier(users domain.UserRepository, level int) (domain.MemberTier, error) {
+	tier, err := users.GetMemberTier(level)
+	if errors.Is(err, domain.ErrMemberTierNotFound) {
+		return domain.MemberTier{Level: level}, nil
+	}
+	return tier, err
+}
+
+// findTier returns the tier of level in tiers, nil when there is none.
+func findTier(tiers []domain.MemberTier, level int) *domain.MemberTier {
+	for i := range tiers {
+		if tiers[i].Level == level {
+			return &tiers[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"oa-bitgin/pkg/domain"
+	"time"
+)
+
+// DefaultSpendWindow is how far back purchases count toward a member upgrade.
+const DefaultSpendWindow = 365 * 24 * time.Hour
+
+// WithSpendWindow sets how far back purchases count toward a member upgrade, 0 counts every purchase.
+func WithSpendWindow(window time.Duration) Option {
+	return func(c *cashierUsecase) {
+		c.spendWindow = window
+	}
+}
+
+// GetUserSpend returns what the user spent in the spend window up to now,
+// the money paid for tokens plus the tokens paid for products less refunds.
+func (c *cashierUsecase) GetUserSpend(userID int) (int64, error) {
+	if _, err := c.userRepo.GetUser(userID); err != nil {
+		return 0, err
+	}
+	return c.userSpend(c.ledger(), userID, time.Now())
+}
+
+func (c *cashierUsecase) userSpend(ledger domain.LedgerRepository, userID int, now time.Time) (int64, error) {
+	var since time.Time
+	if c.spendWindow > 0 {
+		since = now.Add(-c.spendWindow)
+	}
+	return ledger.GetUserSpend(userID, since)
+}
+
+// upgradeMember promotes the user to the highest ranked tier their spend reaches, it runs in the unit of work of
+// a purchase after the purchase is posted. The returned event is nil when the user stays at their level.
+func (c *cashierUsecase) upgradeMember(repos domain.Repositories, userID int) (*domain.Event, error) {
+	user, err := repos.Users().GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	tiers, err := repos.Users().ListMemberTiers()
+	if err != nil {
+		return nil, err
+	}
+	// a subscriber is upgraded from the level they earned, the subscribed level is kept while it is higher
+	level := user.Member.Level
+	sub, err := repos.Users().GetActiveSubscription(userID)
+	subscribed := err == nil
+	if err != nil && !errors.Is(err, domain.ErrSubscriptionNotFound) {
+		return nil, err
+	}
+	if subscribed {
+		level = sub.EarnedLevel
+	}
+	// users at a level without a tier may be upgraded to any tier
+	rank := math.MinInt
+	if t := findTier(tiers, level); t != nil {
+		rank = t.Rank
+	}
+	candidates := make([]domain.MemberTier, 0)
+	for _, t := range tiers {
+		if t.UpgradeSpend > 0 && t.Rank > rank {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	spend, err := c.userSpend(repos.Ledger(), userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var target *domain.MemberTier
+	for i := range candidates {
+		if spend >= candidates[i].UpgradeSpend && (target == nil || candidates[i].Rank > target.Rank) {
+			target = &candidates[i]
+		}
+	}
+	if target == nil {
+		return nil, nil
+	}
+
+	if subscribed {
+		sub.EarnedLevel, sub.EarnedGraceUntil = target.Level, time.Time{}
+		if current := findTier(tiers, user.Member.Level); current != nil && current.Rank >= target.Rank {
+			return nil, repos.Users().UpdateSubscription(sub)
+		}
+		// the earned level is now higher, the subscription is not worth renewing
+		sub.AutoRenew = false
+		if err := repos.Users().UpdateSubscription(sub); err != nil {
+			return nil, err
+		}
+	}
+	member := domain.Member{Level: target.Level, BuyTokenDefaultDiscount: target.BuyTokenDiscount}
+	if err := repos.Users().SetMember(userID, member); err != nil {
+		return nil, err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] User %d upgraded to member level %d (%s) after spending %d", userID, target.Level, target.Name, spend))
+	return &domain.Event{Type: domain.EventMemberUpgraded, UserID: userID, MemberLevel: target.Level}, nil
+}
@@ -0,0 +1,30 @@
+package usecase
+
+import (
+	"fmt"
+	"oa-bitgin/pkg/domain"
+)
+
+// SetVolumeTiers replaces the volume tiers of a member level, an empty list removes them.
+func (c *cashierUsecase) SetVolumeTiers(memberLevel int, tiers []domain.VolumeTier) error {
+	seen := make(map[int64]bool)
+	for _, t := range tiers {
+		if t.MinToken < 1 || t.Discount < 1 || t.Discount > 100 || seen[t.MinToken] {
+			return fmt.Errorf("invalid volume tier %+v", t)
+		}
+		seen[t.MinToken] = true
+	}
+	err := c.unitOfWork().Do(func(repos domain.Repositories) error {
+		return repos.Users().SetVolumeTiers(memberLevel, tiers)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(fmt.Sprintf("[MSG] Member level %d has %d volume tiers", memberLevel, len(tiers)))
+	return nil
+}
+
+// GetVolumeTiers returns the volume tiers of a member level ordered by MinToken.
+func (c *cashierUsecase) GetVolumeTiers(memberLevel int) ([]domain.VolumeTier, error) {
+	return c.userRepo.ListVolumeTiers(memberLevel)
+}